@@ -0,0 +1,450 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/zignd/errors"
+)
+
+// configFiles returns the configuration files referred by pattern, which can
+// be a file, a directory, whose files with an extension supported by viper
+// are returned sorted by name, or a glob pattern.
+func configFiles(pattern string) ([]string, error) {
+	if fi, err := os.Stat(pattern); err == nil && fi.IsDir() {
+		entries, err := ioutil.ReadDir(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list the directory %s", pattern)
+		}
+		var files []string
+		for _, entry := range entries {
+			if !entry.IsDir() && supportedConfigFile(entry.Name()) {
+				files = append(files, filepath.Join(pattern, entry.Name()))
+			}
+		}
+		if len(files) == 0 {
+			return nil, errors.Errorf("directory %s has no configuration files", pattern)
+		}
+		return files, nil
+	}
+
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid pattern %s", pattern)
+	}
+	if len(files) == 0 {
+		return nil, errors.Errorf("could not find file %s", pattern)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func supportedConfigFile(name string) bool {
+	ext := strings.TrimPrefix(filepath.Ext(name), ".")
+	for _, supported := range viper.SupportedExts {
+		if ext == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// readConfigFile reads a single configuration file in any of the formats
+// supported by viper.
+func readConfigFile(file string) (map[string]interface{}, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read the configuration file %s", file)
+	}
+	all := v.AllSettings()
+	if strings.TrimPrefix(filepath.Ext(file), ".") == "hcl" {
+		all = collapseBlocks(all)
+	}
+	settings, ok := normalize(all).(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("configuration file %s is not a map", file)
+	}
+	return settings, nil
+}
+
+// settingTypes are the types the settings are decoded into, which tell the
+// blocks of the HCL files that are lists from the ones that are maps.
+var settingTypes = map[string]reflect.Type{
+	"servers":        reflect.TypeOf([]Server{}),
+	"rules":          reflect.TypeOf([]Rule{}),
+	"silences":       reflect.TypeOf([]Silence{}),
+	"discovery":      reflect.TypeOf(Discovery{}),
+	"notifications":  reflect.TypeOf(Notifications{}),
+	"remediation":    reflect.TypeOf(Remediation{}),
+	"history":        reflect.TypeOf(History{}),
+	"actions":        reflect.TypeOf(map[string]Action{}),
+	"rule_templates": reflect.TypeOf(map[string]Rule{}),
+}
+
+// collapseBlocks gives the settings parsed from an HCL file the shape they
+// have in the other formats. The HCL parser produces a list for each block,
+// which is kept for the fields decoded into a slice, like the rules of a
+// server, and replaced by its element otherwise, so that `remediation { ...
+// }` is decoded as a map.
+func collapseBlocks(settings map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(settings))
+	for k, v := range settings {
+		m[k] = collapseBlock(v, settingTypes[strings.ToLower(k)])
+	}
+	return m
+}
+
+// collapseBlock collapses v, decoded into t, which is nil when unknown.
+func collapseBlock(v interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch v := v.(type) {
+	case []map[string]interface{}:
+		if len(v) == 1 && !isList(t) {
+			return collapseBlock(v[0], t)
+		}
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = collapseBlock(val, elemType(t))
+		}
+		return s
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[k] = collapseBlock(val, fieldType(t, k))
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = collapseBlock(val, elemType(t))
+		}
+		return s
+	}
+	return v
+}
+
+func isList(t reflect.Type) bool {
+	return t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array)
+}
+
+func elemType(t reflect.Type) reflect.Type {
+	if !isList(t) {
+		return nil
+	}
+	return t.Elem()
+}
+
+// fieldType returns the type the key of a map decoded into t is decoded
+// into, matching the field names case insensitively as mapstructure does.
+func fieldType(t reflect.Type, key string) reflect.Type {
+	switch {
+	case t == nil:
+		return nil
+	case t.Kind() == reflect.Map:
+		return t.Elem()
+	case t.Kind() != reflect.Struct:
+		return nil
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Name
+		if tag := strings.Split(field.Tag.Get("mapstructure"), ",")[0]; tag != "" {
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return field.Type
+		}
+	}
+	return nil
+}
+
+// normalize converts the map[interface{}]interface{} values produced by some
+// of the parsers into map[string]interface{} so that they can be merged and
+// encoded as JSON.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = normalize(val)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[k] = normalize(val)
+		}
+		return m
+	case []map[string]interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = normalize(val)
+		}
+		return s
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = normalize(val)
+		}
+		return s
+	}
+	return v
+}
+
+// configMerger merges configuration files remembering which file defined
+// each setting in order to report conflicts.
+type configMerger struct {
+	settings map[string]interface{}
+	origins  map[string]string
+}
+
+func newConfigMerger() *configMerger {
+	return &configMerger{
+		settings: make(map[string]interface{}),
+		origins:  make(map[string]string),
+	}
+}
+
+// merge adds the settings of file. Maps are merged recursively, the
+// `servers` lists are merged by server description, with the rules of a
+// server concatenated, and the `silences`, `rules` and `include` lists are
+// concatenated. Any other setting defined with different values by two files
+// is a conflict.
+func (m *configMerger) merge(file string, settings map[string]interface{}) error {
+	for key, value := range settings {
+		var err error
+		switch strings.ToLower(key) {
+		case "servers":
+			err = m.mergeServers(file, value)
+		case "silences", "rules", "include":
+			m.settings[key] = appendList(m.settings[key], value)
+		default:
+			m.settings[key], err = m.mergeValue(key, file, m.settings[key], value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendList appends src, or its elements if it is a list, to dst, which is
+// turned into a list if needed. Nil values are ignored.
+func appendList(dst, src interface{}) []interface{} {
+	list, ok := dst.([]interface{})
+	if !ok && dst != nil {
+		list = []interface{}{dst}
+	}
+	if src == nil {
+		return list
+	}
+	if s, ok := src.([]interface{}); ok {
+		return append(list, s...)
+	}
+	return append(list, src)
+}
+
+func (m *configMerger) mergeValue(path, file string, dst, src interface{}) (interface{}, error) {
+	if dst == nil {
+		m.origins[path] = file
+		return src, nil
+	}
+	dstMap, dstOK := dst.(map[string]interface{})
+	srcMap, srcOK := src.(map[string]interface{})
+	if dstOK && srcOK {
+		for k, v := range srcMap {
+			merged, err := m.mergeValue(path+"."+k, file, dstMap[k], v)
+			if err != nil {
+				return nil, err
+			}
+			dstMap[k] = merged
+		}
+		return dstMap, nil
+	}
+	a, _ := json.Marshal(dst)
+	b, _ := json.Marshal(src)
+	if bytes.Equal(a, b) {
+		return dst, nil
+	}
+	return nil, errors.Errorcf(map[string]interface{}{
+		"setting": path,
+		"files":   []string{m.origin(path), file},
+	}, "setting `%s` is defined with different values in %s and %s", path, m.origin(path), file)
+}
+
+// origin returns the file that defined the setting at path, which is the
+// file that defined its closest parent when the setting came with it.
+func (m *configMerger) origin(path string) string {
+	for {
+		if file, ok := m.origins[path]; ok {
+			return file
+		}
+		i := strings.LastIndex(path, ".")
+		if i < 0 {
+			return ""
+		}
+		path = path[:i]
+	}
+}
+
+// lookup returns the value of key in item ignoring its case.
+func lookup(item map[string]interface{}, key string) (string, interface{}) {
+	for k, v := range item {
+		if strings.EqualFold(k, key) {
+			return k, v
+		}
+	}
+	return key, nil
+}
+
+func (m *configMerger) mergeServers(file string, value interface{}) error {
+	servers := appendList(nil, value)
+	merged, _ := m.settings["servers"].([]interface{})
+	for _, s := range servers {
+		server, ok := s.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("`servers` setting in %s has an item that is not a map", file)
+		}
+		_, description := lookup(server, "description")
+		path := fmt.Sprintf("servers[%v]", description)
+
+		var existing map[string]interface{}
+		for _, e := range merged {
+			e := e.(map[string]interface{})
+			if _, d := lookup(e, "description"); fmt.Sprint(d) == fmt.Sprint(description) {
+				existing = e
+				break
+			}
+		}
+		if existing == nil {
+			m.origins[path] = file
+			merged = append(merged, server)
+			if err := m.checkRules(path, file, nil, server); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for k, v := range server {
+			if strings.EqualFold(k, "rules") {
+				continue
+			}
+			ek, ev := lookup(existing, k)
+			mv, err := m.mergeValue(path+"."+strings.ToLower(k), file, ev, v)
+			if err != nil {
+				return err
+			}
+			existing[ek] = mv
+		}
+		_, rules := lookup(server, "rules")
+		if rules == nil {
+			continue
+		}
+		if err := m.checkRules(path, file, existing, server); err != nil {
+			return err
+		}
+		rk, existingRules := lookup(existing, "rules")
+		existing[rk] = appendList(existingRules, rules)
+	}
+	m.settings["servers"] = merged
+	return nil
+}
+
+// checkRules reports a conflict when a rule of server has the same ID as one
+// already defined, in existing or in another rule of server.
+func (m *configMerger) checkRules(path, file string, existing, server map[string]interface{}) error {
+	ids := make(map[string]bool)
+	if existing != nil {
+		_, rules := lookup(existing, "rules")
+		for _, r := range appendList(nil, rules) {
+			if rule, ok := r.(map[string]interface{}); ok {
+				_, id := lookup(rule, "id")
+				ids[fmt.Sprint(id)] = true
+			}
+		}
+	}
+	_, rules := lookup(server, "rules")
+	if rules == nil {
+		return nil
+	}
+	for _, r := range appendList(nil, rules) {
+		rule, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		_, id := lookup(rule, "id")
+		rulePath := fmt.Sprintf("%s.rules[%v]", path, id)
+		if ids[fmt.Sprint(id)] {
+			return errors.Errorcf(map[string]interface{}{
+				"setting": rulePath,
+				"files":   []string{m.origins[rulePath], file},
+			}, "rule %v of server %s is defined in %s and %s", id, path, m.origins[rulePath], file)
+		}
+		ids[fmt.Sprint(id)] = true
+		m.origins[rulePath] = file
+	}
+	return nil
+}
+
+// readConfigFiles merges the configuration files matched by pattern, and the
+// ones matched by the `include` patterns of those files, relative to the
+// file declaring them, into viper.
+func readConfigFiles(pattern string) error {
+	merger := newConfigMerger()
+	seen := make(map[string]bool)
+	patterns := []string{pattern}
+	for len(patterns) > 0 {
+		files, err := configFiles(patterns[0])
+		if err != nil {
+			return err
+		}
+		patterns = patterns[1:]
+		for _, file := range files {
+			abs, err := filepath.Abs(file)
+			if err != nil {
+				return errors.Wrapf(err, "failed to resolve the path of %s", file)
+			}
+			if seen[abs] {
+				continue
+			}
+			seen[abs] = true
+
+			settings, err := readConfigFile(file)
+			if err != nil {
+				return err
+			}
+			_, includes := lookup(settings, "include")
+			for _, include := range appendList(nil, includes) {
+				p := fmt.Sprint(include)
+				if !filepath.IsAbs(p) {
+					p = filepath.Join(filepath.Dir(file), p)
+				}
+				patterns = append(patterns, p)
+			}
+			if err := merger.merge(file, settings); err != nil {
+				return errors.Wrap(err, "failed to merge the configuration files")
+			}
+		}
+	}
+
+	b, err := json.Marshal(merger.settings)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the merged configuration")
+	}
+	viper.SetConfigType("json")
+	if err := viper.ReadConfig(bytes.NewReader(b)); err != nil {
+		return errors.Wrap(err, "failed to read the merged configuration")
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// writeConfigFiles writes files, by name, into a temporary directory and
+// returns it, the settings they are read into being reset after the test.
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	return dir
+}
+
+func TestReadConfigFiles(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"1-servers.yaml": `
+delay: 1000
+servers:
+- description: main
+  host: rabbit-1
+  rules:
+  - id: backlog
+    delay: 30000
+`,
+		"2-labels.json": `{
+  "delay": 1000,
+  "servers": [{"description": "main", "labels": {"env": "prod"}, "rules": [{"id": "consumers"}]}]
+}`,
+		"3-remediation.toml": `
+[remediation.circuit_breaker]
+window = 60000
+max_failures = 3
+`,
+		"4-other.hcl": `
+servers {
+  description = "other"
+  host = "rabbit-2"
+  rules {
+    id = "backlog"
+    actions {
+      description = "notify"
+      cmd = "notify-ops"
+    }
+  }
+}
+remediation {
+  circuit_breaker {
+    cooldown = 300000
+  }
+}
+`,
+	})
+	if err := readConfigFiles(dir); err != nil {
+		t.Fatalf("readConfigFiles() error = %v", err)
+	}
+
+	var servers []Server
+	if err := viper.UnmarshalKey("servers", &servers); err != nil {
+		t.Fatalf("failed to decode the servers: %v", err)
+	}
+	want := []Server{
+		{
+			Description: "main",
+			Host:        "rabbit-1",
+			Labels:      map[string]string{"env": "prod"},
+			Rules:       []Rule{{ID: "backlog", Delay: 30000}, {ID: "consumers"}},
+		},
+		{
+			Description: "other",
+			Host:        "rabbit-2",
+			Rules:       []Rule{{ID: "backlog", Actions: []Action{{Description: "notify", Cmd: "notify-ops"}}}},
+		},
+	}
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("servers = %+v, want %+v", servers, want)
+	}
+
+	var remediation Remediation
+	if err := viper.UnmarshalKey("remediation", &remediation); err != nil {
+		t.Fatalf("failed to decode the remediation: %v", err)
+	}
+	breaker := remediation.CircuitBreaker
+	if breaker.Window != 60000 || breaker.MaxFailures != 3 || breaker.Cooldown != 300000 {
+		t.Errorf("circuit breaker = %+v, want the settings of both files", breaker)
+	}
+	if delay := viper.GetInt("delay"); delay != 1000 {
+		t.Errorf("delay = %d, want 1000", delay)
+	}
+}
+
+func TestReadConfigFilesConflicts(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		err   string
+	}{
+		{
+			name: "setting",
+			files: map[string]string{
+				"a.yaml": "delay: 1000\n",
+				"b.json": `{"delay": 2000}`,
+			},
+			err: "setting `delay` is defined with different values in",
+		},
+		{
+			name: "nested setting",
+			files: map[string]string{
+				"a.yaml": "remediation:\n  circuit_breaker:\n    window: 1000\n",
+				"b.hcl":  "remediation {\n  circuit_breaker {\n    window = 2000\n  }\n}\n",
+			},
+			err: "setting `remediation.circuit_breaker.window` is defined with different values in",
+		},
+		{
+			name: "server setting",
+			files: map[string]string{
+				"a.yaml": "servers:\n- description: main\n  host: rabbit-1\n",
+				"b.toml": "[[servers]]\ndescription = \"main\"\nhost = \"rabbit-2\"\n",
+			},
+			err: "setting `servers[main].host` is defined with different values in",
+		},
+		{
+			name: "rule",
+			files: map[string]string{
+				"a.yaml": "servers:\n- description: main\n  rules:\n  - id: backlog\n",
+				"b.json": `{"servers": [{"description": "main", "rules": [{"id": "backlog"}]}]}`,
+			},
+			err: "rule backlog of server servers[main] is defined in",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeConfigFiles(t, test.files)
+			err := readConfigFiles(dir)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("readConfigFiles() error = %v, want %q", err, test.err)
+			}
+			for name := range test.files {
+				if !strings.Contains(err.Error(), filepath.Join(dir, name)) {
+					t.Errorf("readConfigFiles() error = %v, want it to report %s", err, name)
+				}
+			}
+		})
+	}
+}
+
+func TestReadConfigFilesEqualSettings(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"a.yaml": "delay: 1000\nservers:\n- description: main\n  host: rabbit-1\n",
+		"b.json": `{"delay": 1000, "servers": [{"description": "main", "host": "rabbit-1"}]}`,
+	})
+	if err := readConfigFiles(dir); err != nil {
+		t.Errorf("readConfigFiles() error = %v, want the equal settings merged", err)
+	}
+}
+
+// The blocks of an HCL file have the shape of the same settings in YAML.
+func TestReadConfigFileHCLBlocks(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.yaml": `
+servers:
+- description: main
+  labels:
+    env: prod
+  rules:
+  - id: backlog
+    escalation:
+    - after: 60000
+      actions:
+      - description: page
+        cmd: page-ops
+    actions:
+    - description: notify
+      cmd: notify-ops
+      options:
+        channel: ops
+remediation:
+  circuit_breaker:
+    window: 60000
+actions:
+  notify:
+    cmd: notify-ops
+`,
+		"config.hcl": `
+servers {
+  description = "main"
+  labels {
+    env = "prod"
+  }
+  rules {
+    id = "backlog"
+    escalation {
+      after = 60000
+      actions {
+        description = "page"
+        cmd = "page-ops"
+      }
+    }
+    actions {
+      description = "notify"
+      cmd = "notify-ops"
+      options {
+        channel = "ops"
+      }
+    }
+  }
+}
+remediation {
+  circuit_breaker {
+    window = 60000
+  }
+}
+actions {
+  notify {
+    cmd = "notify-ops"
+  }
+}
+`,
+	})
+	yaml, err := readConfigFile(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("readConfigFile() error = %v", err)
+	}
+	hcl, err := readConfigFile(filepath.Join(dir, "config.hcl"))
+	if err != nil {
+		t.Fatalf("readConfigFile() error = %v", err)
+	}
+	if !reflect.DeepEqual(hcl, yaml) {
+		t.Errorf("readConfigFile() of the HCL file = %v, want %v", hcl, yaml)
+	}
+}
@@ -3,7 +3,10 @@ package common
 import (
 	"os"
 	"path"
+	"reflect"
+	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/zignd/errors"
@@ -11,8 +14,22 @@ import (
 
 // ConfigFlags configures the application flags.
 func ConfigFlags() error {
-	pflag.String("config-file", "$XDG_CONFIG_HOME/config.yaml", "Configuration file with information regarding the connection to the server, expressions and actions to be taken.")
+	pflag.String("config-file", "$XDG_CONFIG_HOME/config.yaml", "Configuration file with information regarding the connection to the server, expressions and actions to be taken. Can also be a directory or a glob pattern, in which case the configuration files are merged.")
 	pflag.Bool("run-once", false, "Performs the verifications defined in the configuration file only once. When set to `true` the `Frequency` setting is ignored.")
+	pflag.Bool("dry-run", false, "Performs the requests, evaluations and delay verifications but prints the actions that would be executed as a JSON summary instead of executing them.")
+	pflag.Bool("record", false, "Saves the responses of the performed requests and the outcome of each rule into the fixtures directory so that they can be replayed by the `test` command. Requires `--run-once`, the actions are not executed, as with `--dry-run`.")
+	pflag.String("fixtures-dir", "fixtures", "Directory of the fixtures used by the `test` command and written by the `--record` flag.")
+	pflag.String("log-format", "text", "Format of the log entries, either `text` or `json`.")
+	pflag.String("log-level", "info", "Minimum level of the log entries, one of `debug`, `info`, `warn` or `error`.")
+	pflag.String("state-dir", "$XDG_DATA_HOME/lophutch", "Directory where the state that must survive restarts, like the silences, is persisted.")
+	pflag.String("listen", "", "Address of the HTTP API, e.g. `:8080`. The API is disabled when empty and is not available with `--run-once`.")
+	pflag.String("silence-server", "", "Description of the server matched by the silence created by the `silence add` command.")
+	pflag.String("silence-rule", "", "ID of the rule matched by the silence created by the `silence add` command.")
+	pflag.StringSlice("silence-label", nil, "Label, in the `name=value` form, matched by the silence created by the `silence add` command. Can be repeated.")
+	pflag.String("silence-start", "", "Start of the silence created by the `silence add` command in the RFC 3339 format. Defaults to now.")
+	pflag.Duration("silence-duration", time.Hour, "Duration of the silence created by the `silence add` command.")
+	pflag.String("silence-reason", "", "Why the silence created by the `silence add` command is needed.")
+	pflag.String("silence-created-by", os.Getenv("USER"), "Who is creating or expiring a silence through the `silence` command.")
 	pflag.Parse()
 	viper.BindPFlags(pflag.CommandLine)
 
@@ -25,14 +42,80 @@ func ConfigFlags() error {
 		} else {
 			viper.AddConfigPath("$HOME/.config/lophutch")
 		}
+		viper.ReadInConfig()
+	} else if fi, err := os.Stat(configFile); err == nil && !fi.IsDir() {
+		viper.SetConfigFile(configFile)
+		viper.ReadInConfig()
 	} else {
-		if fi, err := os.Stat(configFile); (fi != nil && fi.IsDir()) || os.IsNotExist(err) {
-			return errors.Wrapf(err, "could not find file %s", configFile)
+		if err := readConfigFiles(configFile); err != nil {
+			return errors.Wrapf(err, "failed to read the configuration files %s", configFile)
+		}
+	}
+
+	if used := viper.ConfigFileUsed(); used != "" && viper.IsSet("include") {
+		if err := readConfigFiles(used); err != nil {
+			return errors.Wrapf(err, "failed to read the configuration files included by %s", used)
 		}
-		viper.SetConfigFile(configFile)
 	}
 
-	viper.ReadInConfig()
+	if err := configLogger(); err != nil {
+		return errors.Wrap(err, "failed to configure the logger")
+	}
 
 	return nil
 }
+
+// configLogger replaces Log with a logger based on the `log-format` and
+// `log-level` settings, which can be provided either as flags or in the
+// configuration file.
+func configLogger() error {
+	level, err := ParseLevel(viper.GetString("log-level"))
+	if err != nil {
+		return errors.Wrap(err, "invalid `log-level` setting")
+	}
+	logger, err := NewLogger(os.Stderr, viper.GetString("log-format"), level)
+	if err != nil {
+		return errors.Wrap(err, "invalid `log-format` setting")
+	}
+	Log = logger
+	return nil
+}
+
+// StateDir returns the directory set by the `state-dir` setting, resolving
+// its default to `$XDG_DATA_HOME/lophutch` or `$HOME/.local/share/lophutch`.
+func StateDir() string {
+	stateDir := viper.GetString("state-dir")
+	if stateDir != "$XDG_DATA_HOME/lophutch" {
+		return stateDir
+	}
+	if xdgDataHome := os.Getenv("XDG_DATA_HOME"); xdgDataHome != "" {
+		return path.Join(xdgDataHome, "lophutch")
+	}
+	return path.Join(os.Getenv("HOME"), ".local", "share", "lophutch")
+}
+
+// UnmarshalKey works like viper.UnmarshalKey but also converts RFC 3339
+// strings into time.Time values.
+func UnmarshalKey(key string, rawVal interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           rawVal,
+		WeaklyTypedInput: true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			stringToTimeHookFunc(),
+		),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create the decoder")
+	}
+	return decoder.Decode(viper.Get(key))
+}
+
+func stringToTimeHookFunc() mapstructure.DecodeHookFunc {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String || t != reflect.TypeOf(time.Time{}) {
+			return data, nil
+		}
+		return time.Parse(time.RFC3339, data.(string))
+	}
+}
@@ -0,0 +1,275 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zignd/errors"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLevel converts the name of a level into a Level.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, errors.Errorf("unknown log level %s", name)
+}
+
+// Fields are the structured data attached to a log entry.
+type Fields map[string]interface{}
+
+// Logger writes leveled log entries with structured fields either as text,
+// in the `key=value` form, or as one JSON object per line.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	json   bool
+	level  Level
+	fields Fields
+}
+
+// NewLogger returns a Logger writing to out entries of at least the provided
+// level. The format must be either `text` or `json`.
+func NewLogger(out io.Writer, format string, level Level) (*Logger, error) {
+	var isJSON bool
+	switch strings.ToLower(format) {
+	case "text", "":
+	case "json":
+		isJSON = true
+	default:
+		return nil, errors.Errorf("unknown log format %s", format)
+	}
+	return &Logger{
+		mu:     &sync.Mutex{},
+		out:    out,
+		json:   isJSON,
+		level:  level,
+		fields: Fields{},
+	}, nil
+}
+
+// Log is the logger used by the application, it is configured by ConfigFlags
+// based on the `log-format` and `log-level` settings.
+var Log = &Logger{
+	mu:     &sync.Mutex{},
+	out:    os.Stderr,
+	level:  InfoLevel,
+	fields: Fields{},
+}
+
+// With returns a Logger that attaches fields to every entry in addition to
+// the ones already attached to l.
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{
+		mu:     l.mu,
+		out:    l.out,
+		json:   l.json,
+		level:  l.level,
+		fields: merged,
+	}
+}
+
+// WithError returns a Logger that attaches err to every entry. The contexts
+// of the errors created by github.com/zignd/errors are attached as the
+// `error_context` field instead of being part of the error message, the
+// outermost context wins when a key is present in more than one of them.
+func (l *Logger) WithError(err error) *Logger {
+	fields := Fields{"error": err.Error()}
+	ctx := make(map[string]interface{})
+	for err != nil {
+		e, ok := unwrapError(err)
+		if !ok {
+			break
+		}
+		for k, v := range e.Context {
+			if _, ok := ctx[k]; !ok {
+				ctx[k] = v
+			}
+		}
+		err = e.Cause
+	}
+	if len(ctx) > 0 {
+		fields["error_context"] = ctx
+	}
+	return l.With(fields)
+}
+
+func unwrapError(err error) (*errors.Error, bool) {
+	switch e := err.(type) {
+	case *errors.Error:
+		return e, true
+	case errors.Error:
+		return &e, true
+	}
+	return nil, false
+}
+
+// Debug logs msg at the debug level.
+func (l *Logger) Debug(msg string) { l.log(DebugLevel, msg) }
+
+// Info logs msg at the info level.
+func (l *Logger) Info(msg string) { l.log(InfoLevel, msg) }
+
+// Warn logs msg at the warn level.
+func (l *Logger) Warn(msg string) { l.log(WarnLevel, msg) }
+
+// Error logs msg at the error level.
+func (l *Logger) Error(msg string) { l.log(ErrorLevel, msg) }
+
+// Fatal logs msg at the error level and exits the application.
+func (l *Logger) Fatal(msg string) {
+	l.log(ErrorLevel, msg)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string) {
+	if level < l.level {
+		return
+	}
+
+	var line []byte
+	if l.json {
+		line = l.formatJSON(level, msg)
+	} else {
+		line = l.formatText(level, msg)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+func (l *Logger) formatJSON(level Level, msg string) []byte {
+	entry := make(map[string]interface{}, len(l.fields)+3)
+	for k, v := range l.fields {
+		entry[k] = jsonValue(v)
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{
+			"time":  entry["time"],
+			"level": entry["level"],
+			"msg":   msg,
+			"error": fmt.Sprintf("failed to encode the log entry: %s", err.Error()),
+		})
+	}
+	return append(b, '\n')
+}
+
+// jsonValue returns v if it can be encoded as JSON, otherwise its textual
+// representation. Maps are handled per key so that a single unencodable
+// value, like an *http.Request, does not hide the rest of an error context.
+func jsonValue(v interface{}) interface{} {
+	if m, ok := v.(map[string]interface{}); ok {
+		out := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			out[k] = jsonValue(v)
+		}
+		return out
+	}
+	if d, ok := v.(time.Duration); ok {
+		return d.String()
+	}
+	if _, err := json.Marshal(v); err != nil {
+		return fmt.Sprintf("%+v", v)
+	}
+	return v
+}
+
+func (l *Logger) formatText(level Level, msg string) []byte {
+	var sb strings.Builder
+	sb.WriteString(time.Now().Format(time.RFC3339))
+	sb.WriteString(" ")
+	sb.WriteString(strings.ToUpper(level.String()))
+	sb.WriteString(" ")
+	sb.WriteString(msg)
+	writeTextFields(&sb, "", l.fields)
+	sb.WriteString("\n")
+	return []byte(sb.String())
+}
+
+func writeTextFields(sb *strings.Builder, prefix string, fields map[string]interface{}) {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		switch v := fields[k].(type) {
+		case map[string]interface{}:
+			writeTextFields(sb, prefix+k+".", v)
+		case Fields:
+			writeTextFields(sb, prefix+k+".", v)
+		case map[string]string:
+			m := make(map[string]interface{}, len(v))
+			for mk, mv := range v {
+				m[mk] = mv
+			}
+			writeTextFields(sb, prefix+k+".", m)
+		default:
+			fmt.Fprintf(sb, " %s%s=%s", prefix, k, textValue(v))
+		}
+	}
+}
+
+func textValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprintf("%v", v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
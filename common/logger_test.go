@@ -0,0 +1,219 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zignd/errors"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		level   Level
+		invalid bool
+	}{
+		{name: "debug", level: DebugLevel},
+		{name: "INFO", level: InfoLevel},
+		{name: "warn", level: WarnLevel},
+		{name: "warning", level: WarnLevel},
+		{name: "error", level: ErrorLevel},
+		{name: "trace", level: InfoLevel, invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			level, err := ParseLevel(test.name)
+			if (err != nil) != test.invalid {
+				t.Fatalf("ParseLevel() error = %v, want an error %t", err, test.invalid)
+			}
+			if level != test.level {
+				t.Errorf("ParseLevel() = %s, want %s", level, test.level)
+			}
+		})
+	}
+}
+
+func TestNewLoggerUnknownFormat(t *testing.T) {
+	if _, err := NewLogger(&bytes.Buffer{}, "xml", InfoLevel); err == nil {
+		t.Error("NewLogger() error = nil, want the unknown format")
+	}
+}
+
+// textEntry returns the entry of line without its time.
+func textEntry(t *testing.T, line string) string {
+	t.Helper()
+	i := strings.Index(line, " ")
+	if i < 0 {
+		t.Fatalf("invalid log line %q", line)
+	}
+	if _, err := time.Parse(time.RFC3339, line[:i]); err != nil {
+		t.Errorf("log line %q does not start with its time: %v", line, err)
+	}
+	return line[i+1:]
+}
+
+func TestLoggerText(t *testing.T) {
+	tests := []struct {
+		name  string
+		log   func(l *Logger)
+		entry string
+	}{
+		{
+			name:  "message",
+			log:   func(l *Logger) { l.Info("Scout started") },
+			entry: "INFO Scout started\n",
+		},
+		{
+			name: "sorted fields",
+			log: func(l *Logger) {
+				l.With(Fields{"server": "main", "rule": "backlog", "duration": 1500 * time.Millisecond}).Warn("Rule processed")
+			},
+			entry: "WARN Rule processed duration=1.5s rule=backlog server=main\n",
+		},
+		{
+			name:  "quoted values",
+			log:   func(l *Logger) { l.With(Fields{"reason": "rate limit", "empty": "", "quote": `a"b`}).Info("Skipped") },
+			entry: `INFO Skipped empty="" quote="a\"b" reason="rate limit"` + "\n",
+		},
+		{
+			name: "nested fields",
+			log: func(l *Logger) {
+				l.With(Fields{"labels": map[string]string{"env": "prod"}, "ctx": Fields{"a": map[string]interface{}{"b": 1}}}).Info("Fired")
+			},
+			entry: "INFO Fired ctx.a.b=1 labels.env=prod\n",
+		},
+		{
+			name:  "filtered level",
+			log:   func(l *Logger) { l.Debug("Response received") },
+			entry: "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			l, err := NewLogger(&out, "text", InfoLevel)
+			if err != nil {
+				t.Fatalf("NewLogger() error = %v", err)
+			}
+			test.log(l)
+			entry := out.String()
+			if entry != "" {
+				entry = textEntry(t, entry)
+			}
+			if entry != test.entry {
+				t.Errorf("log entry = %q, want %q", entry, test.entry)
+			}
+		})
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	cause := errors.Errorcf(map[string]interface{}{
+		"status": 500,
+		"path":   "/api/overview",
+	}, "HTTP request failed")
+	tests := []struct {
+		name  string
+		log   func(l *Logger)
+		entry map[string]interface{}
+	}{
+		{
+			name: "fields",
+			log: func(l *Logger) {
+				l.With(Fields{"scout": "abc", "duration": time.Second}).With(Fields{"rule": "backlog"}).Error("Rule failed")
+			},
+			entry: map[string]interface{}{
+				"level":    "error",
+				"msg":      "Rule failed",
+				"scout":    "abc",
+				"rule":     "backlog",
+				"duration": "1s",
+			},
+		},
+		{
+			// The outermost context wins.
+			name: "error contexts",
+			log: func(l *Logger) {
+				err := errors.Wrapc(cause, map[string]interface{}{"path": "/api/queues", "rule": "backlog"}, "failed to process the rule")
+				l.WithError(err).Error("Processing rule... Fail")
+			},
+			entry: map[string]interface{}{
+				"level": "error",
+				"msg":   "Processing rule... Fail",
+				"error": "failed to process the rule: HTTP request failed",
+				"error_context": map[string]interface{}{
+					"status": 500.0,
+					"path":   "/api/queues",
+					"rule":   "backlog",
+				},
+			},
+		},
+		{
+			name: "error without context",
+			log:  func(l *Logger) { l.WithError(errors.New("unavailable")).Warn("Retrying") },
+			entry: map[string]interface{}{
+				"level": "warn",
+				"msg":   "Retrying",
+				"error": "unavailable",
+			},
+		},
+		{
+			name: "unencodable value",
+			log: func(l *Logger) {
+				l.With(Fields{"ctx": map[string]interface{}{"handler": http.HandlerFunc(nil), "count": 2}}).Info("Request")
+			},
+			entry: map[string]interface{}{
+				"level": "info",
+				"msg":   "Request",
+				"ctx":   map[string]interface{}{"handler": "<nil>", "count": 2.0},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			l, err := NewLogger(&out, "json", DebugLevel)
+			if err != nil {
+				t.Fatalf("NewLogger() error = %v", err)
+			}
+			test.log(l)
+			var entry map[string]interface{}
+			if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+				t.Fatalf("invalid log entry %q: %v", out.String(), err)
+			}
+			if _, err := time.Parse(time.RFC3339Nano, entry["time"].(string)); err != nil {
+				t.Errorf("log entry time %v: %v", entry["time"], err)
+			}
+			delete(entry, "time")
+			if !reflect.DeepEqual(entry, test.entry) {
+				t.Errorf("log entry = %v, want %v", entry, test.entry)
+			}
+		})
+	}
+}
+
+func TestLoggerWithKeepsTheParentFields(t *testing.T) {
+	var out bytes.Buffer
+	l, err := NewLogger(&out, "text", InfoLevel)
+	if err != nil {
+		t.Fatalf("NewLogger() error = %v", err)
+	}
+	parent := l.With(Fields{"server": "main"})
+	parent.With(Fields{"server": "other", "rule": "backlog"}).Info("Child")
+	parent.Info("Parent")
+	lines := strings.SplitAfter(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("log = %q, want two entries", out.String())
+	}
+	if entry := textEntry(t, lines[0]); entry != "INFO Child rule=backlog server=other\n" {
+		t.Errorf("child entry = %q", entry)
+	}
+	if entry := textEntry(t, lines[1]); entry != "INFO Parent server=main" {
+		t.Errorf("parent entry = %q", entry)
+	}
+}
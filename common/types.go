@@ -2,24 +2,249 @@ package common
 
 import "time"
 
+// Action is a command executed when a rule evaluates to true.
+//
+// OnFailure decides what happens when the command fails: `stop`, the
+// default, skips the remaining actions of the rule, `continue` executes them
+// anyway and `retry` executes the command again up to Retries times, waiting
+// Backoff milliseconds before the first retry and doubling it after each one,
+// before stopping. Consecutive actions with the same non-empty Group are
+// executed in parallel.
+//
+// Use refers to an action of the `actions` setting by name, the fields set in
+// the action override the ones of the named action and Params replace the
+// `${name}` placeholders of the named action.
+//
+// Builtin runs a built-in action of the rules, e.g. `reapply_definitions`,
+// with its Options instead of executing Cmd.
+//
+// Args are Go templates only when Templated is set, otherwise they are passed
+// unchanged so that literal `{{`, e.g. of a `--format` argument, are kept.
 type Action struct {
+	Use         string            `json:",omitempty"`
+	Params      map[string]string `json:",omitempty"`
 	Description string
 	Cmd         string
 	Args        []string
+	Templated   bool                   `json:",omitempty"`
+	Builtin     string                 `json:",omitempty"`
+	Options     map[string]interface{} `json:",omitempty"`
+	OnFailure   string                 `mapstructure:"on_failure" json:",omitempty"`
+	Retries     int                    `json:",omitempty"`
+	Backoff     time.Duration          `json:",omitempty"`
+	Group       string                 `json:",omitempty"`
+	RateLimit   *RateLimit             `mapstructure:"rate_limit" json:",omitempty"`
 }
 
+// RateLimit allows at most Max executions within Window milliseconds.
+type RateLimit struct {
+	Max    int
+	Window time.Duration
+}
+
+// CircuitBreaker stops the execution of every action once MaxExecutions
+// actions were executed, or MaxFailures actions failed, within Window
+// milliseconds. Its Actions are executed when it opens, and it closes again
+// after Cooldown milliseconds, or only on restart when Cooldown is zero.
+type CircuitBreaker struct {
+	MaxExecutions int `mapstructure:"max_executions"`
+	MaxFailures   int `mapstructure:"max_failures"`
+	Window        time.Duration
+	Cooldown      time.Duration
+	Actions       []Action
+}
+
+// Remediation limits the execution of the actions of every rule.
+type Remediation struct {
+	RateLimit      *RateLimit     `mapstructure:"rate_limit"`
+	CircuitBreaker CircuitBreaker `mapstructure:"circuit_breaker"`
+}
+
+// Probe publishes a message to Queue, in Vhost, through AMQP using the
+// credentials of the server and consumes it back, within Timeout
+// milliseconds. Port is the AMQP port of the server, 5671 with TLS when the
+// server protocol is `https` and 5672 otherwise.
+type Probe struct {
+	Port    int
+	Vhost   string
+	Queue   string
+	Timeout time.Duration
+}
+
+// Request is a request of the Management API. A response other than 200 is
+// an error unless AnyStatus is set, in which case the evaluator receives it.
+// Body is sent as the JSON body of the request, e.g. with the POST requests
+// of `/api/queues/{vhost}/{name}/get`. Path is a Go template only when
+// Templated is set, like the arguments of an Action.
 type Request struct {
-	Method string
-	Path   string
+	Method    string
+	Path      string
+	Templated bool
+	AnyStatus bool `mapstructure:"any_status"`
+	Format    string
+	Port      int
+	Columns   []string
+	Body      string
 }
 
+// Rule is evaluated against the response of Request to decide whether its
+// Actions must be executed.
+//
+// Template refers to a rule of the `rule_templates` setting by name, the
+// fields set in the rule override the ones of the template and Params replace
+// the `${name}` placeholders of the template.
 type Rule struct {
+	Template    string
+	Params      map[string]string
 	ID          string
 	Description string
+	Labels      map[string]string
 	Request     Request
 	Evaluator   string
 	Delay       time.Duration
 	Actions     []Action
+	Escalation  []EscalationStep
+	Samples     []Sample
+	Checks      []Check
+	// OnStatus maps response statuses, e.g. `404` or `5xx`, to the actions
+	// executed instead of evaluating the rule.
+	OnStatus map[string][]Action `mapstructure:"on_status"`
+	// Probe replaces the request of the rule by an AMQP probe, whose
+	// result is evaluated instead of a Management API response.
+	Probe *Probe
+	// Builtin replaces the request and the evaluator of the rule by a
+	// check of a built-in rule pack.
+	Builtin *Builtin
+	// Drift replaces the request and the evaluator of the rule by a
+	// comparison of the definitions of the server with the desired ones.
+	Drift *Drift
+	// Changes replaces the request of the rule by snapshots of Management
+	// API collections, compared with the previous snapshot at each scout.
+	Changes *Changes
+	// Trigger lists the types of the events of the event exchange of the
+	// server, e.g. `queue.deleted` or `consumer.*`, that process the rule,
+	// which is then not processed by the scouts.
+	Trigger []string
+	// DeadLetters samples the messages of a dead-letter queue when the
+	// actions of the rule are executed, so that they can refer to them.
+	DeadLetters *DeadLetters `mapstructure:"dead_letters"`
+	// Selector attaches a rule of the `rules` setting to every server whose
+	// labels it matches, e.g. `env=prod, team!=payments, vhost`.
+	Selector string
+	// SkipDelayOnFailure does not delay the actions of the rule when any
+	// of them fails, so that they are executed again on the next scout.
+	SkipDelayOnFailure bool `mapstructure:"skip_delay_on_failure"`
+}
+
+// EscalationStep executes its Actions once the rule has been evaluating to
+// true for After milliseconds, unless the rule is acknowledged or resolves
+// before that.
+type EscalationStep struct {
+	After   time.Duration
+	Actions []Action
+}
+
+// Sample records the number at Path, a dot separated path, of the response
+// body in the history of the rule under Name. When the body is an array,
+// each element is sampled separately, as the entity at its Entity path,
+// `name` by default.
+type Sample struct {
+	Name   string
+	Path   string
+	Entity string
+}
+
+// Check fires when Function, applied to the Sample samples of each entity
+// within Window milliseconds, or all of them when Window is zero, is above
+// Above or below Below. The functions are `derivative`, the change per
+// second, `average`, `min`, `max`, `time_to_reach`, the seconds until Target
+// is reached according to a linear regression, and `anomaly`.
+//
+// `anomaly` is the number of standard deviations between the last sample and
+// the baseline learned from the previous ones, an exponentially weighted
+// moving average with Alpha as smoothing factor. When Hourly is set, only the
+// samples of the same hour of the day are part of the baseline, which the
+// History must hold more than a day of. The standard deviation is at least
+// MinStddev so that a flat series does not fire on its first change. It
+// fires, unless Above or Below are set, once the deviation exceeds Sigmas,
+// but only when the baseline has at least WarmUp samples.
+type Check struct {
+	Sample    string
+	Function  string
+	Window    time.Duration
+	Target    float64
+	Above     *float64
+	Below     *float64
+	Sigmas    float64
+	Alpha     float64
+	Hourly    bool
+	WarmUp    int     `mapstructure:"warm_up"`
+	MinStddev float64 `mapstructure:"min_stddev"`
+}
+
+// History configures the samples kept for each rule and entity: at most Size
+// samples, dropped once no sample was recorded for Retention milliseconds,
+// and persisted in the state directory when Persist is set.
+type History struct {
+	Size      int
+	Retention time.Duration
+	Persist   bool
+}
+
+// Builtin is a check of a built-in rule pack, e.g. `nodes/memory-alarm`,
+// restricted to the queues of Vhost when set, which fires when any of its
+// Thresholds is crossed.
+type Builtin struct {
+	Check      string
+	Vhost      string
+	Thresholds map[string]float64
+}
+
+// Drift compares the definitions of a server with the desired ones of File,
+// a definitions file as exported by the Management API. Kinds restricts the
+// comparison to some of `vhosts`, `users`, `permissions`, `policies`,
+// `exchanges`, `queues` and `bindings`, and IgnoreUnexpected ignores the objects of the server
+// that are not in File.
+type Drift struct {
+	File             string
+	Kinds            []string
+	IgnoreUnexpected bool `mapstructure:"ignore_unexpected"`
+}
+
+// Changes snapshots the Collections of the Management API, some of `queues`,
+// `exchanges`, `bindings`, `consumers`, `policies`, `connections` and
+// `channels`, all of them but the connections and channels by default. Vhost
+// restricts the snapshots to a virtual host.
+type Changes struct {
+	Collections []string
+	Vhost       string
+}
+
+// DeadLetters peeks the first Count messages, 10 by default, of the Queue of
+// Vhost and puts them back. Their payloads are truncated to Truncate bytes
+// when it is positive, and the fields of their JSON payloads at the Redact
+// dot separated paths, e.g. `customer.email`, are redacted. Queue is a Go
+// template only when Templated is set.
+type DeadLetters struct {
+	Vhost     string
+	Queue     string
+	Templated bool
+	Count     int
+	Truncate  int
+	Redact    []string
+}
+
+// Pack enables the built-in rules of the rule pack Name on a server, or only
+// its Rules when set. Thresholds override the default thresholds of the
+// rules, Vhost restricts the queue rules to a virtual host, and the fields
+// set in Rule, such as Actions, Delay or Escalation, apply to every rule of
+// the pack.
+type Pack struct {
+	Name       string
+	Rules      []string
+	Vhost      string
+	Thresholds map[string]float64
+	Rule       Rule
 }
 
 type Server struct {
@@ -29,5 +254,70 @@ type Server struct {
 	Port        int
 	User        string
 	Password    string
+	Labels      map[string]string
 	Rules       []Rule
+	Packs       []Pack
+	Events      Events
+}
+
+// Events configures the AMQP connection consuming the `amq.rabbitmq.event`
+// exchange of a server for the rules with a trigger. Port is 5671 with TLS
+// when the server protocol is `https` and 5672 otherwise, and Vhost is `/` by
+// default.
+type Events struct {
+	Port  int
+	Vhost string
+}
+
+// Discovery finds servers through its Providers in addition to the ones of
+// the `servers` setting.
+type Discovery struct {
+	Providers []DiscoveryProvider
+}
+
+// DiscoveryProvider configures how servers are discovered according to its
+// Type:
+//
+//   - `dns` looks up the SRV records of Name, through the Resolver address
+//     instead of the system resolver when set.
+//   - `file` reads the servers from the YAML or JSON file at Path, again
+//     whenever it changes.
+//   - `http` reads the servers from the JSON array returned by URL.
+//
+// The `dns` and `http` providers look the servers up again after Refresh
+// milliseconds. The fields set in Server are the defaults of the discovered
+// servers, and its Labels are added to theirs.
+type DiscoveryProvider struct {
+	Type     string
+	Name     string
+	Resolver string
+	Path     string
+	URL      string
+	Refresh  time.Duration
+	Server   Server
+}
+
+// Notifications groups the rules that fire within a window of time, based on
+// the values of the GroupBy labels, and executes Actions once per group.
+type Notifications struct {
+	Window  time.Duration
+	GroupBy []string `mapstructure:"group_by"`
+	Actions []Action
+}
+
+// Silence suppresses the execution of the actions of the rules it matches
+// between Start and End, the rules are still evaluated. A rule is matched when
+// every non-empty matcher, Server, Rule and Labels, matches it. The labels of
+// a rule include the ones of its server.
+type Silence struct {
+	ID        string            `json:"id"`
+	Server    string            `json:"server,omitempty"`
+	Rule      string            `json:"rule,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Start     time.Time         `json:"start"`
+	End       time.Time         `json:"end"`
+	CreatedBy string            `json:"created_by" mapstructure:"created_by"`
+	CreatedAt time.Time         `json:"created_at" mapstructure:"created_at"`
+	Reason    string            `json:"reason"`
+	ExpiredBy string            `json:"expired_by,omitempty" mapstructure:"expired_by"`
 }
@@ -0,0 +1,186 @@
+// Package discovery finds RabbitMQ servers through pluggable providers.
+package discovery
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+const defaultRefresh = time.Minute
+
+// Provider discovers servers.
+type Provider interface {
+	Discover() ([]common.Server, error)
+}
+
+// Factory creates the Provider configured by cfg.
+type Factory func(cfg common.DiscoveryProvider) (Provider, error)
+
+var (
+	factoriesMu sync.Mutex
+	factories   = map[string]Factory{
+		"dns":  newDNSProvider,
+		"file": newFileProvider,
+		"http": newHTTPProvider,
+	}
+)
+
+// Register makes the providers created by factory available as the kind
+// type, replacing the existing ones.
+func Register(kind string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[kind] = factory
+}
+
+// Discoverer keeps the providers created for each configuration, and the
+// servers they last discovered, between calls to Servers. It is safe for
+// concurrent use.
+type Discoverer struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	provider Provider
+	servers  []common.Server
+}
+
+func New() *Discoverer {
+	return &Discoverer{
+		entries: make(map[string]*entry),
+	}
+}
+
+// Servers returns the servers discovered by the providers of cfg. When a
+// provider fails, the servers it last discovered are returned with a
+// warning, or, if it never succeeded, the servers of the other providers
+// are returned with its error.
+func (d *Discoverer) Servers(cfg common.Discovery) ([]common.Server, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var (
+		servers []common.Server
+		failure error
+	)
+	seen := make(map[string]bool, len(cfg.Providers))
+	for i, providerCfg := range cfg.Providers {
+		b, err := json.Marshal(providerCfg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to encode discovery provider %d", i)
+		}
+		key := string(b)
+		seen[key] = true
+
+		e, ok := d.entries[key]
+		if !ok {
+			provider, err := newProvider(providerCfg)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid discovery provider %d", i)
+			}
+			e = &entry{provider: provider}
+			d.entries[key] = e
+		}
+
+		discovered, err := e.provider.Discover()
+		if err != nil {
+			err = errors.Wrapcf(err, map[string]interface{}{
+				"provider": providerCfg.Type,
+			}, "discovery provider %d failed", i)
+			if e.servers == nil {
+				if failure == nil {
+					failure = err
+				}
+				continue
+			}
+			common.Log.WithError(err).With(common.Fields{
+				"servers": len(e.servers),
+			}).Warn("Using the last discovered servers")
+		} else {
+			e.servers = withDefaults(discovered, providerCfg.Server)
+		}
+		servers = append(servers, e.servers...)
+	}
+
+	for key, e := range d.entries {
+		if !seen[key] {
+			if c, ok := e.provider.(interface{ Close() error }); ok {
+				c.Close()
+			}
+			delete(d.entries, key)
+		}
+	}
+	return servers, failure
+}
+
+func newProvider(cfg common.DiscoveryProvider) (Provider, error) {
+	factoriesMu.Lock()
+	factory, ok := factories[cfg.Type]
+	factoriesMu.Unlock()
+	if !ok {
+		return nil, errors.Errorf("unknown discovery provider type %s", cfg.Type)
+	}
+	return factory(cfg)
+}
+
+// withDefaults returns servers with the fields they do not set taken from
+// defaults, and the labels of defaults added to theirs. The rules of
+// defaults are given to the servers without rules, their IDs suffixed with
+// `@<description>` as for the rules attached by selector.
+func withDefaults(servers []common.Server, defaults common.Server) []common.Server {
+	result := make([]common.Server, 0, len(servers))
+	for _, server := range servers {
+		if server.Protocol == "" {
+			server.Protocol = defaults.Protocol
+		}
+		if server.Host == "" {
+			server.Host = defaults.Host
+		}
+		if server.Port == 0 {
+			server.Port = defaults.Port
+		}
+		if server.User == "" {
+			server.User = defaults.User
+		}
+		if server.Password == "" {
+			server.Password = defaults.Password
+		}
+		if len(defaults.Labels) > 0 {
+			labels := make(map[string]string, len(defaults.Labels)+len(server.Labels))
+			for k, v := range defaults.Labels {
+				labels[k] = v
+			}
+			for k, v := range server.Labels {
+				labels[k] = v
+			}
+			server.Labels = labels
+		}
+		if server.Description == "" {
+			server.Description = server.Host
+		}
+		if len(server.Rules) == 0 && len(defaults.Rules) > 0 {
+			// The state of the rules is kept by ID, which must differ
+			// between the servers sharing the default rules.
+			rules := make([]common.Rule, 0, len(defaults.Rules))
+			for _, rule := range defaults.Rules {
+				rule.ID = rule.ID + "@" + server.Description
+				rules = append(rules, rule)
+			}
+			server.Rules = rules
+		}
+		result = append(result, server)
+	}
+	return result
+}
+
+func refresh(cfg common.DiscoveryProvider) time.Duration {
+	if cfg.Refresh > 0 {
+		return cfg.Refresh * time.Millisecond
+	}
+	return defaultRefresh
+}
@@ -0,0 +1,193 @@
+package discovery
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// stubProvider returns its servers, or its error, and counts its calls.
+type stubProvider struct {
+	servers []common.Server
+	err     error
+	calls   int
+	closed  bool
+}
+
+func (p *stubProvider) Discover() ([]common.Server, error) {
+	p.calls++
+	return p.servers, p.err
+}
+
+func (p *stubProvider) Close() error {
+	p.closed = true
+	return nil
+}
+
+// withStub registers the `stub` provider type, created as p, for the
+// duration of the test.
+func withStub(t *testing.T, p *stubProvider) {
+	t.Helper()
+	Register("stub", func(cfg common.DiscoveryProvider) (Provider, error) {
+		return p, nil
+	})
+	t.Cleanup(func() {
+		factoriesMu.Lock()
+		delete(factories, "stub")
+		factoriesMu.Unlock()
+	})
+}
+
+func TestWithDefaults(t *testing.T) {
+	rules := []common.Rule{{ID: "rule-1"}}
+	defaults := common.Server{
+		Protocol: "https",
+		Host:     "default.example.com",
+		Port:     15671,
+		User:     "monitor",
+		Password: "secret",
+		Labels:   map[string]string{"env": "prod", "team": "ops"},
+		Rules:    rules,
+	}
+	tests := []struct {
+		name     string
+		server   common.Server
+		defaults common.Server
+		want     common.Server
+	}{
+		{
+			name:     "unset fields are taken from the defaults",
+			server:   common.Server{Host: "rabbit-1", Labels: map[string]string{"team": "orders"}},
+			defaults: defaults,
+			want: common.Server{
+				Description: "rabbit-1",
+				Protocol:    "https",
+				Host:        "rabbit-1",
+				Port:        15671,
+				User:        "monitor",
+				Password:    "secret",
+				Labels:      map[string]string{"env": "prod", "team": "orders"},
+				Rules:       []common.Rule{{ID: "rule-1@rabbit-1"}},
+			},
+		},
+		{
+			name: "set fields are kept",
+			server: common.Server{
+				Description: "main",
+				Protocol:    "http",
+				Host:        "rabbit-2",
+				Port:        15672,
+				User:        "guest",
+				Password:    "guest",
+				Rules:       []common.Rule{{ID: "own"}},
+			},
+			defaults: defaults,
+			want: common.Server{
+				Description: "main",
+				Protocol:    "http",
+				Host:        "rabbit-2",
+				Port:        15672,
+				User:        "guest",
+				Password:    "guest",
+				Labels:      map[string]string{"env": "prod", "team": "ops"},
+				Rules:       []common.Rule{{ID: "own"}},
+			},
+		},
+		{
+			name:   "no defaults",
+			server: common.Server{Host: "rabbit-3", Labels: map[string]string{"env": "dev"}},
+			want: common.Server{
+				Description: "rabbit-3",
+				Host:        "rabbit-3",
+				Labels:      map[string]string{"env": "dev"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := withDefaults([]common.Server{test.server}, test.defaults)
+			if len(got) != 1 || !reflect.DeepEqual(got[0], test.want) {
+				t.Errorf("withDefaults() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDiscovererServers(t *testing.T) {
+	p := &stubProvider{servers: []common.Server{{Host: "rabbit-1"}}}
+	withStub(t, p)
+	cfg := common.Discovery{Providers: []common.DiscoveryProvider{{
+		Type:   "stub",
+		Server: common.Server{Port: 15672, Labels: map[string]string{"env": "prod"}},
+	}}}
+	d := New()
+
+	servers, err := d.Servers(cfg)
+	if err != nil {
+		t.Fatalf("Servers() error = %v", err)
+	}
+	want := []common.Server{{Description: "rabbit-1", Host: "rabbit-1", Port: 15672, Labels: map[string]string{"env": "prod"}}}
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("Servers() = %+v, want %+v", servers, want)
+	}
+
+	// The last discovered servers are kept when the provider fails.
+	p.err = errors.New("unavailable")
+	servers, err = d.Servers(cfg)
+	if err != nil {
+		t.Fatalf("Servers() error = %v after a failure, want the last servers", err)
+	}
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("Servers() = %+v after a failure, want %+v", servers, want)
+	}
+
+	// The providers no longer configured are closed.
+	if _, err := d.Servers(common.Discovery{}); err != nil {
+		t.Fatalf("Servers() error = %v", err)
+	}
+	if !p.closed {
+		t.Error("the provider that is no longer configured was not closed")
+	}
+}
+
+// The servers of the other providers are returned with the error of a
+// provider that never succeeded.
+func TestDiscovererServersPartialFailure(t *testing.T) {
+	withStub(t, &stubProvider{servers: []common.Server{{Host: "rabbit-1"}}})
+	cfg := common.Discovery{Providers: []common.DiscoveryProvider{
+		{Type: "http", URL: "http://127.0.0.1:1/servers"},
+		{Type: "stub"},
+	}}
+	servers, err := New().Servers(cfg)
+	if err == nil {
+		t.Error("Servers() error = nil, want the failure of the http provider")
+	}
+	want := []common.Server{{Description: "rabbit-1", Host: "rabbit-1"}}
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("Servers() = %+v, want %+v", servers, want)
+	}
+}
+
+func TestDiscovererServersErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  common.DiscoveryProvider
+	}{
+		{name: "unknown type", cfg: common.DiscoveryProvider{Type: "consul"}},
+		{name: "dns without name", cfg: common.DiscoveryProvider{Type: "dns"}},
+		{name: "file without path", cfg: common.DiscoveryProvider{Type: "file"}},
+		{name: "http without url", cfg: common.DiscoveryProvider{Type: "http"}},
+		{name: "failing provider", cfg: common.DiscoveryProvider{Type: "stub"}},
+	}
+	withStub(t, &stubProvider{err: errors.New("unavailable")})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := common.Discovery{Providers: []common.DiscoveryProvider{test.cfg}}
+			if _, err := New().Servers(cfg); err == nil {
+				t.Error("Servers() error = nil")
+			}
+		})
+	}
+}
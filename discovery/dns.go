@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+const dnsTimeout = 5 * time.Second
+
+// dnsProvider discovers a server for each SRV record of a name.
+type dnsProvider struct {
+	name     string
+	resolver *net.Resolver
+	refresh  time.Duration
+	servers  []common.Server
+	expires  time.Time
+}
+
+func newDNSProvider(cfg common.DiscoveryProvider) (Provider, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("the `dns` discovery provider requires a name")
+	}
+	p := &dnsProvider{
+		name:     cfg.Name,
+		resolver: net.DefaultResolver,
+		refresh:  refresh(cfg),
+	}
+	if cfg.Resolver != "" {
+		addr := cfg.Resolver
+		p.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	return p, nil
+}
+
+func (p *dnsProvider) Discover() ([]common.Server, error) {
+	if time.Now().Before(p.expires) {
+		return p.servers, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	_, records, err := p.resolver.LookupSRV(ctx, "", "", p.name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to look up the SRV records of %s", p.name)
+	}
+
+	servers := make([]common.Server, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		servers = append(servers, common.Server{
+			Description: fmt.Sprintf("%s:%d", host, record.Port),
+			Host:        host,
+			Port:        int(record.Port),
+		})
+	}
+	p.servers = servers
+	p.expires = time.Now().Add(p.refresh)
+	return servers, nil
+}
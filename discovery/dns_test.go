@@ -0,0 +1,179 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tradeforce/lophutch/common"
+)
+
+// srvRecord is an SRV record answered by the DNS stand-in.
+type srvRecord struct {
+	target string
+	port   uint16
+}
+
+// dnsStandIn answers the SRV queries of name with records, and the other
+// queries with no answer, over UDP. It returns its address.
+func dnsStandIn(t *testing.T, name string, records []srvRecord) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if reply := dnsReply(buf[:n], name, records); reply != nil {
+				conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// dnsReply returns the reply to the query, nil when it can not be parsed.
+func dnsReply(query []byte, name string, records []srvRecord) []byte {
+	const headerSize = 12
+	end := headerSize
+	var labels []string
+	for end < len(query) && query[end] != 0 {
+		size := int(query[end])
+		if end+1+size > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[end+1:end+1+size]))
+		end += 1 + size
+	}
+	// The question ends with the root label, its type and its class.
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+	matched := qtype == 33 && strings.EqualFold(strings.Join(labels, "."), strings.TrimSuffix(name, "."))
+
+	reply := append([]byte(nil), query[:2]...)
+	// A recursive response, with the question and the answers only.
+	reply = append(reply, 0x81, 0x80, 0, 1)
+	answers := 0
+	if matched {
+		answers = len(records)
+	}
+	reply = binary.BigEndian.AppendUint16(reply, uint16(answers))
+	reply = append(reply, 0, 0, 0, 0)
+	reply = append(reply, query[headerSize:end]...)
+	for i := 0; i < answers; i++ {
+		// Distinct priorities keep the records in order, the resolver
+		// shuffles the ones of the same priority.
+		var rdata []byte
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(10+i))
+		rdata = binary.BigEndian.AppendUint16(rdata, 5)
+		rdata = binary.BigEndian.AppendUint16(rdata, records[i].port)
+		for _, label := range strings.Split(strings.TrimSuffix(records[i].target, "."), ".") {
+			rdata = append(rdata, byte(len(label)))
+			rdata = append(rdata, label...)
+		}
+		rdata = append(rdata, 0)
+
+		// The name points to the one of the question.
+		reply = append(reply, 0xc0, headerSize, 0, 33, 0, 1, 0, 0, 0, 60)
+		reply = binary.BigEndian.AppendUint16(reply, uint16(len(rdata)))
+		reply = append(reply, rdata...)
+	}
+	return reply
+}
+
+func TestDNSProvider(t *testing.T) {
+	const name = "_rabbitmq._tcp.lophutch.test"
+	tests := []struct {
+		name    string
+		records []srvRecord
+		want    []common.Server
+	}{
+		{
+			name:    "one record",
+			records: []srvRecord{{target: "rabbit-1.lophutch.test.", port: 15672}},
+			want: []common.Server{
+				{Description: "rabbit-1.lophutch.test:15672", Host: "rabbit-1.lophutch.test", Port: 15672},
+			},
+		},
+		{
+			name: "several records",
+			records: []srvRecord{
+				{target: "rabbit-1.lophutch.test.", port: 15672},
+				{target: "rabbit-2.lophutch.test.", port: 15673},
+			},
+			want: []common.Server{
+				{Description: "rabbit-1.lophutch.test:15672", Host: "rabbit-1.lophutch.test", Port: 15672},
+				{Description: "rabbit-2.lophutch.test:15673", Host: "rabbit-2.lophutch.test", Port: 15673},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := dnsStandIn(t, name, test.records)
+			p, err := newDNSProvider(common.DiscoveryProvider{Type: "dns", Name: name, Resolver: addr})
+			if err != nil {
+				t.Fatalf("newDNSProvider() error = %v", err)
+			}
+			servers, err := p.Discover()
+			if err != nil {
+				t.Fatalf("Discover() error = %v", err)
+			}
+			if !reflect.DeepEqual(servers, test.want) {
+				t.Errorf("Discover() = %+v, want %+v", servers, test.want)
+			}
+		})
+	}
+}
+
+func TestDNSProviderNoRecords(t *testing.T) {
+	addr := dnsStandIn(t, "_rabbitmq._tcp.lophutch.test", nil)
+	p, err := newDNSProvider(common.DiscoveryProvider{Type: "dns", Name: "_other._tcp.lophutch.test", Resolver: addr})
+	if err != nil {
+		t.Fatalf("newDNSProvider() error = %v", err)
+	}
+	if servers, err := p.Discover(); err == nil {
+		t.Errorf("Discover() = %+v, want an error", servers)
+	}
+}
+
+func TestDNSProviderDefaults(t *testing.T) {
+	const name = "_rabbitmq._tcp.lophutch.test"
+	addr := dnsStandIn(t, name, []srvRecord{{target: "rabbit-1.lophutch.test.", port: 15672}})
+	servers, err := New().Servers(common.Discovery{Providers: []common.DiscoveryProvider{{
+		Type:     "dns",
+		Name:     name,
+		Resolver: addr,
+		Server: common.Server{
+			Protocol: "https",
+			User:     "monitor",
+			Labels:   map[string]string{"discovered": "dns"},
+		},
+	}}})
+	if err != nil {
+		t.Fatalf("Servers() error = %v", err)
+	}
+	want := []common.Server{{
+		Description: "rabbit-1.lophutch.test:15672",
+		Protocol:    "https",
+		Host:        "rabbit-1.lophutch.test",
+		Port:        15672,
+		User:        "monitor",
+		Labels:      map[string]string{"discovered": "dns"},
+	}}
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("Servers() = %+v, want %+v", servers, want)
+	}
+}
@@ -0,0 +1,102 @@
+package discovery
+
+import (
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// fileProvider discovers the servers of the `servers` setting of a file, in
+// any of the formats supported by viper, and reads it again whenever it
+// changes.
+type fileProvider struct {
+	path    string
+	watcher *fsnotify.Watcher
+
+	mu      sync.Mutex
+	changed bool
+	servers []common.Server
+}
+
+func newFileProvider(cfg common.DiscoveryProvider) (Provider, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("the `file` discovery provider requires a path")
+	}
+	path, err := filepath.Abs(cfg.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve the path of %s", cfg.Path)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the file watcher")
+	}
+	// The directory is watched since editors and deployment tools often
+	// replace the file instead of writing it.
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, errors.Wrapf(err, "failed to watch %s", filepath.Dir(path))
+	}
+
+	p := &fileProvider{
+		path:    path,
+		watcher: watcher,
+		changed: true,
+	}
+	go p.watch()
+	return p, nil
+}
+
+func (p *fileProvider) watch() {
+	for {
+		select {
+		case event, ok := <-p.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == p.path {
+				p.mu.Lock()
+				p.changed = true
+				p.mu.Unlock()
+			}
+		case err, ok := <-p.watcher.Errors:
+			if !ok {
+				return
+			}
+			common.Log.WithError(err).With(common.Fields{"path": p.path}).Warn("Failed to watch the discovery file")
+		}
+	}
+}
+
+func (p *fileProvider) Discover() ([]common.Server, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.changed {
+		return p.servers, nil
+	}
+
+	v := viper.New()
+	v.SetConfigFile(p.path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read the discovery file %s", p.path)
+	}
+	var servers []common.Server
+	if err := v.UnmarshalKey("servers", &servers); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal the `servers` setting of %s", p.path)
+	}
+	common.Log.With(common.Fields{
+		"path":    p.path,
+		"servers": len(servers),
+	}).Info("Discovery file read")
+	p.servers = servers
+	p.changed = false
+	return servers, nil
+}
+
+// Close stops watching the file.
+func (p *fileProvider) Close() error {
+	return p.watcher.Close()
+}
@@ -0,0 +1,109 @@
+package discovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+)
+
+func TestFileProvider(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+		want []common.Server
+	}{
+		{
+			name: "yaml",
+			file: "servers.yaml",
+			data: "servers:\n- description: main\n  host: rabbit-1\n  port: 15672\n  labels:\n    env: prod\n",
+			want: []common.Server{{Description: "main", Host: "rabbit-1", Port: 15672, Labels: map[string]string{"env": "prod"}}},
+		},
+		{
+			name: "json",
+			file: "servers.json",
+			data: `{"servers": [{"host": "rabbit-1"}, {"host": "rabbit-2"}]}`,
+			want: []common.Server{{Host: "rabbit-1"}, {Host: "rabbit-2"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), test.file)
+			writeFile(t, path, test.data)
+			p, err := newFileProvider(common.DiscoveryProvider{Type: "file", Path: path})
+			if err != nil {
+				t.Fatalf("newFileProvider() error = %v", err)
+			}
+			defer p.(*fileProvider).Close()
+
+			servers, err := p.Discover()
+			if err != nil {
+				t.Fatalf("Discover() error = %v", err)
+			}
+			if !reflect.DeepEqual(servers, test.want) {
+				t.Errorf("Discover() = %+v, want %+v", servers, test.want)
+			}
+		})
+	}
+}
+
+func TestFileProviderReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "servers.yaml")
+	writeFile(t, path, "servers:\n- host: rabbit-1\n")
+	p, err := newFileProvider(common.DiscoveryProvider{Type: "file", Path: path})
+	if err != nil {
+		t.Fatalf("newFileProvider() error = %v", err)
+	}
+	defer p.(*fileProvider).Close()
+
+	if servers, err := p.Discover(); err != nil || len(servers) != 1 {
+		t.Fatalf("Discover() = %+v, %v, want 1 server", servers, err)
+	}
+
+	// The file is replaced, as deployment tools do, rather than written.
+	tmp := filepath.Join(dir, "servers.yaml.new")
+	writeFile(t, tmp, "servers:\n- host: rabbit-1\n- host: rabbit-2\n")
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("failed to replace the file: %v", err)
+	}
+
+	want := []common.Server{{Host: "rabbit-1"}, {Host: "rabbit-2"}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		servers, err := p.Discover()
+		if err != nil {
+			t.Fatalf("Discover() error = %v", err)
+		}
+		if reflect.DeepEqual(servers, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Discover() = %+v after the change, want %+v", servers, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFileProviderMissingFile(t *testing.T) {
+	p, err := newFileProvider(common.DiscoveryProvider{Type: "file", Path: filepath.Join(t.TempDir(), "missing.yaml")})
+	if err != nil {
+		t.Fatalf("newFileProvider() error = %v", err)
+	}
+	defer p.(*fileProvider).Close()
+	if _, err := p.Discover(); err == nil {
+		t.Error("Discover() error = nil, want the missing file")
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
@@ -0,0 +1,59 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+const httpTimeout = 10 * time.Second
+
+// httpProvider discovers the servers returned as a JSON array by an HTTP
+// endpoint.
+type httpProvider struct {
+	url     string
+	client  *http.Client
+	refresh time.Duration
+	servers []common.Server
+	expires time.Time
+}
+
+func newHTTPProvider(cfg common.DiscoveryProvider) (Provider, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("the `http` discovery provider requires a url")
+	}
+	return &httpProvider{
+		url:     cfg.URL,
+		client:  &http.Client{Timeout: httpTimeout},
+		refresh: refresh(cfg),
+	}, nil
+}
+
+func (p *httpProvider) Discover() ([]common.Server, error) {
+	if time.Now().Before(p.expires) {
+		return p.servers, nil
+	}
+
+	resp, err := p.client.Get(p.url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to request %s", p.url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorcf(map[string]interface{}{
+			"url":    p.url,
+			"status": resp.StatusCode,
+		}, "unexpected status %d from %s", resp.StatusCode, p.url)
+	}
+
+	var servers []common.Server
+	if err := json.NewDecoder(resp.Body).Decode(&servers); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode the servers returned by %s", p.url)
+	}
+	p.servers = servers
+	p.expires = time.Now().Add(p.refresh)
+	return servers, nil
+}
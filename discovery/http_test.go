@@ -0,0 +1,81 @@
+package discovery
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/tradeforce/lophutch/common"
+)
+
+func TestHTTPProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    []common.Server
+		wantErr bool
+	}{
+		{
+			name:   "servers",
+			status: http.StatusOK,
+			body:   `[{"description": "main", "host": "rabbit-1", "port": 15672, "labels": {"env": "prod"}}, {"host": "rabbit-2"}]`,
+			want: []common.Server{
+				{Description: "main", Host: "rabbit-1", Port: 15672, Labels: map[string]string{"env": "prod"}},
+				{Host: "rabbit-2"},
+			},
+		},
+		{
+			name:    "unexpected status",
+			status:  http.StatusServiceUnavailable,
+			body:    `[]`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid body",
+			status:  http.StatusOK,
+			body:    `{"servers": []}`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			defer srv.Close()
+
+			p, err := newHTTPProvider(common.DiscoveryProvider{Type: "http", URL: srv.URL, Refresh: 60000})
+			if err != nil {
+				t.Fatalf("newHTTPProvider() error = %v", err)
+			}
+			servers, err := p.Discover()
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("Discover() = %+v, want an error", servers)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Discover() error = %v", err)
+			}
+			if !reflect.DeepEqual(servers, test.want) {
+				t.Errorf("Discover() = %+v, want %+v", servers, test.want)
+			}
+
+			// The servers are requested again only once refresh elapsed.
+			if _, err := p.Discover(); err != nil {
+				t.Fatalf("Discover() error = %v", err)
+			}
+			if n := atomic.LoadInt32(&requests); n != 1 {
+				t.Errorf("Discover() requested the endpoint %d times within refresh, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package hutch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+const (
+	onFailureStop     = "stop"
+	onFailureContinue = "continue"
+	onFailureRetry    = "retry"
+
+	defaultBackoff = time.Second
+)
+
+// actionContext is the rule an action is executed for, with the outcome of
+// its evaluation.
+type actionContext struct {
+	server  common.Server
+	rule    common.Rule
+	outcome *Outcome
+}
+
+// builtinActions are the actions that can run instead of a command, by the
+// name of their `builtin` setting.
+var builtinActions = map[string]func(action common.Action, ctx actionContext, logger *common.Logger) error{
+	"reapply_definitions": reapplyDefinitions,
+	"replay_dead_letters": replayDeadLetters,
+}
+
+// decodeOptions decodes the options of a built-in action into v, failing on
+// the options v does not have.
+func decodeOptions(options map[string]interface{}, v interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           v,
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create the decoder")
+	}
+	if err := decoder.Decode(options); err != nil {
+		return errors.Wrap(err, "invalid options")
+	}
+	return nil
+}
+
+// actionsResult counts the actions executed by executeActions.
+type actionsResult struct {
+	succeeded int
+	failed    int
+	skipped   int
+	limited   int
+}
+
+// status summarizes the result as `ok`, `partial` or `failed`, or an empty
+// string when no action was executed.
+func (r actionsResult) status() string {
+	switch {
+	case r.succeeded+r.failed == 0:
+		return ""
+	case r.failed == 0:
+		return "ok"
+	case r.succeeded > 0:
+		return "partial"
+	}
+	return "failed"
+}
+
+// executeActions executes actions in order, running consecutive actions of
+// the same group in parallel. The remaining actions are skipped after a
+// failed action whose OnFailure policy is not `continue`. During dry runs
+// the actions are added to outcome instead.
+func executeActions(actions []common.Action, server common.Server, rule common.Rule, opts scoutOptions, logger *common.Logger, outcome *Outcome) (actionsResult, error) {
+	var result actionsResult
+	rendered := make([]common.Action, 0, len(actions))
+	for _, action := range actions {
+		if err := validateOnFailure(action); err != nil {
+			return result, errors.Wrapf(err, "invalid action %s", action.Description)
+		}
+		if _, ok := builtinActions[action.Builtin]; action.Builtin != "" && !ok {
+			return result, errors.Errorf("invalid action %s: unknown built-in action %s", action.Description, action.Builtin)
+		}
+		action, err := renderActionWith(action, actionData(server, rule, outcome))
+		if err != nil {
+			return result, errors.Wrapf(err, "failed to render action %s", action.Description)
+		}
+		rendered = append(rendered, action)
+	}
+
+	if opts.dryRun {
+		for _, action := range rendered {
+			logger.With(common.Fields{"action": action.Description}).Info("Skipping action due to dry run")
+			outcome.Actions = append(outcome.Actions, action)
+		}
+		return result, nil
+	}
+
+	ctx := actionContext{server: server, rule: rule, outcome: outcome}
+	for _, batch := range batchActions(rendered) {
+		errs := make([]error, len(batch))
+		allowed := make([]bool, len(batch))
+		var wg sync.WaitGroup
+		for i, action := range batch {
+			actionLogger := logger.With(common.Fields{"action": action.Description})
+			if opts.limiter != nil {
+				if reason := opts.limiter.allow(opts.remediation, rule, action, time.Now()); reason != "" {
+					actionLogger.With(common.Fields{"reason": reason}).Warn("Skipping action due to a limit")
+					outcome.LimitedActions = append(outcome.LimitedActions, action.Description)
+					result.limited++
+					continue
+				}
+			}
+			allowed[i] = true
+			wg.Add(1)
+			go func(i int, action common.Action) {
+				defer wg.Done()
+				errs[i] = runAction(action, ctx, actionLogger)
+			}(i, action)
+		}
+		wg.Wait()
+
+		stop := false
+		for i, err := range errs {
+			if !allowed[i] {
+				continue
+			}
+			if opts.limiter != nil && opts.limiter.record(opts.remediation, rule, batch[i], err != nil, time.Now()) {
+				tripped(opts.remediation, rule, logger)
+			}
+			if err == nil {
+				result.succeeded++
+				continue
+			}
+			result.failed++
+			outcome.FailedActions = append(outcome.FailedActions, batch[i].Description)
+			if batch[i].OnFailure != onFailureContinue {
+				stop = true
+			}
+		}
+		if stop {
+			result.skipped = len(rendered) - result.succeeded - result.failed - result.limited
+			if result.skipped > 0 {
+				logger.With(common.Fields{"skipped": result.skipped}).Warn("Skipping the remaining actions due to a failed action")
+			}
+			break
+		}
+	}
+
+	return result, nil
+}
+
+func validateOnFailure(action common.Action) error {
+	switch action.OnFailure {
+	case "", onFailureStop, onFailureContinue, onFailureRetry:
+		return nil
+	}
+	return errors.Errorf("unknown on_failure policy %s, expected stop, continue or retry", action.OnFailure)
+}
+
+// batchActions splits actions into batches executed one after the other,
+// consecutive actions with the same non-empty group share a batch.
+func batchActions(actions []common.Action) [][]common.Action {
+	var batches [][]common.Action
+	for i, action := range actions {
+		if i > 0 && action.Group != "" && action.Group == actions[i-1].Group {
+			batches[len(batches)-1] = append(batches[len(batches)-1], action)
+			continue
+		}
+		batches = append(batches, []common.Action{action})
+	}
+	return batches
+}
+
+// runAction executes action for ctx, retrying it according to its OnFailure
+// policy.
+func runAction(action common.Action, ctx actionContext, logger *common.Logger) error {
+	attempts := 1
+	if action.OnFailure == onFailureRetry {
+		attempts += action.Retries
+	}
+	backoff := action.Backoff * time.Millisecond
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		attemptLogger := logger
+		if attempts > 1 {
+			attemptLogger = logger.With(common.Fields{"attempt": attempt})
+		}
+		attemptLogger.Debug("Executing action...")
+		start := time.Now()
+		if action.Builtin != "" {
+			err = builtinActions[action.Builtin](action, ctx, attemptLogger)
+		} else {
+			err = act(action)
+		}
+		if err == nil {
+			attemptLogger.With(common.Fields{"duration": time.Since(start)}).Info("Executing action... OK")
+			return nil
+		}
+		err = errors.Wrapcf(err, map[string]interface{}{
+			"action":  action,
+			"attempt": attempt,
+		}, "failed to execute action %s", action.Description)
+		attemptLogger.WithError(err).With(common.Fields{"duration": time.Since(start)}).Error("Executing action... Fail")
+		if attempt < attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package hutch
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// withBuiltin registers the built-in action name for the duration of the
+// test.
+func withBuiltin(t *testing.T, name string, f func(action common.Action, ctx actionContext, logger *common.Logger) error) {
+	t.Helper()
+	builtinActions[name] = f
+	t.Cleanup(func() {
+		delete(builtinActions, name)
+	})
+}
+
+// firingRule returns a rule that always fires with actions, answered by
+// the request of firingOptions.
+func firingRule(actions ...common.Action) common.Rule {
+	return common.Rule{
+		ID:        "rule-1",
+		Request:   common.Request{Method: "GET", Path: "/api/overview"},
+		Evaluator: "function evaluate(body) { return true; }",
+		Actions:   actions,
+	}
+}
+
+func firingOptions() scoutOptions {
+	return scoutOptions{
+		request: func(server common.Server, request common.Request) (response, error) {
+			return response{Status: http.StatusOK, Body: "{}"}, nil
+		},
+		limiter: newLimiter(),
+	}
+}
+
+func TestProcessRuleReleasesTheStateLock(t *testing.T) {
+	state := NewState()
+	withBuiltin(t, "check_lock", func(action common.Action, ctx actionContext, logger *common.Logger) error {
+		if !state.mu.TryLock() {
+			return errors.New("the state is locked while the action is executed")
+		}
+		state.mu.Unlock()
+		return nil
+	})
+	rule := firingRule(common.Action{Description: "check", Builtin: "check_lock"})
+	rule.Escalation = []common.EscalationStep{{Actions: rule.Actions}}
+
+	outcome := Outcome{}
+	state.mu.Lock()
+	err := processRule(common.Server{}, rule, state, firingOptions(), common.Log, &outcome)
+	state.mu.Unlock()
+	if err != nil {
+		t.Fatalf("processRule() error = %v", err)
+	}
+	if outcome.Status != "ok" || outcome.Escalation != 1 || len(outcome.FailedActions) > 0 {
+		t.Errorf("processRule() outcome = %+v, want the actions executed without the lock", outcome)
+	}
+}
@@ -0,0 +1,449 @@
+package hutch
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// AMQP 0-9-1 frame types and classes used by the stand-in, the methods are
+// identified by their IDs within their class.
+const (
+	frameMethod = 1
+	frameHeader = 2
+	frameBody   = 3
+	frameEnd    = 0xce
+
+	classConnection = 10
+	classChannel    = 20
+	classQueue      = 50
+	classBasic      = 60
+	classConfirm    = 85
+)
+
+// amqpStandIn is a minimal AMQP 0-9-1 server: it opens connections and
+// channels, declares queues, and routes the published messages to the queue
+// named by their routing key through the default exchange, or through the
+// bound exchanges. The messages are delivered to the consumer of their queue
+// or kept until they are fetched. The fetched messages that are not
+// acknowledged are requeued when their connection closes. The publishings
+// are confirmed, or rejected when nack is set, unless silent is set.
+type amqpStandIn struct {
+	listener net.Listener
+	silent   bool
+
+	mu     sync.Mutex
+	nack   bool
+	queues map[string][]standInMessage
+	routes map[string]string
+	conns  []net.Conn
+}
+
+// standInMessage is a message of a queue of the stand-in, its properties
+// being the encoded properties of its header frame.
+type standInMessage struct {
+	exchange   string
+	routingKey string
+	properties []byte
+	body       []byte
+}
+
+// newAMQPStandIn starts a stand-in, closed at the end of the test.
+func newAMQPStandIn(t *testing.T, silent bool) *amqpStandIn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &amqpStandIn{
+		listener: l,
+		silent:   silent,
+		queues:   make(map[string][]standInMessage),
+		routes:   make(map[string]string),
+	}
+	go s.serve()
+	t.Cleanup(s.close)
+	return s
+}
+
+func (s *amqpStandIn) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *amqpStandIn) close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// declare declares queue with messages.
+func (s *amqpStandIn) declare(queue string, messages ...standInMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queues[queue] = append(s.queues[queue], messages...)
+}
+
+// bind routes the messages published to exchange with key to queue.
+func (s *amqpStandIn) bind(exchange, key, queue string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes[exchange+"/"+key] = queue
+}
+
+// rejectPublishings makes the stand-in reject the following publishings.
+func (s *amqpStandIn) rejectPublishings() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nack = true
+}
+
+// length returns the number of messages of queue.
+func (s *amqpStandIn) length(queue string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queues[queue])
+}
+
+// bodies returns the bodies of the messages of queue, waiting for the
+// connections to be closed and their unacknowledged messages requeued.
+func (s *amqpStandIn) bodies(t *testing.T, queue string) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		open := len(s.conns)
+		var bodies []string
+		for _, message := range s.queues[queue] {
+			bodies = append(bodies, string(message.body))
+		}
+		s.mu.Unlock()
+		if open == 0 || time.Now().After(deadline) {
+			return bodies
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *amqpStandIn) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// route returns the queue a message published to exchange with key is
+// routed to.
+func (s *amqpStandIn) route(exchange, key string) (string, bool) {
+	if exchange == "" {
+		_, ok := s.queues[key]
+		return key, ok
+	}
+	queue, ok := s.routes[exchange+"/"+key]
+	return queue, ok
+}
+
+// amqpArgs reads the arguments of a method frame.
+type amqpArgs struct {
+	*bytes.Reader
+}
+
+func (a amqpArgs) short() uint16 {
+	var v uint16
+	binary.Read(a, binary.BigEndian, &v)
+	return v
+}
+
+func (a amqpArgs) longlong() uint64 {
+	var v uint64
+	binary.Read(a, binary.BigEndian, &v)
+	return v
+}
+
+func (a amqpArgs) shortstr() string {
+	n, _ := a.ReadByte()
+	b := make([]byte, n)
+	io.ReadFull(a, b)
+	return string(b)
+}
+
+// amqpWriter writes the frames of a connection.
+type amqpWriter struct {
+	conn net.Conn
+}
+
+func (w *amqpWriter) frame(kind byte, channel uint16, payload []byte) {
+	var b bytes.Buffer
+	b.WriteByte(kind)
+	binary.Write(&b, binary.BigEndian, channel)
+	binary.Write(&b, binary.BigEndian, uint32(len(payload)))
+	b.Write(payload)
+	b.WriteByte(frameEnd)
+	w.conn.Write(b.Bytes())
+}
+
+func (w *amqpWriter) method(channel, class, method uint16, args ...interface{}) {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, class)
+	binary.Write(&b, binary.BigEndian, method)
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			b.WriteByte(byte(len(v)))
+			b.WriteString(v)
+		case []byte:
+			binary.Write(&b, binary.BigEndian, uint32(len(v)))
+			b.Write(v)
+		default:
+			binary.Write(&b, binary.BigEndian, v)
+		}
+	}
+	w.frame(frameMethod, channel, b.Bytes())
+}
+
+// content writes the header and body frames of a message.
+func (w *amqpWriter) content(channel uint16, properties []byte, body []byte) {
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, uint16(classBasic))
+	binary.Write(&header, binary.BigEndian, uint16(0))
+	binary.Write(&header, binary.BigEndian, uint64(len(body)))
+	header.Write(properties)
+	w.frame(frameHeader, channel, header.Bytes())
+	if len(body) > 0 {
+		w.frame(frameBody, channel, body)
+	}
+}
+
+// amqpProperties encodes the message ID and the headers of a message as the
+// properties of its header frame.
+func amqpProperties(messageID string, headers map[string]interface{}) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint16(0x2000|0x0080))
+	writeTable(&b, headers)
+	b.WriteByte(byte(len(messageID)))
+	b.WriteString(messageID)
+	return b.Bytes()
+}
+
+// writeTable encodes t as an AMQP field table, its values being strings,
+// int64, times, arrays or tables.
+func writeTable(w *bytes.Buffer, t map[string]interface{}) {
+	var fields bytes.Buffer
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fields.WriteByte(byte(len(name)))
+		fields.WriteString(name)
+		writeField(&fields, t[name])
+	}
+	binary.Write(w, binary.BigEndian, uint32(fields.Len()))
+	w.Write(fields.Bytes())
+}
+
+func writeField(w *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		w.WriteByte('S')
+		binary.Write(w, binary.BigEndian, uint32(len(v)))
+		w.WriteString(v)
+	case int64:
+		w.WriteByte('l')
+		binary.Write(w, binary.BigEndian, v)
+	case time.Time:
+		w.WriteByte('T')
+		binary.Write(w, binary.BigEndian, uint64(v.Unix()))
+	case []interface{}:
+		var values bytes.Buffer
+		for _, value := range v {
+			writeField(&values, value)
+		}
+		w.WriteByte('A')
+		binary.Write(w, binary.BigEndian, uint32(values.Len()))
+		w.Write(values.Bytes())
+	case map[string]interface{}:
+		w.WriteByte('F')
+		writeTable(w, v)
+	}
+}
+
+func (s *amqpStandIn) handle(conn net.Conn) {
+	// The messages fetched and not acknowledged, by delivery tag, are
+	// requeued at the head of their queue once the connection closes.
+	unacked := make(map[uint64]standInMessage)
+	queueOf := make(map[uint64]string)
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		tags := make([]uint64, 0, len(unacked))
+		for tag := range unacked {
+			tags = append(tags, tag)
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] > tags[j] })
+		for _, tag := range tags {
+			queue := queueOf[tag]
+			s.queues[queue] = append([]standInMessage{unacked[tag]}, s.queues[queue]...)
+		}
+		for i, c := range s.conns {
+			if c == conn {
+				s.conns = append(s.conns[:i], s.conns[i+1:]...)
+				break
+			}
+		}
+	}()
+
+	r := bufio.NewReader(conn)
+	protocol := make([]byte, 8)
+	if _, err := io.ReadFull(r, protocol); err != nil {
+		return
+	}
+	w := &amqpWriter{conn: conn}
+	w.method(0, classConnection, 10, uint8(0), uint8(9), []byte{}, []byte("PLAIN"), []byte("en_US"))
+
+	var (
+		consumer   string
+		consumed   string
+		confirming bool
+		published  uint64
+		delivered  uint64
+		publishing *standInMessage
+		mandatory  bool
+		size       uint64
+	)
+	for {
+		head := make([]byte, 7)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return
+		}
+		kind, channel := head[0], binary.BigEndian.Uint16(head[1:3])
+		payload := make([]byte, binary.BigEndian.Uint32(head[3:7])+1)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		payload = payload[:len(payload)-1]
+
+		switch kind {
+		case frameHeader:
+			if publishing == nil {
+				continue
+			}
+			size = binary.BigEndian.Uint64(payload[4:12])
+			publishing.properties = payload[12:]
+		case frameBody:
+			if publishing != nil {
+				publishing.body = append(publishing.body, payload...)
+			}
+		case frameMethod:
+			args := amqpArgs{bytes.NewReader(payload[4:])}
+			class, method := binary.BigEndian.Uint16(payload[:2]), binary.BigEndian.Uint16(payload[2:4])
+			switch {
+			case class == classConnection && method == 11: // start-ok
+				w.method(0, classConnection, 30, uint16(2047), uint32(131072), uint16(0))
+			case class == classConnection && method == 40: // open
+				w.method(0, classConnection, 41, "")
+			case class == classConnection && method == 50: // close
+				w.method(0, classConnection, 51)
+				return
+			case class == classChannel && method == 10: // open
+				w.method(channel, classChannel, 11, []byte{})
+			case class == classChannel && method == 40: // close
+				w.method(channel, classChannel, 41)
+			case class == classQueue && method == 10: // declare
+				args.short()
+				queue := args.shortstr()
+				if queue == "" {
+					queue = "amq.gen-standin"
+				}
+				s.declare(queue)
+				w.method(channel, classQueue, 11, queue, uint32(0), uint32(0))
+			case class == classConfirm && method == 10: // select
+				confirming = true
+				w.method(channel, classConfirm, 11)
+			case class == classBasic && method == 20: // consume
+				args.short()
+				consumed = args.shortstr()
+				consumer = args.shortstr()
+				w.method(channel, classBasic, 21, consumer)
+			case class == classBasic && method == 40: // publish
+				args.short()
+				publishing = &standInMessage{exchange: args.shortstr(), routingKey: args.shortstr()}
+				bits, _ := args.ReadByte()
+				mandatory = bits&1 != 0
+				continue
+			case class == classBasic && method == 70: // get
+				args.short()
+				queue := args.shortstr()
+				s.mu.Lock()
+				messages := s.queues[queue]
+				if len(messages) == 0 {
+					s.mu.Unlock()
+					w.method(channel, classBasic, 72, "") // get-empty
+					continue
+				}
+				message := messages[0]
+				s.queues[queue] = messages[1:]
+				remaining := uint32(len(messages) - 1)
+				s.mu.Unlock()
+				delivered++
+				unacked[delivered] = message
+				queueOf[delivered] = queue
+				w.method(channel, classBasic, 71, delivered, uint8(0), message.exchange, message.routingKey, remaining) // get-ok
+				w.content(channel, message.properties, message.body)
+			case class == classBasic && method == 80: // ack
+				tag := args.longlong()
+				delete(unacked, tag)
+				delete(queueOf, tag)
+			}
+		}
+
+		// A message is complete once its body is read.
+		if publishing != nil && publishing.properties != nil && uint64(len(publishing.body)) >= size {
+			message := *publishing
+			publishing = nil
+			published++
+			if s.silent {
+				continue
+			}
+			s.mu.Lock()
+			nack := s.nack
+			queue, routed := s.route(message.exchange, message.routingKey)
+			if routed && !nack && (consumer == "" || queue != consumed) {
+				s.queues[queue] = append(s.queues[queue], message)
+			}
+			s.mu.Unlock()
+			if !routed && mandatory {
+				w.method(channel, classBasic, 50, uint16(312), "NO_ROUTE", message.exchange, message.routingKey) // return
+				w.content(channel, message.properties, message.body)
+			}
+			if confirming {
+				if nack {
+					w.method(channel, classBasic, 120, published, uint8(0)) // nack
+				} else {
+					w.method(channel, classBasic, 80, published, uint8(0)) // ack
+				}
+			}
+			if routed && !nack && consumer != "" && queue == consumed {
+				delivered++
+				w.method(channel, classBasic, 60, consumer, delivered, uint8(0), message.exchange, message.routingKey) // deliver
+				w.content(channel, message.properties, message.body)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package hutch
+
+import (
+	"math"
+
+	"github.com/tradeforce/lophutch/common"
+)
+
+const (
+	defaultSigmas    = 3
+	defaultAlpha     = 0.1
+	defaultWarmUp    = 30
+	defaultMinStddev = 1
+)
+
+func sigmas(check common.Check) float64 {
+	if check.Sigmas > 0 {
+		return check.Sigmas
+	}
+	return defaultSigmas
+}
+
+// anomaly returns the number of standard deviations between the last of
+// points and the exponentially weighted moving average of the previous ones,
+// false while the baseline has less than the warm-up samples. The standard
+// deviation is floored so that a series that stayed flat, like a quiet queue,
+// is not infinitely far from its first change.
+func anomaly(check common.Check, points []point) (float64, bool) {
+	if len(points) == 0 {
+		return 0, false
+	}
+	alpha := check.Alpha
+	if alpha <= 0 || alpha > 1 {
+		alpha = defaultAlpha
+	}
+	warmUp := check.WarmUp
+	if warmUp <= 0 {
+		warmUp = defaultWarmUp
+	}
+	minStddev := check.MinStddev
+	if minStddev <= 0 {
+		minStddev = defaultMinStddev
+	}
+
+	current := points[len(points)-1]
+	baseline := points[:len(points)-1]
+	if check.Hourly {
+		var sameHour []point
+		for _, p := range baseline {
+			if p.Time.Hour() == current.Time.Hour() {
+				sameHour = append(sameHour, p)
+			}
+		}
+		baseline = sameHour
+	}
+	if len(baseline) < warmUp {
+		return 0, false
+	}
+
+	mean, variance := baseline[0].Value, 0.0
+	for _, p := range baseline[1:] {
+		diff := p.Value - mean
+		increment := alpha * diff
+		mean += increment
+		variance = (1 - alpha) * (variance + diff*increment)
+	}
+
+	return (current.Value - mean) / math.Max(math.Sqrt(variance), minStddev), true
+}
@@ -0,0 +1,127 @@
+package hutch
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+)
+
+// samples returns a point per value, every step from start.
+func samples(start time.Time, step time.Duration, values ...float64) []point {
+	points := make([]point, len(values))
+	for i, value := range values {
+		points[i] = point{Time: start.Add(time.Duration(i) * step), Value: value}
+	}
+	return points
+}
+
+// repeat returns n times value.
+func repeat(value float64, n int) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+func TestAnomaly(t *testing.T) {
+	start := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	// A day of samples every 30 minutes, around 100 at 10:00 and 0 at the
+	// other hours, then 100 at 10:00 the next day.
+	var daily []float64
+	for i := 0; i < 48; i++ {
+		switch i {
+		case 0:
+			daily = append(daily, 99)
+		case 1:
+			daily = append(daily, 101)
+		default:
+			daily = append(daily, 0)
+		}
+	}
+	daily = append(daily, 100)
+
+	tests := []struct {
+		name   string
+		check  common.Check
+		points []point
+		ok     bool
+		fires  bool
+		value  float64
+	}{
+		{
+			name:   "flat series, first message",
+			check:  common.Check{},
+			points: samples(start, time.Minute, append(repeat(0, 30), 1)...),
+			ok:     true,
+			value:  1,
+		},
+		{
+			name:   "flat series, spike",
+			check:  common.Check{},
+			points: samples(start, time.Minute, append(repeat(0, 30), 10)...),
+			ok:     true,
+			fires:  true,
+			value:  10,
+		},
+		{
+			name:   "flat series, minimum standard deviation",
+			check:  common.Check{MinStddev: 5},
+			points: samples(start, time.Minute, append(repeat(0, 30), 10)...),
+			ok:     true,
+			value:  2,
+		},
+		{
+			name:   "warm-up",
+			check:  common.Check{},
+			points: samples(start, time.Minute, append(repeat(0, 29), 100)...),
+		},
+		{
+			name:   "custom warm-up",
+			check:  common.Check{WarmUp: 5},
+			points: samples(start, time.Minute, append(repeat(0, 5), 100)...),
+			ok:     true,
+			fires:  true,
+			value:  100,
+		},
+		{
+			name:   "without hourly baseline",
+			check:  common.Check{WarmUp: 2},
+			points: samples(start, 30*time.Minute, daily...),
+			ok:     true,
+			fires:  true,
+		},
+		{
+			name:   "hourly baseline",
+			check:  common.Check{WarmUp: 2, Hourly: true},
+			points: samples(start, 30*time.Minute, daily...),
+			ok:     true,
+		},
+		{
+			name:   "hourly baseline warm-up",
+			check:  common.Check{WarmUp: 3, Hourly: true},
+			points: samples(start, 30*time.Minute, daily...),
+		},
+		{
+			name:   "hourly baseline without the previous days",
+			check:  common.Check{WarmUp: 2, Hourly: true},
+			points: samples(start, 30*time.Minute, daily...)[2:],
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, ok := anomaly(test.check, test.points)
+			if ok != test.ok {
+				t.Fatalf("anomaly() = %g, %t, want ok %t", value, ok, test.ok)
+			}
+			if fires := ok && math.Abs(value) > sigmas(test.check); fires != test.fires {
+				t.Errorf("anomaly() = %g, fires %t, want %t", value, fires, test.fires)
+			}
+			if test.value != 0 && value != test.value {
+				t.Errorf("anomaly() = %g, want %g", value, test.value)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package hutch
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// serveAPI serves the HTTP API on addr until it fails.
+func serveAPI(addr string, state *State) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/silences", silencesHandler(state))
+	mux.HandleFunc("/silences/", silenceHandler(state))
+	mux.HandleFunc("/rules", rulesHandler(state))
+	mux.HandleFunc("/rules/", ackHandler(state))
+	mux.HandleFunc("/status", statusHandler(state))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		return errors.Wrapf(err, "failed to serve the HTTP API on %s", addr)
+	}
+	return nil
+}
+
+// silencesHandler lists the silences on GET and creates one from the JSON
+// body on POST.
+func silencesHandler(state *State) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			configMu.Lock()
+			silences, err := getSilences(state.silences)
+			configMu.Unlock()
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			writeResponse(w, http.StatusOK, silences)
+		case http.MethodPost:
+			var silence common.Silence
+			if err := json.NewDecoder(r.Body).Decode(&silence); err != nil {
+				writeError(w, http.StatusBadRequest, errors.Wrap(err, "failed to decode the silence"))
+				return
+			}
+			silence, err := state.silences.add(silence)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeResponse(w, http.StatusCreated, silence)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// silenceHandler expires the silence whose ID is the last segment of the path
+// on DELETE, who is expiring it must be provided in the `by` query parameter.
+func silenceHandler(state *State) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/silences/")
+		silence, err := state.silences.expire(id, r.URL.Query().Get("by"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeResponse(w, http.StatusOK, silence)
+	}
+}
+
+// rulesHandler lists the state of the rules, including their escalation, on
+// GET.
+func rulesHandler(state *State) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeResponse(w, http.StatusOK, state.snapshot())
+	}
+}
+
+// ackHandler acknowledges the firing rule on POST to `/rules/<id>/ack`, who
+// is acknowledging it must be provided in the `by` query parameter.
+func ackHandler(state *State) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/rules/")
+		if r.Method != http.MethodPost || !strings.HasSuffix(id, "/ack") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rs, err := state.acknowledge(strings.TrimSuffix(id, "/ack"), r.URL.Query().Get("by"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeResponse(w, http.StatusOK, rs)
+	}
+}
+
+// statusHandler returns the execution counts of the actions, within the
+// windows of the rate limits and the circuit breaker, and whether the circuit
+// breaker is open on GET.
+func statusHandler(state *State) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		configMu.Lock()
+		remediation, err := getRemediation()
+		configMu.Unlock()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeResponse(w, http.StatusOK, state.limiter.status(remediation, time.Now()))
+	}
+}
+
+func writeResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		common.Log.WithError(err).Warn("Failed to write the HTTP response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeResponse(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,51 @@
+package hutch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// Run with -race: the API reads the configuration while the scouts run.
+func TestAPIDuringScouts(t *testing.T) {
+	api := ordersAPI(t)
+	defer api.Close()
+	configure(t, ordersConfig(t, api.URL))
+	viper.Set("dry-run", true)
+	viper.Set("run-once", true)
+
+	state := NewState()
+	handlers := map[string]http.HandlerFunc{
+		"/silences": silencesHandler(state),
+		"/status":   statusHandler(state),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1 + len(handlers))
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if err := Scout(state); err != nil {
+				t.Errorf("Scout() error = %v", err)
+				return
+			}
+		}
+	}()
+	for path, handler := range handlers {
+		go func(path string, handler http.HandlerFunc) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				w := httptest.NewRecorder()
+				handler(w, httptest.NewRequest(http.MethodGet, path, nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("GET %s status = %d, want %d: %s", path, w.Code, http.StatusOK, w.Body)
+					return
+				}
+			}
+		}(path, handler)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,339 @@
+package hutch
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/tradeforce/lophutch/management"
+	"github.com/zignd/errors"
+)
+
+// topologySnapshot holds the attributes of the entities of each collection,
+// by collection and entity name.
+type topologySnapshot map[string]map[string]map[string]interface{}
+
+// topologyEntity is an entity added to or removed from a collection.
+type topologyEntity struct {
+	Collection string                 `json:"collection"`
+	Name       string                 `json:"name"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// topologyChange is an entity whose attributes changed, Attributes being the
+// names of the changed ones.
+type topologyChange struct {
+	Collection string                 `json:"collection"`
+	Name       string                 `json:"name"`
+	Attributes []string               `json:"attributes"`
+	Before     map[string]interface{} `json:"before"`
+	After      map[string]interface{} `json:"after"`
+}
+
+// topologyChanges are the differences between two snapshots.
+type topologyChanges struct {
+	Added   []topologyEntity `json:"added,omitempty"`
+	Removed []topologyEntity `json:"removed,omitempty"`
+	Changed []topologyChange `json:"changed,omitempty"`
+}
+
+func (c topologyChanges) empty() bool {
+	return len(c.Added)+len(c.Removed)+len(c.Changed) == 0
+}
+
+// findings describes each change of c.
+func (c topologyChanges) findings() []string {
+	var findings []string
+	for _, e := range c.Added {
+		findings = append(findings, fmt.Sprintf("added %s %s", collections[e.Collection].entity, e.Name))
+	}
+	for _, e := range c.Removed {
+		findings = append(findings, fmt.Sprintf("removed %s %s", collections[e.Collection].entity, e.Name))
+	}
+	for _, e := range c.Changed {
+		findings = append(findings, fmt.Sprintf("changed %s of %s %s", strings.Join(e.Attributes, ", "), collections[e.Collection].entity, e.Name))
+	}
+	return findings
+}
+
+// collection fetches the entities of a Management API collection, with the
+// attributes whose changes are reported, by name.
+type collection struct {
+	entity string
+	fetch  func(c *management.Client, vhost string) (map[string]map[string]interface{}, error)
+}
+
+// defaultCollections are snapshot when a rule does not set its collections,
+// the connections and channels changing too often to be among them.
+var defaultCollections = []string{"queues", "exchanges", "bindings", "consumers", "policies"}
+
+var collections = map[string]collection{
+	"queues": {
+		entity: "queue",
+		fetch: func(c *management.Client, vhost string) (map[string]map[string]interface{}, error) {
+			queues, err := c.Queues(vhost)
+			entities := make(map[string]map[string]interface{}, len(queues))
+			for _, q := range queues {
+				entities[fmt.Sprintf("%s in %s", q.Name, q.Vhost)] = map[string]interface{}{
+					"type":        q.Type,
+					"durable":     q.Durable,
+					"auto_delete": q.AutoDelete,
+					"exclusive":   q.Exclusive,
+					"arguments":   normalizeArguments(q.Arguments),
+					"policy":      q.Policy,
+					"node":        q.Node,
+				}
+			}
+			return entities, err
+		},
+	},
+	"exchanges": {
+		entity: "exchange",
+		fetch: func(c *management.Client, vhost string) (map[string]map[string]interface{}, error) {
+			exchanges, err := c.Exchanges(vhost)
+			entities := make(map[string]map[string]interface{}, len(exchanges))
+			for _, e := range exchanges {
+				if e.Name == "" {
+					continue
+				}
+				entities[fmt.Sprintf("%s in %s", e.Name, e.Vhost)] = map[string]interface{}{
+					"type":        e.Type,
+					"durable":     e.Durable,
+					"auto_delete": e.AutoDelete,
+					"internal":    e.Internal,
+					"arguments":   normalizeArguments(e.Arguments),
+				}
+			}
+			return entities, err
+		},
+	},
+	"bindings": {
+		entity: "binding",
+		fetch: func(c *management.Client, vhost string) (map[string]map[string]interface{}, error) {
+			bindings, err := c.Bindings(vhost)
+			entities := make(map[string]map[string]interface{}, len(bindings))
+			for _, b := range bindings {
+				// Every queue is bound to the default exchange.
+				if b.Source == "" {
+					continue
+				}
+				key := b.PropertiesKey
+				if key == "" {
+					key = b.RoutingKey
+				}
+				entities[fmt.Sprintf("of %s to %s %s with key `%s` in %s", b.Source, b.DestinationType, b.Destination, key, b.Vhost)] = map[string]interface{}{
+					"routing_key": b.RoutingKey,
+					"arguments":   normalizeArguments(b.Arguments),
+				}
+			}
+			return entities, err
+		},
+	},
+	"consumers": {
+		entity: "consumer",
+		fetch: func(c *management.Client, vhost string) (map[string]map[string]interface{}, error) {
+			consumers, err := c.Consumers(vhost)
+			entities := make(map[string]map[string]interface{}, len(consumers))
+			for _, consumer := range consumers {
+				entities[fmt.Sprintf("%s of queue %s in %s on channel %s", consumer.ConsumerTag, consumer.Queue.Name, consumer.Queue.Vhost, consumer.ChannelDetails.Name)] = map[string]interface{}{
+					"ack_required":   consumer.AckRequired,
+					"exclusive":      consumer.Exclusive,
+					"active":         consumer.Active,
+					"prefetch_count": consumer.PrefetchCount,
+				}
+			}
+			return entities, err
+		},
+	},
+	"policies": {
+		entity: "policy",
+		fetch: func(c *management.Client, vhost string) (map[string]map[string]interface{}, error) {
+			policies, err := c.Policies(vhost)
+			entities := make(map[string]map[string]interface{}, len(policies))
+			for _, p := range policies {
+				entities[fmt.Sprintf("%s in %s", p.Name, p.Vhost)] = map[string]interface{}{
+					"pattern":    p.Pattern,
+					"apply-to":   applyTo(p),
+					"definition": normalizeArguments(p.Definition),
+					"priority":   p.Priority,
+				}
+			}
+			return entities, err
+		},
+	},
+	"connections": {
+		entity: "connection",
+		fetch: func(c *management.Client, vhost string) (map[string]map[string]interface{}, error) {
+			connections, err := c.Connections()
+			entities := make(map[string]map[string]interface{}, len(connections))
+			for _, connection := range connections {
+				if vhost != "" && connection.Vhost != vhost {
+					continue
+				}
+				entities[connection.Name] = map[string]interface{}{
+					"user":      connection.User,
+					"vhost":     connection.Vhost,
+					"node":      connection.Node,
+					"peer_host": connection.PeerHost,
+				}
+			}
+			return entities, err
+		},
+	},
+	"channels": {
+		entity: "channel",
+		fetch: func(c *management.Client, vhost string) (map[string]map[string]interface{}, error) {
+			channels, err := c.Channels()
+			entities := make(map[string]map[string]interface{}, len(channels))
+			for _, channel := range channels {
+				if vhost != "" && channel.Vhost != vhost {
+					continue
+				}
+				entities[channel.Name] = map[string]interface{}{
+					"user":           channel.User,
+					"vhost":          channel.Vhost,
+					"prefetch_count": channel.PrefetchCount,
+				}
+			}
+			return entities, err
+		},
+	},
+}
+
+// takeSnapshot snapshots the collections of cfg on server, the requests
+// going through request.
+func takeSnapshot(server common.Server, cfg common.Changes, request requestFunc) (topologySnapshot, error) {
+	names := cfg.Collections
+	if len(names) == 0 {
+		names = defaultCollections
+	}
+	client := management.NewWithClient(server, &http.Client{
+		Transport: requestTransport{server: server, request: request},
+	})
+
+	snapshot := make(topologySnapshot, len(names))
+	for _, name := range names {
+		name = strings.ToLower(name)
+		c, ok := collections[name]
+		if !ok {
+			return nil, errors.Errorf("unknown collection %s, expected queues, exchanges, bindings, consumers, policies, connections or channels", name)
+		}
+		entities, err := c.fetch(client, cfg.Vhost)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to snapshot the %s", name)
+		}
+		// The attributes are compared with the ones of the persisted
+		// snapshots, whose numbers are decoded as float64.
+		for entity, attributes := range entities {
+			entities[entity] = plainJSON(attributes).(map[string]interface{})
+		}
+		snapshot[name] = entities
+	}
+	return snapshot, nil
+}
+
+// diffSnapshots returns the changes from previous to current, ignoring the
+// collections that previous does not hold, such as on the first scout.
+func diffSnapshots(previous, current topologySnapshot) topologyChanges {
+	var changes topologyChanges
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		before, ok := previous[name]
+		if !ok {
+			continue
+		}
+		after := current[name]
+		for _, entity := range sortedKeys(after) {
+			attributes, ok := before[entity]
+			if !ok {
+				changes.Added = append(changes.Added, topologyEntity{Collection: name, Name: entity, Attributes: after[entity]})
+				continue
+			}
+			var changed []string
+			for _, attribute := range sortedKeys(after[entity]) {
+				if !reflect.DeepEqual(attributes[attribute], after[entity][attribute]) {
+					changed = append(changed, attribute)
+				}
+			}
+			if len(changed) > 0 {
+				changes.Changed = append(changes.Changed, topologyChange{
+					Collection: name,
+					Name:       entity,
+					Attributes: changed,
+					Before:     attributes,
+					After:      after[entity],
+				})
+			}
+		}
+		for _, entity := range sortedKeys(before) {
+			if _, ok := after[entity]; !ok {
+				changes.Removed = append(changes.Removed, topologyEntity{Collection: name, Name: entity, Attributes: before[entity]})
+			}
+		}
+	}
+	return changes
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := reflect.ValueOf(m).MapKeys()
+	sorted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		sorted = append(sorted, key.String())
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// changesRule snapshots the collections of the changes rule of server and
+// compares them with the last reported snapshot, persisted with the state of
+// the rule. The rule fires when something changed and its evaluator, if any,
+// returns true for the changes. The snapshot of a firing rule is only
+// reported once its actions ran, so that the changes found while the rule
+// is delayed or silenced add up until then.
+func changesRule(server common.Server, rule common.Rule, state *State, opts scoutOptions, logger *common.Logger, outcome *Outcome, now time.Time) (bool, error) {
+	snapshot, err := takeSnapshot(server, *rule.Changes, opts.request)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to snapshot the collections")
+	}
+	rs := state.rule(rule.ID)
+	changes := diffSnapshots(rs.Snapshot, snapshot)
+	if changes.empty() {
+		rs.Snapshot = snapshot
+		return false, nil
+	}
+
+	findings := changes.findings()
+	for _, finding := range findings {
+		logger.With(common.Fields{"finding": finding}).Info("Change found")
+	}
+	outcome.Findings = findings
+	outcome.Changes = &changes
+
+	if rule.Evaluator == "" {
+		outcome.snapshot = snapshot
+		return true, nil
+	}
+	logger.Debug("Evaluating rule...")
+	result, err := evaluateRule(rule.Evaluator, plainJSON(changes), response{}, state.history, rule.ID, now)
+	if err != nil {
+		return false, errors.Wrapc(err, map[string]interface{}{
+			"evaluator": rule.Evaluator,
+		}, "failed to evaluate rule")
+	}
+	// The changes the evaluator ignores are not reported later either.
+	if !result {
+		rs.Snapshot = snapshot
+		return false, nil
+	}
+	outcome.snapshot = snapshot
+	return true, nil
+}
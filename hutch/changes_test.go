@@ -0,0 +1,83 @@
+package hutch
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+func TestChangesRuleKeepsTheUnreportedChanges(t *testing.T) {
+	var (
+		queues []string
+		fail   bool
+	)
+	withBuiltin(t, "report", func(action common.Action, ctx actionContext, logger *common.Logger) error {
+		if fail {
+			return errors.New("failed to report the changes")
+		}
+		return nil
+	})
+	opts := scoutOptions{
+		request: func(server common.Server, request common.Request) (response, error) {
+			list := []map[string]interface{}{}
+			for _, name := range queues {
+				list = append(list, map[string]interface{}{"name": name, "vhost": "/", "durable": true})
+			}
+			b, _ := json.Marshal(list)
+			return response{Status: http.StatusOK, Body: string(b)}, nil
+		},
+		limiter: newLimiter(),
+	}
+	rule := common.Rule{
+		ID:      "changes",
+		Changes: &common.Changes{Collections: []string{"queues"}},
+		Delay:   3600000,
+		Actions: []common.Action{{Description: "report", Builtin: "report"}},
+	}
+
+	steps := []struct {
+		name     string
+		queues   []string
+		delayed  bool
+		fail     bool
+		findings []string
+		status   string
+	}{
+		{name: "first snapshot", queues: []string{"a"}},
+		{name: "reported", queues: []string{"a", "b"}, findings: []string{"added queue b in /"}, status: "ok"},
+		{name: "delayed", queues: []string{"a", "b", "c"}, delayed: true, findings: []string{"added queue c in /"}},
+		{
+			name:     "reported after the delay",
+			queues:   []string{"a", "c"},
+			findings: []string{"added queue c in /", "removed queue b in /"},
+			status:   "ok",
+		},
+		{name: "unchanged", queues: []string{"a", "c"}},
+		{name: "failed", queues: []string{"a"}, fail: true, findings: []string{"removed queue c in /"}, status: "failed"},
+		{name: "reported after the failure", queues: []string{"a"}, findings: []string{"removed queue c in /"}, status: "ok"},
+		{name: "unchanged after the failure", queues: []string{"a"}},
+	}
+	state := NewState()
+	for _, step := range steps {
+		queues, fail = step.queues, step.fail
+		if !step.delayed {
+			state.rule(rule.ID).Delay = time.Time{}
+		}
+		outcome := Outcome{}
+		state.mu.Lock()
+		err := processRule(common.Server{Description: "main", Protocol: "http", Host: "rabbit-1", Port: 15672}, rule, state, opts, common.Log, &outcome)
+		state.mu.Unlock()
+		if err != nil {
+			t.Fatalf("%s: processRule() error = %v", step.name, err)
+		}
+		if !reflect.DeepEqual(outcome.Findings, step.findings) || outcome.Delayed != step.delayed || outcome.Status != step.status {
+			t.Errorf("%s: processRule() = findings %v, delayed %t, status %q, want %v, %t, %q",
+				step.name, outcome.Findings, outcome.Delayed, outcome.Status, step.findings, step.delayed, step.status)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package hutch
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/tradeforce/lophutch/management"
+	"github.com/zignd/errors"
+)
+
+const (
+	defaultDeadLetterCount = 10
+
+	redacted = "[redacted]"
+)
+
+// deadLetter is a message of a dead-letter queue, described by the most
+// recent entry of its `x-death` header: the queue it was dead-lettered from,
+// why, how many times, and the exchange and routing keys it was published
+// with.
+type deadLetter struct {
+	Queue       string      `json:"queue,omitempty"`
+	Reason      string      `json:"reason,omitempty"`
+	Count       int         `json:"count,omitempty"`
+	Time        time.Time   `json:"time"`
+	Exchange    string      `json:"exchange,omitempty"`
+	RoutingKeys []string    `json:"routing_keys,omitempty"`
+	Payload     interface{} `json:"payload"`
+}
+
+// deadLetterSummary summarizes the messages sampled from a dead-letter queue,
+// Reasons and Queues counting their deaths by reason and original queue.
+type deadLetterSummary struct {
+	Vhost    string         `json:"vhost"`
+	Queue    string         `json:"queue"`
+	Sampled  int            `json:"sampled"`
+	Reasons  map[string]int `json:"reasons"`
+	Queues   map[string]int `json:"queues"`
+	Messages []deadLetter   `json:"messages"`
+}
+
+// inspectDeadLetters samples the messages of the dead-letter queue of cfg on
+// server, the requests going through request.
+func inspectDeadLetters(server common.Server, cfg common.DeadLetters, request requestFunc) (deadLetterSummary, error) {
+	count := cfg.Count
+	if count <= 0 {
+		count = defaultDeadLetterCount
+	}
+	client := management.NewWithClient(server, &http.Client{
+		Transport: requestTransport{server: server, request: request},
+	})
+	messages, err := client.GetMessages(cfg.Vhost, cfg.Queue, management.GetOptions{
+		Count:    count,
+		Requeue:  true,
+		Truncate: cfg.Truncate,
+	})
+	if err != nil {
+		return deadLetterSummary{}, errors.Wrapf(err, "failed to get the messages of the queue %s", cfg.Queue)
+	}
+
+	summary := deadLetterSummary{
+		Vhost:    cfg.Vhost,
+		Queue:    cfg.Queue,
+		Sampled:  len(messages),
+		Reasons:  make(map[string]int),
+		Queues:   make(map[string]int),
+		Messages: make([]deadLetter, 0, len(messages)),
+	}
+	for _, message := range messages {
+		deaths := xDeath(message)
+		for _, death := range deaths {
+			summary.Reasons[death.Reason] += death.Count
+			summary.Queues[death.Queue] += death.Count
+		}
+		var letter deadLetter
+		if len(deaths) > 0 {
+			letter = deaths[0]
+		}
+		letter.Payload = redactPayload(message, cfg.Redact)
+		summary.Messages = append(summary.Messages, letter)
+	}
+	return summary, nil
+}
+
+// xDeath returns the entries of the `x-death` header of message, the most
+// recent first.
+func xDeath(message management.Message) []deadLetter {
+	headers, _ := message.Properties["headers"].(map[string]interface{})
+	entries, _ := headers["x-death"].([]interface{})
+	deaths := make([]deadLetter, 0, len(entries))
+	for _, entry := range entries {
+		fields, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		death := deadLetter{}
+		death.Queue, _ = fields["queue"].(string)
+		death.Reason, _ = fields["reason"].(string)
+		death.Exchange, _ = fields["exchange"].(string)
+		if count, ok := fields["count"].(float64); ok {
+			death.Count = int(count)
+		}
+		// The Management API renders AMQP timestamps in seconds.
+		if t, ok := fields["time"].(float64); ok {
+			death.Time = time.Unix(int64(t), 0).UTC()
+		}
+		keys, _ := fields["routing-keys"].([]interface{})
+		for _, key := range keys {
+			if key, ok := key.(string); ok {
+				death.RoutingKeys = append(death.RoutingKeys, key)
+			}
+		}
+		deaths = append(deaths, death)
+	}
+	return deaths
+}
+
+// redactPayload returns the payload of message, decoded when it is JSON,
+// with its fields at the paths replaced. The payloads that are not JSON
+// objects or arrays are entirely redacted when there are paths.
+func redactPayload(message management.Message, paths []string) interface{} {
+	var payload interface{}
+	if message.PayloadEncoding != "string" || json.Unmarshal([]byte(message.Payload), &payload) != nil {
+		if len(paths) > 0 {
+			return redacted
+		}
+		return message.Payload
+	}
+	switch payload.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		if len(paths) > 0 {
+			return redacted
+		}
+		return payload
+	}
+	for _, path := range paths {
+		redact(payload, strings.Split(path, "."))
+	}
+	return payload
+}
+
+// redact replaces the field of v at path, applying the path to each element
+// of the arrays it goes through.
+func redact(v interface{}, path []string) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			redact(e, path)
+		}
+	case map[string]interface{}:
+		field, ok := v[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) == 1 {
+			v[path[0]] = redacted
+			return
+		}
+		redact(field, path[1:])
+	}
+}
+
+// deadLetters samples the dead-letter queue of rule, whose templated name can
+// refer to the templateData of the rule.
+func deadLetters(server common.Server, rule common.Rule, opts scoutOptions) (deadLetterSummary, error) {
+	cfg := *rule.DeadLetters
+	if cfg.Templated {
+		queue, err := render("queue", cfg.Queue, templateData(server, rule))
+		if err != nil {
+			return deadLetterSummary{}, errors.Wrap(err, "failed to render the queue name")
+		}
+		cfg.Queue = queue
+	}
+	return inspectDeadLetters(server, cfg, opts.request)
+}
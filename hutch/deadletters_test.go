@@ -0,0 +1,205 @@
+package hutch
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/tradeforce/lophutch/management"
+)
+
+func TestRedactPayload(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		payload  string
+		paths    []string
+		want     interface{}
+	}{
+		{
+			name:    "field",
+			payload: `{"order": 1, "customer": {"email": "jane@example.com", "name": "Jane"}}`,
+			paths:   []string{"customer.email"},
+			want: map[string]interface{}{
+				"order":    1.0,
+				"customer": map[string]interface{}{"email": redacted, "name": "Jane"},
+			},
+		},
+		{
+			name:    "fields of arrays",
+			payload: `[{"cards": [{"number": "4111", "type": "visa"}, {"number": "5500"}]}, {"cards": []}]`,
+			paths:   []string{"cards.number"},
+			want: []interface{}{
+				map[string]interface{}{"cards": []interface{}{
+					map[string]interface{}{"number": redacted, "type": "visa"},
+					map[string]interface{}{"number": redacted},
+				}},
+				map[string]interface{}{"cards": []interface{}{}},
+			},
+		},
+		{
+			name:    "object",
+			payload: `{"customer": {"email": "jane@example.com"}, "order": 1}`,
+			paths:   []string{"customer"},
+			want:    map[string]interface{}{"customer": redacted, "order": 1.0},
+		},
+		{
+			name:    "missing field",
+			payload: `{"order": 1}`,
+			paths:   []string{"customer.email", "order.id"},
+			want:    map[string]interface{}{"order": 1.0},
+		},
+		{name: "without paths", payload: `{"token": "secret"}`, want: map[string]interface{}{"token": "secret"}},
+		{name: "text", payload: "token=secret", paths: []string{"token"}, want: redacted},
+		{name: "text without paths", payload: "token=secret", want: "token=secret"},
+		{name: "truncated JSON", payload: `{"token": "sec`, paths: []string{"token"}, want: redacted},
+		{name: "JSON string", payload: `"secret"`, paths: []string{"token"}, want: redacted},
+		{name: "JSON number without paths", payload: `42`, want: 42.0},
+		{name: "base64", encoding: "base64", payload: "eyJ0b2tlbiI6ICJzZWNyZXQifQ==", paths: []string{"token"}, want: redacted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoding := test.encoding
+			if encoding == "" {
+				encoding = "string"
+			}
+			payload := redactPayload(management.Message{Payload: test.payload, PayloadEncoding: encoding}, test.paths)
+			if !reflect.DeepEqual(payload, test.want) {
+				t.Errorf("redactPayload() = %#v, want %#v", payload, test.want)
+			}
+		})
+	}
+}
+
+// deadLettersBody is the response of the `/get` endpoint with a rejected
+// message and an expired one, both with secrets in their payload.
+const deadLettersBody = `[
+  {
+    "payload": "{\"order\": 1, \"customer\": {\"card\": \"4111-SECRET\"}}",
+    "payload_encoding": "string",
+    "properties": {"headers": {"x-death": [
+      {"queue": "orders", "reason": "rejected", "count": 2, "time": 1760781600, "exchange": "orders", "routing-keys": ["order.created"]},
+      {"queue": "orders.retry", "reason": "expired", "count": 1, "time": 1760781000, "exchange": ""}
+    ]}}
+  },
+  {
+    "payload": "card=4111-SECRET",
+    "payload_encoding": "string",
+    "properties": {"headers": {"x-death": [
+      {"queue": "payments", "reason": "expired", "count": 1, "time": 1760781700, "exchange": "payments"}
+    ]}}
+  }
+]`
+
+// deadLettersOptions answers the request of firingRule and the `/get`
+// requests, which are kept in gets.
+func deadLettersOptions(gets *[]common.Request) scoutOptions {
+	opts := firingOptions()
+	overview := opts.request
+	opts.request = func(server common.Server, request common.Request) (response, error) {
+		if strings.HasSuffix(request.Path, "/get") {
+			*gets = append(*gets, request)
+			return response{Status: http.StatusOK, Body: deadLettersBody}, nil
+		}
+		return overview(server, request)
+	}
+	return opts
+}
+
+func TestInspectDeadLetters(t *testing.T) {
+	var gets []common.Request
+	opts := deadLettersOptions(&gets)
+	cfg := common.DeadLetters{Vhost: "/", Queue: "orders.dlq", Count: 5, Truncate: 100, Redact: []string{"customer.card"}}
+	summary, err := inspectDeadLetters(common.Server{Protocol: "http", Host: "rabbit-1", Port: 15672}, cfg, opts.request)
+	if err != nil {
+		t.Fatalf("inspectDeadLetters() error = %v", err)
+	}
+
+	if len(gets) != 1 || gets[0].Path != "/api/queues/%2F/orders.dlq/get" {
+		t.Fatalf("requests = %+v, want the messages of the queue", gets)
+	}
+	var get map[string]interface{}
+	if err := json.Unmarshal([]byte(gets[0].Body), &get); err != nil {
+		t.Fatalf("invalid request body %q: %v", gets[0].Body, err)
+	}
+	wantGet := map[string]interface{}{"count": 5.0, "ackmode": "ack_requeue_true", "encoding": "auto", "truncate": 100.0}
+	if !reflect.DeepEqual(get, wantGet) {
+		t.Errorf("request body = %v, want %v", get, wantGet)
+	}
+
+	want := deadLetterSummary{
+		Vhost:   "/",
+		Queue:   "orders.dlq",
+		Sampled: 2,
+		Reasons: map[string]int{"rejected": 2, "expired": 2},
+		Queues:  map[string]int{"orders": 2, "orders.retry": 1, "payments": 1},
+		Messages: []deadLetter{
+			{
+				Queue:       "orders",
+				Reason:      "rejected",
+				Count:       2,
+				Time:        time.Unix(1760781600, 0).UTC(),
+				Exchange:    "orders",
+				RoutingKeys: []string{"order.created"},
+				Payload:     map[string]interface{}{"order": 1.0, "customer": map[string]interface{}{"card": redacted}},
+			},
+			{
+				Queue:    "payments",
+				Reason:   "expired",
+				Count:    1,
+				Time:     time.Unix(1760781700, 0).UTC(),
+				Exchange: "payments",
+				Payload:  redacted,
+			},
+		},
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Errorf("inspectDeadLetters() = %+v, want %+v", summary, want)
+	}
+}
+
+// The redacted fields of the dead letters reach neither the logs, the
+// rendered actions nor the outcomes.
+func TestDeadLettersSecrets(t *testing.T) {
+	log := captureLog(t)
+	var gets []common.Request
+	opts := deadLettersOptions(&gets)
+	opts.dryRun = true
+	rule := firingRule(common.Action{
+		Description: "notify",
+		Cmd:         "notify-ops",
+		Args:        []string{"{{range .DeadLetters.Messages}}{{.Reason}}: {{.Payload}}. {{end}}"},
+		Templated:   true,
+	})
+	rule.DeadLetters = &common.DeadLetters{Vhost: "/", Queue: "orders.dlq", Redact: []string{"customer.card"}}
+
+	state := NewState()
+	outcome := Outcome{Rule: rule.ID}
+	state.mu.Lock()
+	err := processRule(common.Server{Description: "main", Protocol: "http", Host: "rabbit-1", Port: 15672}, rule, state, opts, common.Log, &outcome)
+	state.mu.Unlock()
+	if err != nil {
+		t.Fatalf("processRule() error = %v", err)
+	}
+	if len(gets) != 1 || outcome.DeadLetters == nil || outcome.DeadLetters.Sampled != 2 || len(outcome.Actions) != 1 {
+		t.Fatalf("processRule() outcome = %+v, want the dead letters sampled and the action rendered", outcome)
+	}
+	if args := outcome.Actions[0].Args; !strings.Contains(args[0], "[redacted]") {
+		t.Errorf("rendered arguments = %q, want the redacted payloads", args)
+	}
+
+	var printed bytes.Buffer
+	if err := printOutcomes(&printed, []Outcome{outcome}); err != nil {
+		t.Fatalf("printOutcomes() error = %v", err)
+	}
+	for name, out := range map[string]string{"logs": log.String(), "outcomes": printed.String()} {
+		if strings.Contains(out, "4111-SECRET") {
+			t.Errorf("the secret reached the %s:\n%s", name, out)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package hutch
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/robertkrimen/otto"
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// requestPath returns the path of request with its columns, which let the
+// Management API leave out the fields that are not needed.
+func requestPath(request common.Request) string {
+	if len(request.Columns) == 0 {
+		return request.Path
+	}
+	sep := "?"
+	if strings.Contains(request.Path, "?") {
+		sep = "&"
+	}
+	return request.Path + sep + "columns=" + url.QueryEscape(strings.Join(request.Columns, ","))
+}
+
+// decodeJSON decodes the JSON document read from r keeping only columns.
+// The elements of an array are decoded one at a time, only the fields of
+// columns being decoded and the others skipped, so that the fields left out
+// of a large list are never held in memory.
+func decodeJSON(r io.Reader, columns []string) (interface{}, error) {
+	br := bufio.NewReader(r)
+	dec := json.NewDecoder(br)
+	if !startsWith(br, '[') {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, errors.Wrap(err, "failed to decode the JSON body")
+		}
+		return project(v, columns), nil
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, errors.Wrap(err, "failed to decode the JSON body")
+	}
+	d := columnDecoder{dec: dec, tree: newColumnTree(columns)}
+	items := []interface{}{}
+	for dec.More() {
+		var item interface{}
+		var err error
+		if len(columns) == 0 {
+			err = dec.Decode(&item)
+		} else {
+			item, err = d.item()
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode the element %d of the JSON body", len(items))
+		}
+		items = append(items, item)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, errors.Wrap(err, "failed to decode the JSON body")
+	}
+	return items, nil
+}
+
+// columnTree is the tree of the fields of columns, the fields kept whole
+// having no children.
+type columnTree map[string]columnTree
+
+func newColumnTree(columns []string) columnTree {
+	tree := columnTree{}
+	for _, column := range columns {
+		node := tree
+		keys := strings.Split(column, ".")
+		for i, key := range keys {
+			child, ok := node[key]
+			if ok && child == nil {
+				break
+			}
+			if i == len(keys)-1 {
+				node[key] = nil
+				break
+			}
+			if child == nil {
+				child = columnTree{}
+				node[key] = child
+			}
+			node = child
+		}
+	}
+	return tree
+}
+
+// columnDecoder decodes the elements of an array like projectItem restricts
+// them, skipping the values of the fields that are not kept.
+type columnDecoder struct {
+	dec  *json.Decoder
+	tree columnTree
+	// skipped holds the last skipped value, its buffer being reused.
+	skipped json.RawMessage
+}
+
+// item decodes the next element of the array.
+func (d *columnDecoder) item() (interface{}, error) {
+	t, err := d.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case json.Delim('{'):
+		return d.object(d.tree)
+	case json.Delim('['):
+		items := []interface{}{}
+		for d.dec.More() {
+			var item interface{}
+			if err := d.dec.Decode(&item); err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		_, err := d.dec.Token()
+		return items, err
+	}
+	return t, nil
+}
+
+// object decodes the fields of tree of the object whose opening brace was
+// read.
+func (d *columnDecoder) object(tree columnTree) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(tree))
+	for d.dec.More() {
+		t, err := d.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := t.(string)
+		child, ok := tree[key]
+		switch {
+		case !ok:
+			err = d.dec.Decode(&d.skipped)
+		case child == nil:
+			var value interface{}
+			if err = d.dec.Decode(&value); err == nil {
+				out[key] = value
+			}
+		default:
+			err = d.nested(out, key, child)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err := d.dec.Token()
+	return out, err
+}
+
+// nested decodes the fields of tree of the value of key into out when it is
+// an object, and skips it otherwise.
+func (d *columnDecoder) nested(out map[string]interface{}, key string, tree columnTree) error {
+	t, err := d.dec.Token()
+	if err != nil {
+		return err
+	}
+	switch t {
+	case json.Delim('{'):
+		obj, err := d.object(tree)
+		if err != nil {
+			return err
+		}
+		out[key] = obj
+	case json.Delim('['):
+		for d.dec.More() {
+			if err := d.dec.Decode(&d.skipped); err != nil {
+				return err
+			}
+		}
+		_, err = d.dec.Token()
+	}
+	return err
+}
+
+// startsWith reports whether the first character of r, past the white
+// space, is c.
+func startsWith(r *bufio.Reader, c byte) bool {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			r.UnreadByte()
+			return b == c
+		}
+	}
+}
+
+// project keeps only the columns of v, the dot separated paths of the
+// fields of each element of a list, of each item of a page or of a single
+// object, like the `columns` parameter of the Management API.
+func project(v interface{}, columns []string) interface{} {
+	if len(columns) == 0 {
+		return v
+	}
+	switch v := v.(type) {
+	case []interface{}:
+		for i, item := range v {
+			v[i] = projectItem(item, columns)
+		}
+		return v
+	case map[string]interface{}:
+		if items, ok := v["items"].([]interface{}); ok {
+			if _, paged := v["page"]; paged {
+				v["items"] = project(items, columns)
+				return v
+			}
+		}
+	}
+	return projectItem(v, columns)
+}
+
+func projectItem(v interface{}, columns []string) interface{} {
+	obj, ok := v.(map[string]interface{})
+	if !ok || len(columns) == 0 {
+		return v
+	}
+	out := make(map[string]interface{}, len(columns))
+	for _, column := range columns {
+		keys := strings.Split(column, ".")
+		src, dst := obj, out
+		for i, key := range keys {
+			value, ok := src[key]
+			if !ok {
+				break
+			}
+			if i == len(keys)-1 {
+				dst[key] = value
+				break
+			}
+			next, ok := value.(map[string]interface{})
+			if !ok {
+				break
+			}
+			child, ok := dst[key].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				dst[key] = child
+			}
+			src, dst = next, child
+		}
+	}
+	return out
+}
+
+// jsValue prepares the decoded v to be handed to the evaluators as is,
+// without being encoded and parsed again by the VM. The VM reads a nil Go
+// value as undefined, the null values are replaced so that they stay null.
+func jsValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return otto.NullValue()
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = jsValue(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsValue(value)
+		}
+	}
+	return v
+}
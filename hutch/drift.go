@@ -0,0 +1,346 @@
+package hutch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/tradeforce/lophutch/management"
+	"github.com/zignd/errors"
+)
+
+// driftChange is an object whose actual definition differs from the desired
+// one.
+type driftChange struct {
+	Kind    string      `json:"kind"`
+	Name    string      `json:"name"`
+	Desired interface{} `json:"desired"`
+	Actual  interface{} `json:"actual"`
+}
+
+// topologyDrift is the difference between the definitions of a server and
+// the desired ones: the Missing objects are desired but do not exist, the
+// Unexpected ones exist but are not desired.
+type topologyDrift struct {
+	Missing    management.Definitions `json:"missing"`
+	Unexpected management.Definitions `json:"unexpected"`
+	Changed    []driftChange          `json:"changed,omitempty"`
+}
+
+// driftKind describes how the objects of a kind, stored in the field of
+// management.Definitions, are identified and compared. Objects with the
+// same key are the same object, and they changed when equal returns false.
+type driftKind struct {
+	name  string
+	field string
+	key   func(v interface{}) string
+	equal func(desired, actual interface{}) bool
+	// ignore skips the objects of the server created by RabbitMQ.
+	ignore func(v interface{}) bool
+}
+
+// driftKinds are the kinds of objects compared, in the order they are
+// created when the definitions are applied again.
+var driftKinds = []driftKind{
+	{
+		name:  "vhosts",
+		field: "Vhosts",
+		key: func(v interface{}) string {
+			return "vhost " + v.(management.Vhost).Name
+		},
+	},
+	{
+		name:  "users",
+		field: "Users",
+		key: func(v interface{}) string {
+			return "user " + v.(management.User).Name
+		},
+		equal: func(desired, actual interface{}) bool {
+			return sameTags(desired.(management.User).Tags, actual.(management.User).Tags)
+		},
+	},
+	{
+		name:  "permissions",
+		field: "Permissions",
+		key: func(v interface{}) string {
+			p := v.(management.Permission)
+			return fmt.Sprintf("permission of %s in %s", p.User, p.Vhost)
+		},
+		equal: func(desired, actual interface{}) bool {
+			return desired.(management.Permission) == actual.(management.Permission)
+		},
+	},
+	{
+		name:  "exchanges",
+		field: "Exchanges",
+		key: func(v interface{}) string {
+			e := v.(management.ExchangeDefinition)
+			return fmt.Sprintf("exchange %s in %s", e.Name, e.Vhost)
+		},
+		equal: func(desired, actual interface{}) bool {
+			d, a := desired.(management.ExchangeDefinition), actual.(management.ExchangeDefinition)
+			return d.Type == a.Type && d.Durable == a.Durable && d.AutoDelete == a.AutoDelete &&
+				d.Internal == a.Internal && sameArguments(d.Arguments, a.Arguments)
+		},
+		ignore: func(v interface{}) bool {
+			name := v.(management.ExchangeDefinition).Name
+			return name == "" || strings.HasPrefix(name, "amq.")
+		},
+	},
+	{
+		name:  "queues",
+		field: "Queues",
+		key: func(v interface{}) string {
+			q := v.(management.QueueDefinition)
+			return fmt.Sprintf("queue %s in %s", q.Name, q.Vhost)
+		},
+		equal: func(desired, actual interface{}) bool {
+			d, a := desired.(management.QueueDefinition), actual.(management.QueueDefinition)
+			return d.Durable == a.Durable && d.AutoDelete == a.AutoDelete && sameArguments(d.Arguments, a.Arguments)
+		},
+	},
+	{
+		name:  "bindings",
+		field: "Bindings",
+		key: func(v interface{}) string {
+			b := v.(management.Binding)
+			args, _ := json.Marshal(normalizeArguments(b.Arguments))
+			return fmt.Sprintf("binding of %s to %s %s with routing key `%s` and arguments %s in %s",
+				b.Source, b.DestinationType, b.Destination, b.RoutingKey, args, b.Vhost)
+		},
+	},
+	{
+		name:  "policies",
+		field: "Policies",
+		key: func(v interface{}) string {
+			p := v.(management.Policy)
+			return fmt.Sprintf("policy %s in %s", p.Name, p.Vhost)
+		},
+		equal: func(desired, actual interface{}) bool {
+			d, a := desired.(management.Policy), actual.(management.Policy)
+			return d.Pattern == a.Pattern && applyTo(d) == applyTo(a) && d.Priority == a.Priority &&
+				sameArguments(d.Definition, a.Definition)
+		},
+	},
+}
+
+func sameTags(a, b management.Tags) bool {
+	x := append([]string(nil), a...)
+	y := append([]string(nil), b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	return reflect.DeepEqual(normalizeTags(x), normalizeTags(y))
+}
+
+func normalizeTags(tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+func normalizeArguments(args map[string]interface{}) map[string]interface{} {
+	if args == nil {
+		return map[string]interface{}{}
+	}
+	return args
+}
+
+func sameArguments(a, b map[string]interface{}) bool {
+	return reflect.DeepEqual(normalizeArguments(a), normalizeArguments(b))
+}
+
+func applyTo(p management.Policy) string {
+	if p.ApplyTo == "" {
+		return "all"
+	}
+	return p.ApplyTo
+}
+
+// diffDefinitions compares the actual definitions of a server with the
+// desired ones, for the kinds of objects of cfg.
+func diffDefinitions(desired, actual management.Definitions, cfg common.Drift) (topologyDrift, error) {
+	enabled := make(map[string]bool, len(cfg.Kinds))
+	for _, kind := range cfg.Kinds {
+		enabled[strings.ToLower(kind)] = true
+	}
+	known := make(map[string]bool, len(driftKinds))
+	for _, kind := range driftKinds {
+		known[kind.name] = true
+	}
+	for kind := range enabled {
+		if !known[kind] {
+			return topologyDrift{}, errors.Errorf("unknown kind %s, expected vhosts, users, permissions, policies, exchanges, queues or bindings", kind)
+		}
+	}
+
+	var d topologyDrift
+	missing := reflect.ValueOf(&d.Missing).Elem()
+	unexpected := reflect.ValueOf(&d.Unexpected).Elem()
+	for _, kind := range driftKinds {
+		if len(enabled) > 0 && !enabled[kind.name] {
+			continue
+		}
+		desiredObjects := reflect.ValueOf(desired).FieldByName(kind.field)
+		actualObjects := reflect.ValueOf(actual).FieldByName(kind.field)
+
+		actualByKey := make(map[string]interface{}, actualObjects.Len())
+		for i := 0; i < actualObjects.Len(); i++ {
+			v := actualObjects.Index(i).Interface()
+			actualByKey[kind.key(v)] = v
+		}
+		desiredKeys := make(map[string]bool, desiredObjects.Len())
+		for i := 0; i < desiredObjects.Len(); i++ {
+			v := desiredObjects.Index(i).Interface()
+			key := kind.key(v)
+			desiredKeys[key] = true
+			a, ok := actualByKey[key]
+			if !ok {
+				field := missing.FieldByName(kind.field)
+				field.Set(reflect.Append(field, desiredObjects.Index(i)))
+				continue
+			}
+			if kind.equal != nil && !kind.equal(v, a) {
+				d.Changed = append(d.Changed, driftChange{Kind: kind.name, Name: key, Desired: plainJSON(v), Actual: plainJSON(a)})
+			}
+		}
+		if cfg.IgnoreUnexpected {
+			continue
+		}
+		for i := 0; i < actualObjects.Len(); i++ {
+			v := actualObjects.Index(i).Interface()
+			if desiredKeys[kind.key(v)] || (kind.ignore != nil && kind.ignore(v)) {
+				continue
+			}
+			field := unexpected.FieldByName(kind.field)
+			field.Set(reflect.Append(field, actualObjects.Index(i)))
+		}
+	}
+	return d, nil
+}
+
+// plainJSON converts v to the maps and slices it is encoded to, like the
+// change recorded in a fixture is decoded.
+func plainJSON(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var plain interface{}
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return v
+	}
+	return plain
+}
+
+// findings describes each difference of d.
+func (d topologyDrift) findings() []string {
+	var findings []string
+	for _, kind := range driftKinds {
+		missing := reflect.ValueOf(d.Missing).FieldByName(kind.field)
+		for i := 0; i < missing.Len(); i++ {
+			findings = append(findings, "missing "+kind.key(missing.Index(i).Interface()))
+		}
+		unexpected := reflect.ValueOf(d.Unexpected).FieldByName(kind.field)
+		for i := 0; i < unexpected.Len(); i++ {
+			findings = append(findings, "unexpected "+kind.key(unexpected.Index(i).Interface()))
+		}
+	}
+	for _, change := range d.Changed {
+		findings = append(findings, "changed "+change.Name)
+	}
+	return findings
+}
+
+// checkDrift compares the definitions of server, requested through request,
+// with the desired ones of cfg.
+func checkDrift(server common.Server, cfg common.Drift, request requestFunc) (topologyDrift, error) {
+	b, err := ioutil.ReadFile(cfg.File)
+	if err != nil {
+		return topologyDrift{}, errors.Wrapf(err, "failed to read the desired definitions %s", cfg.File)
+	}
+	var desired management.Definitions
+	if err := json.Unmarshal(b, &desired); err != nil {
+		return topologyDrift{}, errors.Wrapf(err, "failed to decode the desired definitions %s", cfg.File)
+	}
+
+	client := management.NewWithClient(server, &http.Client{
+		Transport: requestTransport{server: server, request: request},
+	})
+	actual, err := client.Definitions()
+	if err != nil {
+		return topologyDrift{}, errors.Wrap(err, "failed to export the definitions of the server")
+	}
+	return diffDefinitions(desired, actual, cfg)
+}
+
+// reapplyDefinitions is the `reapply_definitions` built-in action, which
+// creates the objects found missing by the drift check of the rule, or only
+// those of the kinds of its `kinds` option.
+func reapplyDefinitions(action common.Action, ctx actionContext, logger *common.Logger) error {
+	if ctx.outcome.Drift == nil {
+		return errors.New("the rule has no drift to re-apply")
+	}
+	var options struct {
+		Kinds []string
+	}
+	if err := decodeOptions(action.Options, &options); err != nil {
+		return err
+	}
+	missing := ctx.outcome.Drift.Missing
+	if len(options.Kinds) > 0 {
+		// Comparing the missing objects with nothing keeps those of the kinds.
+		d, err := diffDefinitions(missing, management.Definitions{}, common.Drift{Kinds: options.Kinds, IgnoreUnexpected: true})
+		if err != nil {
+			return errors.Wrap(err, "invalid kinds option")
+		}
+		missing = d.Missing
+	}
+	client := management.New(ctx.server)
+
+	var steps []func() error
+	for _, v := range missing.Vhosts {
+		v := v
+		steps = append(steps, func() error { return client.DeclareVhost(v) })
+	}
+	for _, u := range missing.Users {
+		u := u
+		steps = append(steps, func() error { return client.PutUser(u) })
+	}
+	for _, p := range missing.Permissions {
+		p := p
+		steps = append(steps, func() error { return client.PutPermission(p) })
+	}
+	for _, e := range missing.Exchanges {
+		e := e
+		steps = append(steps, func() error { return client.DeclareExchange(e) })
+	}
+	for _, q := range missing.Queues {
+		q := q
+		steps = append(steps, func() error { return client.DeclareQueue(q) })
+	}
+	for _, b := range missing.Bindings {
+		b := b
+		steps = append(steps, func() error { return client.Bind(b) })
+	}
+	for _, p := range missing.Policies {
+		p := p
+		steps = append(steps, func() error { return client.PutPolicy(p) })
+	}
+
+	findings := topologyDrift{Missing: missing}.findings()
+	for i, step := range steps {
+		if err := step(); err != nil {
+			return errors.Wrapcf(err, map[string]interface{}{
+				"applied": i,
+			}, "failed to re-apply the %s", strings.TrimPrefix(findings[i], "missing "))
+		}
+		logger.With(common.Fields{"object": strings.TrimPrefix(findings[i], "missing ")}).Info("Re-applied")
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package hutch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/tradeforce/lophutch/management"
+)
+
+func TestDiffDefinitions(t *testing.T) {
+	user := management.User{Name: "app", Tags: management.Tags{"monitoring"}}
+	permission := management.Permission{User: "app", Vhost: "/", Configure: ".*", Write: ".*", Read: ".*"}
+	exchange := management.ExchangeDefinition{Name: "orders", Vhost: "/", Type: "topic", Durable: true}
+	queue := management.QueueDefinition{Name: "orders", Vhost: "/", Durable: true}
+	binding := management.Binding{Source: "orders", Vhost: "/", Destination: "orders", DestinationType: "queue", RoutingKey: "#"}
+	policy := management.Policy{Name: "ttl", Vhost: "/", Pattern: ".*", Definition: map[string]interface{}{"message-ttl": 1000.0}}
+
+	tests := []struct {
+		name     string
+		desired  management.Definitions
+		actual   management.Definitions
+		cfg      common.Drift
+		findings []string
+	}{
+		{
+			name:     "missing vhost",
+			desired:  management.Definitions{Vhosts: []management.Vhost{{Name: "orders"}}},
+			findings: []string{"missing vhost orders"},
+		},
+		{
+			name:     "unexpected vhost",
+			actual:   management.Definitions{Vhosts: []management.Vhost{{Name: "orders"}}},
+			findings: []string{"unexpected vhost orders"},
+		},
+		{
+			name:     "missing user",
+			desired:  management.Definitions{Users: []management.User{user}},
+			findings: []string{"missing user app"},
+		},
+		{
+			name:     "unexpected user",
+			actual:   management.Definitions{Users: []management.User{user}},
+			findings: []string{"unexpected user app"},
+		},
+		{
+			name:     "changed user",
+			desired:  management.Definitions{Users: []management.User{user}},
+			actual:   management.Definitions{Users: []management.User{{Name: "app", Tags: management.Tags{"administrator"}}}},
+			findings: []string{"changed user app"},
+		},
+		{
+			name:    "same user with the tags in another order",
+			desired: management.Definitions{Users: []management.User{{Name: "app", Tags: management.Tags{"monitoring", "policymaker"}}}},
+			actual:  management.Definitions{Users: []management.User{{Name: "app", Tags: management.Tags{"policymaker", "monitoring"}}}},
+		},
+		{
+			name:     "missing permission",
+			desired:  management.Definitions{Permissions: []management.Permission{permission}},
+			findings: []string{"missing permission of app in /"},
+		},
+		{
+			name:     "unexpected permission",
+			actual:   management.Definitions{Permissions: []management.Permission{permission}},
+			findings: []string{"unexpected permission of app in /"},
+		},
+		{
+			name:     "changed permission",
+			desired:  management.Definitions{Permissions: []management.Permission{permission}},
+			actual:   management.Definitions{Permissions: []management.Permission{{User: "app", Vhost: "/", Configure: "", Write: ".*", Read: ".*"}}},
+			findings: []string{"changed permission of app in /"},
+		},
+		{
+			name:     "missing exchange",
+			desired:  management.Definitions{Exchanges: []management.ExchangeDefinition{exchange}},
+			findings: []string{"missing exchange orders in /"},
+		},
+		{
+			name:     "unexpected exchange",
+			actual:   management.Definitions{Exchanges: []management.ExchangeDefinition{exchange}},
+			findings: []string{"unexpected exchange orders in /"},
+		},
+		{
+			name:     "changed exchange",
+			desired:  management.Definitions{Exchanges: []management.ExchangeDefinition{exchange}},
+			actual:   management.Definitions{Exchanges: []management.ExchangeDefinition{{Name: "orders", Vhost: "/", Type: "direct", Durable: true}}},
+			findings: []string{"changed exchange orders in /"},
+		},
+		{
+			name: "default exchanges are never unexpected",
+			actual: management.Definitions{Exchanges: []management.ExchangeDefinition{
+				{Name: "", Vhost: "/", Type: "direct"},
+				{Name: "amq.topic", Vhost: "/", Type: "topic"},
+			}},
+		},
+		{
+			name:     "missing queue",
+			desired:  management.Definitions{Queues: []management.QueueDefinition{queue}},
+			findings: []string{"missing queue orders in /"},
+		},
+		{
+			name:     "unexpected queue",
+			actual:   management.Definitions{Queues: []management.QueueDefinition{queue}},
+			findings: []string{"unexpected queue orders in /"},
+		},
+		{
+			name:    "changed queue",
+			desired: management.Definitions{Queues: []management.QueueDefinition{queue}},
+			actual: management.Definitions{Queues: []management.QueueDefinition{{
+				Name: "orders", Vhost: "/", Durable: true, Arguments: map[string]interface{}{"x-queue-type": "quorum"},
+			}}},
+			findings: []string{"changed queue orders in /"},
+		},
+		{
+			name:     "missing binding",
+			desired:  management.Definitions{Bindings: []management.Binding{binding}},
+			findings: []string{"missing binding of orders to queue orders with routing key `#` and arguments {} in /"},
+		},
+		{
+			name:     "unexpected binding",
+			actual:   management.Definitions{Bindings: []management.Binding{binding}},
+			findings: []string{"unexpected binding of orders to queue orders with routing key `#` and arguments {} in /"},
+		},
+		{
+			// The arguments identify a binding, which never changes.
+			name:    "binding with other arguments",
+			desired: management.Definitions{Bindings: []management.Binding{binding}},
+			actual: management.Definitions{Bindings: []management.Binding{{
+				Source: "orders", Vhost: "/", Destination: "orders", DestinationType: "queue", RoutingKey: "#",
+				Arguments: map[string]interface{}{"x-match": "all"},
+			}}},
+			findings: []string{
+				"missing binding of orders to queue orders with routing key `#` and arguments {} in /",
+				"unexpected binding of orders to queue orders with routing key `#` and arguments {\"x-match\":\"all\"} in /",
+			},
+		},
+		{
+			name:     "missing policy",
+			desired:  management.Definitions{Policies: []management.Policy{policy}},
+			findings: []string{"missing policy ttl in /"},
+		},
+		{
+			name:     "unexpected policy",
+			actual:   management.Definitions{Policies: []management.Policy{policy}},
+			findings: []string{"unexpected policy ttl in /"},
+		},
+		{
+			name:    "changed policy",
+			desired: management.Definitions{Policies: []management.Policy{policy}},
+			actual: management.Definitions{Policies: []management.Policy{{
+				Name: "ttl", Vhost: "/", Pattern: ".*", Definition: map[string]interface{}{"message-ttl": 2000.0},
+			}}},
+			findings: []string{"changed policy ttl in /"},
+		},
+		{
+			name:     "ignored unexpected objects",
+			desired:  management.Definitions{Users: []management.User{user}},
+			actual:   management.Definitions{Permissions: []management.Permission{permission}},
+			cfg:      common.Drift{IgnoreUnexpected: true},
+			findings: []string{"missing user app"},
+		},
+		{
+			name:     "kinds",
+			desired:  management.Definitions{Users: []management.User{user}, Permissions: []management.Permission{permission}},
+			cfg:      common.Drift{Kinds: []string{"Permissions"}},
+			findings: []string{"missing permission of app in /"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := diffDefinitions(test.desired, test.actual, test.cfg)
+			if err != nil {
+				t.Fatalf("diffDefinitions() error = %v", err)
+			}
+			if findings := d.findings(); !reflect.DeepEqual(findings, test.findings) {
+				t.Errorf("diffDefinitions() findings = %q, want %q", findings, test.findings)
+			}
+		})
+	}
+}
+
+func TestDiffDefinitionsUnknownKind(t *testing.T) {
+	if _, err := diffDefinitions(management.Definitions{}, management.Definitions{}, common.Drift{Kinds: []string{"shovels"}}); err == nil {
+		t.Error("diffDefinitions() error = nil, want the unknown kind")
+	}
+}
+
+func TestReapplyDefinitions(t *testing.T) {
+	var requests []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.EscapedPath())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer api.Close()
+	u, err := url.Parse(api.URL)
+	if err != nil {
+		t.Fatalf("invalid address %s: %v", api.URL, err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	server := common.Server{Description: "main", Protocol: "http", Host: u.Hostname(), Port: port}
+	drift := &topologyDrift{
+		Missing: management.Definitions{
+			Vhosts:      []management.Vhost{{Name: "orders"}},
+			Users:       []management.User{{Name: "app"}},
+			Permissions: []management.Permission{{User: "app", Vhost: "orders", Configure: ".*", Write: ".*", Read: ".*"}},
+			Queues:      []management.QueueDefinition{{Name: "orders", Vhost: "orders", Durable: true}},
+		},
+		// Unexpected and changed objects are left as they are.
+		Unexpected: management.Definitions{Users: []management.User{{Name: "guest"}}},
+		Changed:    []driftChange{{Kind: "permissions", Name: "permission of monitor in /"}},
+	}
+
+	tests := []struct {
+		name     string
+		options  map[string]interface{}
+		requests []string
+	}{
+		{
+			name: "all kinds",
+			requests: []string{
+				"PUT /api/vhosts/orders",
+				"PUT /api/users/app",
+				"PUT /api/permissions/orders/app",
+				"PUT /api/queues/orders/orders",
+			},
+		},
+		{
+			name:     "kinds option",
+			options:  map[string]interface{}{"kinds": []interface{}{"permissions"}},
+			requests: []string{"PUT /api/permissions/orders/app"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests = nil
+			action := common.Action{Description: "reapply", Builtin: "reapply_definitions", Options: test.options}
+			ctx := actionContext{server: server, outcome: &Outcome{Drift: drift}}
+			if err := reapplyDefinitions(action, ctx, common.Log); err != nil {
+				t.Fatalf("reapplyDefinitions() error = %v", err)
+			}
+			if !reflect.DeepEqual(requests, test.requests) {
+				t.Errorf("reapplyDefinitions() requests = %q, want %q", requests, test.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package hutch
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// Outcome summarizes the processing of a rule of a server during a scout.
+type Outcome struct {
+	Server     string `json:"server"`
+	Rule       string `json:"rule"`
+	Result     bool   `json:"result"`
+	Delayed    bool   `json:"delayed"`
+	Silenced   string `json:"silenced,omitempty"`
+	Escalation int    `json:"escalation,omitempty"`
+	// ResponseStatus is the status of the response when it matched the
+	// `on_status` setting of the rule.
+	ResponseStatus int `json:"response_status,omitempty"`
+	// Checks are the checks that fired, with their value.
+	Checks []string `json:"checks,omitempty"`
+	// Findings are what the built-in, drift or changes check of the rule
+	// found.
+	Findings []string `json:"findings,omitempty"`
+	// Drift is the difference found by the drift check of the rule.
+	Drift *topologyDrift `json:"drift,omitempty"`
+	// Changes are the changes found by the changes check of the rule.
+	Changes *topologyChanges `json:"changes,omitempty"`
+	// DeadLetters are the messages sampled from the dead-letter queue of
+	// the rule before executing its actions.
+	DeadLetters *deadLetterSummary `json:"dead_letters,omitempty"`
+	// Event is the event that triggered the rule.
+	Event *event `json:"event,omitempty"`
+	// Status is `ok`, `partial` or `failed` depending on how many of the
+	// actions failed, it is empty when no action was executed.
+	Status        string   `json:"status,omitempty"`
+	FailedActions []string `json:"failed_actions,omitempty"`
+	// LimitedActions were not executed due to a rate limit or the circuit
+	// breaker.
+	LimitedActions []string        `json:"limited_actions,omitempty"`
+	Actions        []common.Action `json:"actions,omitempty"`
+	Error          string          `json:"error,omitempty"`
+
+	// snapshot is the snapshot of a firing changes rule, which the next
+	// changes are found from once the actions of the rule ran.
+	snapshot topologySnapshot
+}
+
+// printOutcomes writes the outcomes of a scout to w as indented JSON so that
+// dry runs of different configuration files can be diffed.
+func printOutcomes(w io.Writer, outcomes []Outcome) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(outcomes); err != nil {
+		return errors.Wrap(err, "failed to encode the outcomes")
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package hutch
+
+import (
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// escalate executes the actions of the escalation steps of rule that became
+// due since the last scout. Each step is executed once until the rule
+// resolves, and none is executed after the rule is acknowledged. A step whose
+// actions all failed is executed again on the next scout instead of
+// escalating to the next one. The actions are executed without holding
+// state.mu.
+func escalate(server common.Server, rule common.Rule, state *State, rs *ruleState, now time.Time, opts scoutOptions, logger *common.Logger, outcome *Outcome) error {
+	if rs.AcknowledgedBy != "" {
+		if rs.Step < len(rule.Escalation) {
+			logger.With(common.Fields{"acknowledged_by": rs.AcknowledgedBy}).Debug("Escalation stopped by acknowledgement")
+		}
+		return nil
+	}
+
+	for rs.Step < len(rule.Escalation) {
+		step := rule.Escalation[rs.Step]
+		if rs.FiringSince.Add(step.After * time.Millisecond).After(now) {
+			break
+		}
+		stepLogger := logger.With(common.Fields{"step": rs.Step + 1})
+		stepLogger.Info("Escalating...")
+		var (
+			executed actionsResult
+			err      error
+		)
+		state.unlocked(func() {
+			executed, err = executeActions(step.Actions, server, rule, opts, stepLogger, outcome)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to execute the escalation step %d", rs.Step+1)
+		}
+		if executed.status() == "failed" {
+			stepLogger.Warn("Escalating... Fail")
+			break
+		}
+		rs.Step++
+		outcome.Escalation = rs.Step
+	}
+
+	return nil
+}
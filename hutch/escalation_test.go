@@ -0,0 +1,120 @@
+package hutch
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// withPager registers the `page` built-in action, which records the
+// description of the actions it executes, or fails while *fail is set.
+func withPager(t *testing.T, fail *bool) *[]string {
+	t.Helper()
+	var paged []string
+	withBuiltin(t, "page", func(action common.Action, ctx actionContext, logger *common.Logger) error {
+		if *fail {
+			return errors.New("the pager is unavailable")
+		}
+		paged = append(paged, action.Description)
+		return nil
+	})
+	return &paged
+}
+
+// escalationRule returns a firing rule escalating to the steps executed
+// after each of after, in milliseconds.
+func escalationRule(after ...time.Duration) common.Rule {
+	rule := firingRule()
+	for i, a := range after {
+		rule.Escalation = append(rule.Escalation, common.EscalationStep{
+			After:   a,
+			Actions: []common.Action{{Description: "step " + strconv.Itoa(i+1), Builtin: "page"}},
+		})
+	}
+	return rule
+}
+
+func TestEscalate(t *testing.T) {
+	var fail bool
+	paged := withPager(t, &fail)
+	rule := escalationRule(0, 60000, 120000)
+	start := time.Now()
+	state := NewState()
+	rs := &ruleState{FiringSince: start}
+
+	steps := []struct {
+		name  string
+		at    time.Duration
+		fail  bool
+		step  int
+		paged []string
+	}{
+		{name: "first step", step: 1, paged: []string{"step 1"}},
+		{name: "second step not due", at: 30 * time.Second, step: 1, paged: []string{"step 1"}},
+		{name: "failed second step", at: 90 * time.Second, fail: true, step: 1, paged: []string{"step 1"}},
+		{name: "second step again", at: 100 * time.Second, step: 2, paged: []string{"step 1", "step 2"}},
+		{name: "third step", at: 150 * time.Second, step: 3, paged: []string{"step 1", "step 2", "step 3"}},
+		{name: "no more steps", at: time.Hour, step: 3, paged: []string{"step 1", "step 2", "step 3"}},
+	}
+	for _, step := range steps {
+		fail = step.fail
+		outcome := Outcome{}
+		state.mu.Lock()
+		err := escalate(common.Server{}, rule, state, rs, start.Add(step.at), firingOptions(), common.Log, &outcome)
+		state.mu.Unlock()
+		if err != nil {
+			t.Fatalf("%s: escalate() error = %v", step.name, err)
+		}
+		if rs.Step != step.step || !reflect.DeepEqual(*paged, step.paged) {
+			t.Errorf("%s: escalate() = step %d, paged %q, want %d, %q", step.name, rs.Step, *paged, step.step, step.paged)
+		}
+	}
+}
+
+// An acknowledgement stops the escalation until the rule resolves, which
+// starts it over.
+func TestEscalationAcknowledgedAndResolved(t *testing.T) {
+	var fail bool
+	paged := withPager(t, &fail)
+	rule := escalationRule(0, 0)
+	rule.Escalation[1].After = 60000
+	state := NewState()
+	process := func(firing bool) {
+		t.Helper()
+		rule.Evaluator = "function evaluate(body) { return " + strconv.FormatBool(firing) + "; }"
+		outcome := Outcome{}
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		if err := processRule(common.Server{}, rule, state, firingOptions(), common.Log, &outcome); err != nil {
+			t.Fatalf("processRule() error = %v", err)
+		}
+	}
+
+	process(true)
+	if _, err := state.acknowledge(rule.ID, "alice"); err != nil {
+		t.Fatalf("acknowledge() error = %v", err)
+	}
+	// The second step is due, but the rule is acknowledged.
+	state.rule(rule.ID).FiringSince = time.Now().Add(-time.Hour)
+	process(true)
+	if rs := *state.rule(rule.ID); rs.Step != 1 || !reflect.DeepEqual(*paged, []string{"step 1"}) {
+		t.Errorf("acknowledged: step %d, paged %q, want the escalation stopped at the first step", rs.Step, *paged)
+	}
+
+	process(false)
+	if rs := *state.rule(rule.ID); rs.Step != 0 || rs.AcknowledgedBy != "" || !rs.FiringSince.IsZero() {
+		t.Errorf("resolved: rule state = %+v, want the escalation reset", rs)
+	}
+	if _, err := state.acknowledge(rule.ID, "alice"); err == nil {
+		t.Error("acknowledge() error = nil, want the resolved rule to be refused")
+	}
+
+	process(true)
+	if rs := *state.rule(rule.ID); rs.Step != 1 || !reflect.DeepEqual(*paged, []string{"step 1", "step 1"}) {
+		t.Errorf("firing again: step %d, paged %q, want the first step again", rs.Step, *paged)
+	}
+}
@@ -0,0 +1,351 @@
+package hutch
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+const (
+	eventExchange = "amq.rabbitmq.event"
+
+	minEventBackoff = time.Second
+	maxEventBackoff = time.Minute
+)
+
+// event is a message of the event exchange of a server, its Type being the
+// routing key, e.g. `queue.deleted`, and its Properties the headers.
+type event struct {
+	Type       string                 `json:"type"`
+	Time       time.Time              `json:"time"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// eventSource consumes the event exchange of the servers that have rules
+// with a trigger, and processes these rules when their events arrive.
+type eventSource struct {
+	state *State
+	mu    sync.Mutex
+	// subscriptions are the running subscriptions by server description.
+	subscriptions map[string]*subscription
+}
+
+// subscription consumes the events of a server bound with its keys, the
+// server being updated by each scout so that its latest rules are processed.
+type subscription struct {
+	mu     sync.Mutex
+	server common.Server
+	uri    amqp.URI
+	keys   []string
+	done   chan struct{}
+}
+
+func newEventSource(state *State) *eventSource {
+	return &eventSource{
+		state:         state,
+		subscriptions: make(map[string]*subscription),
+	}
+}
+
+// sync subscribes to the events triggering the rules of servers, and stops
+// the subscriptions no longer needed.
+func (e *eventSource) sync(servers []common.Server) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	seen := make(map[string]bool, len(servers))
+	for _, server := range servers {
+		keys := triggers(server)
+		if len(keys) == 0 {
+			continue
+		}
+		seen[server.Description] = true
+		uri := amqpURI(server, server.Events.Port, server.Events.Vhost)
+		s, ok := e.subscriptions[server.Description]
+		if ok && equalKeys(s.keys, keys) && s.uri == uri {
+			s.mu.Lock()
+			s.server = server
+			s.mu.Unlock()
+			continue
+		}
+		if ok {
+			close(s.done)
+		}
+		s = &subscription{server: server, uri: uri, keys: keys, done: make(chan struct{})}
+		e.subscriptions[server.Description] = s
+		go e.consume(s)
+	}
+	for description, s := range e.subscriptions {
+		if !seen[description] {
+			close(s.done)
+			delete(e.subscriptions, description)
+		}
+	}
+}
+
+// stop stops every subscription.
+func (e *eventSource) stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for description, s := range e.subscriptions {
+		close(s.done)
+		delete(e.subscriptions, description)
+	}
+}
+
+// triggers returns the sorted event types of the triggers of the rules of
+// server.
+func triggers(server common.Server) []string {
+	unique := make(map[string]bool)
+	for _, rule := range server.Rules {
+		for _, trigger := range rule.Trigger {
+			unique[trigger] = true
+		}
+	}
+	keys := make([]string, 0, len(unique))
+	for key := range unique {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// consume consumes the events of s until it is stopped, connecting again
+// with an exponential backoff whenever the connection fails.
+func (e *eventSource) consume(s *subscription) {
+	s.mu.Lock()
+	logger := common.Log.With(common.Fields{"server": s.server.Description})
+	s.mu.Unlock()
+	backoff := minEventBackoff
+	for {
+		start := time.Now()
+		err := e.subscribe(s, logger)
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		// A subscription that lasted is not failing repeatedly.
+		if time.Since(start) > maxEventBackoff {
+			backoff = minEventBackoff
+		}
+		logger.WithError(err).With(common.Fields{"retry_in": backoff}).Error("Consuming the events... Fail")
+		select {
+		case <-s.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxEventBackoff {
+			backoff = maxEventBackoff
+		}
+	}
+}
+
+// subscribe binds a temporary queue to the event exchange of the server of s
+// and processes its events until the connection closes or s is stopped.
+func (e *eventSource) subscribe(s *subscription, logger *common.Logger) error {
+	conn, err := amqp.Dial(s.uri.String())
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to %s:%d", s.uri.Host, s.uri.Port)
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return errors.Wrap(err, "failed to open a channel")
+	}
+	queue, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to declare the events queue")
+	}
+	for _, key := range s.keys {
+		if err := ch.QueueBind(queue.Name, key, eventExchange, false, nil); err != nil {
+			return errors.Wrapf(err, "failed to bind the events queue to %s with %s", eventExchange, key)
+		}
+	}
+	deliveries, err := ch.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to consume the events queue")
+	}
+	logger.With(common.Fields{"events": s.keys}).Info("Consuming the events...")
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	for {
+		select {
+		case <-s.done:
+			return nil
+		case err := <-closed:
+			if err == nil {
+				return errors.New("the connection was closed")
+			}
+			return errors.Wrap(err, "the connection was closed")
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return errors.New("the events queue is no longer consumed")
+			}
+			s.mu.Lock()
+			server := s.server
+			s.mu.Unlock()
+			e.process(server, event{
+				Type:       delivery.RoutingKey,
+				Time:       delivery.Timestamp,
+				Properties: plainTable(delivery.Headers),
+			})
+		}
+	}
+}
+
+// process processes the rules of server triggered by ev like the scouts do,
+// sharing their state and the delay of the actions.
+func (e *eventSource) process(server common.Server, ev event) {
+	logger := common.Log.With(common.Fields{"event": ev.Type, "event_id": newID()})
+	configMu.Lock()
+	opts, err := getScoutOptions(e.state)
+	configMu.Unlock()
+	if err != nil {
+		logger.WithError(err).Error("Failed to process the event")
+		return
+	}
+	opts.event = &ev
+
+	e.state.mu.Lock()
+	defer e.state.mu.Unlock()
+	for _, rule := range server.Rules {
+		if !triggered(rule, ev.Type) {
+			continue
+		}
+		outcome := Outcome{Server: server.Description, Rule: rule.ID}
+		ruleLogger := logger.With(common.Fields{
+			"server": server.Description,
+			"rule":   rule.ID,
+		})
+		ruleLogger.Debug("Processing...")
+		start := time.Now()
+		err := processRule(server, rule, e.state, opts, ruleLogger, &outcome)
+		// An event is not followed up, the rule stops firing once it is
+		// processed and fires again with the next event.
+		e.state.rule(rule.ID).resolve()
+		if err != nil {
+			err = errors.Wrapf(err, "failed to process rule %s", rule.Description)
+			ruleLogger.WithError(err).With(common.Fields{"duration": time.Since(start)}).Error("Processing... Fail")
+			continue
+		}
+		ruleLogger.With(common.Fields{"duration": time.Since(start)}).Info("Processing... OK")
+	}
+	if opts.dryRun {
+		return
+	}
+	if err := e.state.save(); err != nil {
+		logger.WithError(err).Error("Failed to persist the state")
+	}
+}
+
+// triggered reports whether the trigger of rule matches the event type, the
+// trigger being a topic pattern where `*` matches a word and `#` any number
+// of words.
+func triggered(rule common.Rule, eventType string) bool {
+	for _, trigger := range rule.Trigger {
+		if matchTopic(strings.Split(trigger, "."), strings.Split(eventType, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchTopic(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchTopic(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchTopic(pattern[1:], words[1:])
+	}
+	return len(words) > 0 && pattern[0] == words[0] && matchTopic(pattern[1:], words[1:])
+}
+
+// plainTable converts the values of an AMQP table to the ones JSON decodes
+// to, so that the evaluators and action templates can use them.
+func plainTable(table amqp.Table) map[string]interface{} {
+	plain := make(map[string]interface{}, len(table))
+	for name, value := range table {
+		plain[name] = plainValue(value)
+	}
+	return plain
+}
+
+func plainValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case amqp.Table:
+		return plainTable(v)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, e := range v {
+			values[i] = plainValue(e)
+		}
+		return values
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	case amqp.Decimal:
+		f := float64(v.Value)
+		for i := uint8(0); i < v.Scale; i++ {
+			f /= 10
+		}
+		return f
+	case int8:
+		return float64(v)
+	case int16:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint8:
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+	return value
+}
+
+// eventRule evaluates the rule triggered by ev, passing the event to its
+// evaluator when it has one.
+func eventRule(rule common.Rule, ev event, state *State, logger *common.Logger, outcome *Outcome, now time.Time) (bool, error) {
+	outcome.Event = &ev
+	if rule.Evaluator == "" {
+		return true, nil
+	}
+	logger.Debug("Evaluating rule...")
+	result, err := evaluateRule(rule.Evaluator, plainJSON(ev), response{}, state.history, rule.ID, now)
+	if err != nil {
+		return false, errors.Wrapc(err, map[string]interface{}{
+			"evaluator": rule.Evaluator,
+		}, "failed to evaluate rule")
+	}
+	return result, nil
+}
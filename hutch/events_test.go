@@ -0,0 +1,131 @@
+package hutch
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tradeforce/lophutch/common"
+)
+
+// eventsConfig returns the configuration of ordersConfig with a rule
+// triggered by the deleted queues, and grouped notifications.
+func eventsConfig(t *testing.T, addr string) string {
+	t.Helper()
+	return ordersConfig(t, addr) + `
+  - id: queue-deleted
+    trigger: [queue.deleted]
+    actions:
+    - description: notify
+      cmd: notify-ops
+notifications:
+  group_by: [rule]
+  actions:
+  - description: notify the group
+    cmd: notify-group
+`
+}
+
+// eventServer returns the configured server with its triggered rules.
+func eventServer(t *testing.T, state *State) common.Server {
+	t.Helper()
+	servers, err := getServers(state.discoverer)
+	if err != nil {
+		t.Fatalf("getServers() error = %v", err)
+	}
+	return servers[0]
+}
+
+// Run with -race: the events are processed while the scouts flush the
+// notifications.
+func TestProcessEventsDuringScouts(t *testing.T) {
+	api := ordersAPI(t)
+	defer api.Close()
+	configure(t, eventsConfig(t, api.URL))
+	viper.Set("dry-run", true)
+	viper.Set("run-once", true)
+
+	state := NewState()
+	server := eventServer(t, state)
+	events := newEventSource(state)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			if err := Scout(state); err != nil {
+				t.Errorf("Scout() error = %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			events.process(server, event{Type: "queue.deleted", Time: time.Now()})
+		}
+	}()
+	wg.Wait()
+}
+
+func TestProcessEventResolvesTheRule(t *testing.T) {
+	api := ordersAPI(t)
+	defer api.Close()
+	configure(t, eventsConfig(t, api.URL))
+	viper.Set("dry-run", true)
+
+	state := NewState()
+	server := eventServer(t, state)
+	events := newEventSource(state)
+	var id string
+	for _, rule := range server.Rules {
+		if len(rule.Trigger) > 0 {
+			id = rule.ID
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		events.process(server, event{Type: "queue.deleted", Time: time.Now()})
+		state.mu.Lock()
+		rs := *state.rule(id)
+		groups := len(state.notifier.due(0, time.Now(), true))
+		state.mu.Unlock()
+		if !rs.FiringSince.IsZero() || rs.Step != 0 {
+			t.Errorf("event %d: rule state = %+v, want the rule resolved", i+1, rs)
+		}
+		// Each event fires the rule again.
+		if groups != 1 {
+			t.Errorf("event %d: %d notification groups, want the rule to fire", i+1, groups)
+		}
+	}
+}
+
+func TestTriggeredRulesCanNotEscalate(t *testing.T) {
+	u, err := url.Parse("http://127.0.0.1:15672")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configure(t, fmt.Sprintf(`
+servers:
+- description: main server
+  host: %s
+  port: %s
+  rules:
+  - id: queue-deleted
+    trigger: [queue.deleted]
+    escalation:
+    - after: 60000
+      actions:
+      - description: page
+        cmd: page-ops
+`, u.Hostname(), u.Port()))
+	_, err = getServers(NewState().discoverer)
+	if err == nil || !strings.Contains(err.Error(), "rule queue-deleted of server main server can not escalate") {
+		t.Errorf("getServers() error = %v, want the escalation to be refused", err)
+	}
+}
@@ -0,0 +1,293 @@
+package hutch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+const expectedFile = "expected.json"
+
+// fixture is a recorded response of the Management API.
+type fixture struct {
+	Server  string            `json:"server"`
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// fixturePath returns the path of the file holding the response to request
+// for server, fixtures are keyed by the server description, the HTTP method,
+// the request path with its columns and its port when it is not the one of
+// the server.
+func fixturePath(dir string, server common.Server, request common.Request) string {
+	path := requestPath(request)
+	if request.Port != 0 {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += sep + "port=" + strconv.Itoa(request.Port)
+	}
+	name := fmt.Sprintf("%s_%s.json", strings.ToUpper(request.Method), url.PathEscape(path))
+	return filepath.Join(dir, url.PathEscape(server.Description), name)
+}
+
+// recorder performs the requests against the servers and keeps their
+// responses so that they can be saved as fixtures.
+type recorder struct {
+	dir      string
+	fixtures map[string]fixture
+}
+
+func newRecorder(dir string) *recorder {
+	return &recorder{
+		dir:      dir,
+		fixtures: make(map[string]fixture),
+	}
+}
+
+func (r *recorder) request(server common.Server, request common.Request) (response, error) {
+	resp, err := performRequest(server, request)
+	r.record(server, request, resp, err)
+	return resp, err
+}
+
+// probe performs the probe and keeps its result like the response to a
+// request whose method is `AMQP`.
+func (r *recorder) probe(server common.Server, probe common.Probe) (string, error) {
+	body, err := performProbe(server, probe)
+	r.record(server, probeRequest(probe), response{Body: body}, err)
+	return body, err
+}
+
+func (r *recorder) record(server common.Server, request common.Request, resp response, err error) {
+	fx := fixture{
+		Server:  server.Description,
+		Method:  request.Method,
+		Path:    request.Path,
+		Status:  resp.Status,
+		Headers: resp.Headers,
+		Body:    resp.Body,
+	}
+	if resp.Value != nil {
+		b, err := json.Marshal(resp.Value)
+		if err != nil {
+			fx.Error = err.Error()
+		}
+		fx.Body = string(b)
+	}
+	if err != nil {
+		fx.Error = err.Error()
+	}
+	r.fixtures[fixturePath(r.dir, server, request)] = fx
+}
+
+// save writes the recorded responses and outcomes into the fixtures
+// directory, the outcomes become the expected outcomes of the `test`
+// command.
+func (r *recorder) save(outcomes []Outcome) error {
+	for p, fx := range r.fixtures {
+		if err := writeJSON(p, fx); err != nil {
+			return errors.Wrapf(err, "failed to write the fixture %s", p)
+		}
+	}
+	p := filepath.Join(r.dir, expectedFile)
+	if err := writeJSON(p, outcomes); err != nil {
+		return errors.Wrapf(err, "failed to write the expected outcomes %s", p)
+	}
+	return nil
+}
+
+func writeJSON(p string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Wrap(err, "failed to create the directory")
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the content")
+	}
+	if err := ioutil.WriteFile(p, append(b, '\n'), 0644); err != nil {
+		return errors.Wrap(err, "failed to write the file")
+	}
+	return nil
+}
+
+func readJSON(p string, v interface{}) error {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return errors.Wrap(err, "failed to read the file")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.Wrap(err, "failed to decode the content")
+	}
+	return nil
+}
+
+// replay returns a requestFunc that answers the requests with the fixtures
+// stored in dir instead of reaching the servers.
+func replay(dir string) requestFunc {
+	return func(server common.Server, request common.Request) (response, error) {
+		p := fixturePath(dir, server, request)
+		var fx fixture
+		if err := readJSON(p, &fx); err != nil {
+			return response{}, errors.Wrapcf(err, map[string]interface{}{
+				"fixture": p,
+			}, "no fixture for the %s request to %s", request.Method, request.Path)
+		}
+		if fx.Error != "" {
+			return response{}, errors.New(fx.Error)
+		}
+		// Fixtures recorded before the status was kept are successful
+		// responses.
+		if fx.Status == 0 {
+			fx.Status = http.StatusOK
+		}
+		return response{Status: fx.Status, Headers: fx.Headers, Body: fx.Body}, nil
+	}
+}
+
+// replayProbe returns a probeFunc that answers the probes with the fixtures
+// stored in dir.
+func replayProbe(dir string) probeFunc {
+	request := replay(dir)
+	return func(server common.Server, probe common.Probe) (string, error) {
+		resp, err := request(server, probeRequest(probe))
+		return resp.Body, err
+	}
+}
+
+// Test processes the configured rules against the fixtures in dir, without
+// executing any action, and compares the outcomes with the expected ones.
+// A report is written to w and the returned bool is true when every rule
+// matched its expected outcome.
+func Test(w io.Writer, dir string) (bool, error) {
+	state := NewState()
+	servers, err := getServers(state.discoverer)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to retrieve the configured servers")
+	}
+
+	var expected []Outcome
+	if err := readJSON(filepath.Join(dir, expectedFile), &expected); err != nil {
+		return false, errors.Wrap(err, "failed to read the expected outcomes")
+	}
+	expectations := make(map[string]Outcome)
+	for _, outcome := range expected {
+		expectations[outcome.Server+"/"+outcome.Rule] = outcome
+	}
+
+	opts := scoutOptions{
+		dryRun:  true,
+		request: replay(dir),
+		probe:   replayProbe(dir),
+	}
+	state.mu.Lock()
+	outcomes := scout(servers, state, opts)
+	state.mu.Unlock()
+
+	passed, failed, skipped := 0, 0, 0
+	for _, outcome := range outcomes {
+		key := outcome.Server + "/" + outcome.Rule
+		exp, ok := expectations[key]
+		if !ok {
+			skipped++
+			fmt.Fprintf(w, "SKIP %s: no expected outcome\n", key)
+			continue
+		}
+		delete(expectations, key)
+		diff, err := diffOutcomes(exp, outcome)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to compare the outcomes of %s", key)
+		}
+		if diff == "" {
+			passed++
+			fmt.Fprintf(w, "PASS %s\n", key)
+			continue
+		}
+		failed++
+		fmt.Fprintf(w, "FAIL %s\n%s", key, diff)
+	}
+	for key := range expectations {
+		failed++
+		fmt.Fprintf(w, "FAIL %s: expected outcome for a rule that is not configured\n", key)
+	}
+
+	fmt.Fprintf(w, "%d passed, %d failed, %d skipped\n", passed, failed, skipped)
+
+	return failed == 0, nil
+}
+
+// diffOutcomes returns a line based diff between the JSON representations of
+// the expected and actual outcomes, or an empty string if they are equal.
+func diffOutcomes(expected, actual Outcome) (string, error) {
+	a, err := json.MarshalIndent(expected, "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode the expected outcome")
+	}
+	b, err := json.MarshalIndent(actual, "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode the actual outcome")
+	}
+	if string(a) == string(b) {
+		return "", nil
+	}
+	return diffLines(strings.Split(string(a), "\n"), strings.Split(string(b), "\n")), nil
+}
+
+// diffLines returns the lines of a and b prefixed by "-", "+" or " " based
+// on their longest common subsequence.
+func diffLines(a, b []string) string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var sb strings.Builder
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			fmt.Fprintf(&sb, "    %s\n", a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			fmt.Fprintf(&sb, "  - %s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(&sb, "  + %s\n", b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		fmt.Fprintf(&sb, "  - %s\n", a[i])
+	}
+	for ; j < len(b); j++ {
+		fmt.Fprintf(&sb, "  + %s\n", b[j])
+	}
+	return sb.String()
+}
@@ -0,0 +1,223 @@
+package hutch
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/tradeforce/lophutch/common"
+)
+
+// ordersConfig returns a configuration whose rule fires when the orders queue
+// of the Management API at addr has messages.
+func ordersConfig(t *testing.T, addr string) string {
+	t.Helper()
+	u, err := url.Parse(addr)
+	if err != nil {
+		t.Fatalf("invalid address %s: %v", addr, err)
+	}
+	return fmt.Sprintf(`
+servers:
+- description: main server
+  protocol: http
+  host: %s
+  port: %s
+  user: guest
+  password: guest
+  rules:
+  - id: orders-backlog
+    request:
+      method: GET
+      path: /api/queues/%%2F/orders
+    evaluator: |
+      function evaluate(queue) {
+        return queue.messages > 0;
+      }
+    actions:
+    - description: notify
+      cmd: notify-ops
+      args: ["{{.Rule.ID}} fired"]
+      templated: true
+`, u.Hostname(), u.Port())
+}
+
+func ordersAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.EscapedPath() != "/api/queues/%2F/orders" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name": "orders", "vhost": "/", "messages": 5}`)
+	}))
+}
+
+func TestRecordThenTest(t *testing.T) {
+	api := ordersAPI(t)
+	configure(t, ordersConfig(t, api.URL))
+	dir := t.TempDir()
+	viper.Set("fixtures-dir", dir)
+	viper.Set("record", true)
+	viper.Set("dry-run", true)
+	viper.Set("run-once", true)
+
+	if err := Scout(NewState()); err != nil {
+		t.Fatalf("Scout() error = %v", err)
+	}
+	// The test replays the fixtures without reaching the server.
+	api.Close()
+
+	var expected []Outcome
+	if err := readJSON(filepath.Join(dir, expectedFile), &expected); err != nil {
+		t.Fatalf("failed to read the expected outcomes: %v", err)
+	}
+	if len(expected) != 1 || !expected[0].Result || len(expected[0].Actions) != 1 {
+		t.Fatalf("recorded outcomes = %+v, want the rule firing with its action", expected)
+	}
+
+	var report bytes.Buffer
+	ok, err := Test(&report, dir)
+	if err != nil {
+		t.Fatalf("Test() error = %v", err)
+	}
+	if !ok {
+		t.Errorf("Test() failed on its own recording:\n%s", report.String())
+	}
+	if !strings.Contains(report.String(), "PASS main server/orders-backlog") {
+		t.Errorf("Test() report = %q, want the rule to pass", report.String())
+	}
+}
+
+// A recording without `--dry-run` does not execute the actions either.
+func TestRecordSkipsActions(t *testing.T) {
+	executed := 0
+	withBuiltin(t, "count", func(action common.Action, ctx actionContext, logger *common.Logger) error {
+		executed++
+		return nil
+	})
+	api := ordersAPI(t)
+	defer api.Close()
+	configure(t, strings.Replace(ordersConfig(t, api.URL), "cmd: notify-ops", "builtin: count", 1))
+	dir := t.TempDir()
+	viper.Set("fixtures-dir", dir)
+	viper.Set("record", true)
+	viper.Set("run-once", true)
+
+	if err := Scout(NewState()); err != nil {
+		t.Fatalf("Scout() error = %v", err)
+	}
+	if executed != 0 {
+		t.Errorf("the action was executed %d times while recording", executed)
+	}
+	var expected []Outcome
+	if err := readJSON(filepath.Join(dir, expectedFile), &expected); err != nil {
+		t.Fatalf("failed to read the expected outcomes: %v", err)
+	}
+	if len(expected) != 1 || !expected[0].Result || len(expected[0].Actions) != 1 {
+		t.Errorf("recorded outcomes = %+v, want the rule firing with its action", expected)
+	}
+}
+
+func TestRecordRequiresRunOnce(t *testing.T) {
+	api := ordersAPI(t)
+	defer api.Close()
+	configure(t, ordersConfig(t, api.URL))
+	dir := t.TempDir()
+	viper.Set("fixtures-dir", dir)
+	viper.Set("record", true)
+
+	if err := Scout(NewState()); err == nil {
+		t.Fatal("Scout() error = nil, want `--record` to require `--run-once`")
+	}
+	if _, err := os.Stat(filepath.Join(dir, expectedFile)); !os.IsNotExist(err) {
+		t.Errorf("the expected outcomes were recorded by a scheduled scout: %v", err)
+	}
+}
+
+// nodesAPI serves the nodes recorded in the fixtures of the management
+// package, the first one using 95% of its memory limit.
+func nodesAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/nodes" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		http.ServeFile(w, r, filepath.Join("..", "management", "testdata", "nodes.json"))
+	}))
+}
+
+func TestRecordThenTestPack(t *testing.T) {
+	tests := []struct {
+		name   string
+		dryRun bool
+	}{
+		{name: "dry run", dryRun: true},
+		// The actions are not executed, as with `--dry-run`.
+		{name: "live"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api := nodesAPI(t)
+			defer api.Close()
+			u, err := url.Parse(api.URL)
+			if err != nil {
+				t.Fatalf("invalid address %s: %v", api.URL, err)
+			}
+			configure(t, fmt.Sprintf(`
+servers:
+- description: main server
+  protocol: http
+  host: %s
+  port: %s
+  packs:
+  - name: nodes
+    rules: [memory-alarm]
+    rule:
+      actions:
+      - description: notify
+        cmd: notify-ops
+        args: ["{{range .Findings}}{{.}}{{end}}"]
+        templated: true
+`, u.Hostname(), u.Port()))
+			dir := t.TempDir()
+			viper.Set("fixtures-dir", dir)
+			viper.Set("record", true)
+			viper.Set("dry-run", test.dryRun)
+			viper.Set("run-once", true)
+
+			if err := Scout(NewState()); err != nil {
+				t.Fatalf("Scout() error = %v", err)
+			}
+			api.Close()
+
+			var expected []Outcome
+			if err := readJSON(filepath.Join(dir, expectedFile), &expected); err != nil {
+				t.Fatalf("failed to read the expected outcomes: %v", err)
+			}
+			want := []string{"node rabbit@rabbit-1 uses 95% of its memory limit"}
+			if len(expected) != 1 || !expected[0].Result || !reflect.DeepEqual(expected[0].Findings, want) {
+				t.Fatalf("recorded outcomes = %+v, want the rule firing with the findings %v", expected, want)
+			}
+
+			var report bytes.Buffer
+			ok, err := Test(&report, dir)
+			if err != nil {
+				t.Fatalf("Test() error = %v", err)
+			}
+			if !ok || !strings.Contains(report.String(), "PASS main server/nodes/memory-alarm@main server") {
+				t.Errorf("Test() failed on its own recording:\n%s", report.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package hutch
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zignd/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	formatJSON       = "json"
+	formatPrometheus = "prometheus"
+	formatText       = "text"
+	formatYAML       = "yaml"
+)
+
+// parseBody parses body according to format into the value handed to the
+// evaluators and sampled by the rules.
+func parseBody(format, body string) (interface{}, error) {
+	switch strings.ToLower(format) {
+	case "", formatJSON:
+		var v interface{}
+		if err := json.Unmarshal([]byte(body), &v); err != nil {
+			return nil, errors.Wrap(err, "failed to parse the JSON body")
+		}
+		return v, nil
+	case formatYAML:
+		var v interface{}
+		if err := yaml.Unmarshal([]byte(body), &v); err != nil {
+			return nil, errors.Wrap(err, "failed to parse the YAML body")
+		}
+		return stringKeys(v), nil
+	case formatText:
+		lines := strings.Split(strings.TrimRight(body, "\n"), "\n")
+		if body == "" {
+			lines = []string{}
+		}
+		return map[string]interface{}{
+			"text":  body,
+			"lines": lines,
+		}, nil
+	case formatPrometheus:
+		families, err := parsePrometheus(body)
+		if err != nil {
+			return nil, err
+		}
+		// The families are handed to the evaluators as plain objects, by the
+		// names of their JSON fields.
+		b, err := json.Marshal(families)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode the Prometheus families")
+		}
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, errors.Wrap(err, "failed to decode the Prometheus families")
+		}
+		return v, nil
+	}
+	return nil, errors.Errorf("unknown format %s, expected json, prometheus, text or yaml", format)
+}
+
+// bodyValue returns the body of resp, parsed according to format and
+// restricted to columns. The body of a response other than 200 that can not
+// be parsed is returned as a string.
+func bodyValue(format string, columns []string, resp response) (interface{}, error) {
+	if resp.Value != nil {
+		return resp.Value, nil
+	}
+	v, err := parseBody(format, resp.Body)
+	if err != nil {
+		if resp.Status != http.StatusOK {
+			return resp.Body, nil
+		}
+		return nil, err
+	}
+	if isJSON(format) {
+		v = project(v, columns)
+	}
+	return v, nil
+}
+
+func isJSON(format string) bool {
+	return format == "" || strings.ToLower(format) == formatJSON
+}
+
+// stringKeys converts the map[interface{}]interface{} values produced by the
+// YAML parser into map[string]interface{} values.
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = stringKeys(val)
+		}
+		return m
+	case map[string]interface{}:
+		for k, val := range v {
+			v[k] = stringKeys(val)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = stringKeys(val)
+		}
+	}
+	return v
+}
+
+// promFamily is a metric family of the Prometheus text format.
+type promFamily struct {
+	Type    string       `json:"type"`
+	Help    string       `json:"help,omitempty"`
+	Metrics []promMetric `json:"metrics"`
+}
+
+// promMetric is a sample of a metric family, Name differs from the name of
+// the family for the `_bucket`, `_sum` and `_count` samples of histograms
+// and summaries. Value is a string for `+Inf`, `-Inf` and `NaN`, which JSON
+// can not represent.
+type promMetric struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Value     interface{}       `json:"value"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+}
+
+// parsePrometheus parses the Prometheus text exposition format into its
+// metric families, by name.
+func parsePrometheus(body string) (map[string]*promFamily, error) {
+	families := make(map[string]*promFamily)
+	family := func(name string) *promFamily {
+		f, ok := families[name]
+		if !ok {
+			f = &promFamily{Type: "untyped", Metrics: []promMetric{}}
+			families[name] = f
+		}
+		return f
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(strings.TrimSpace(line[1:]), " ", 3)
+			if len(fields) < 3 {
+				continue
+			}
+			switch fields[0] {
+			case "HELP":
+				family(fields[1]).Help = helpEscapes.Replace(fields[2])
+			case "TYPE":
+				family(fields[1]).Type = fields[2]
+			}
+			continue
+		}
+
+		metric, err := parsePromSample(line)
+		if err != nil {
+			return nil, errors.Wrapcf(err, map[string]interface{}{
+				"line": n,
+			}, "failed to parse the Prometheus sample at line %d", n)
+		}
+		name := metric.Name
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			base := strings.TrimSuffix(metric.Name, suffix)
+			if f, ok := families[base]; ok && base != metric.Name && (f.Type == "histogram" || f.Type == "summary") {
+				name = base
+				break
+			}
+		}
+		f := family(name)
+		f.Metrics = append(f.Metrics, metric)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read the Prometheus body")
+	}
+	return families, nil
+}
+
+func parsePromSample(line string) (promMetric, error) {
+	metric := promMetric{Name: line, Labels: make(map[string]string)}
+	rest := ""
+	if i := strings.IndexAny(line, "{ \t"); i >= 0 {
+		metric.Name = line[:i]
+		rest = line[i:]
+	}
+	if metric.Name == "" {
+		return metric, errors.New("missing metric name")
+	}
+
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		if rest, err = parsePromLabels(rest[1:], metric.Labels); err != nil {
+			return metric, err
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return metric, errors.Errorf("expected a value and an optional timestamp, got `%s`", rest)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return metric, errors.Wrapf(err, "invalid value %s", fields[0])
+	}
+	metric.Value = value
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		metric.Value = strconv.FormatFloat(value, 'g', -1, 64)
+	}
+	if len(fields) == 2 {
+		if metric.Timestamp, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return metric, errors.Wrapf(err, "invalid timestamp %s", fields[1])
+		}
+	}
+	return metric, nil
+}
+
+// helpEscapes replaces the escape sequences of the HELP lines.
+var helpEscapes = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+
+// parsePromLabels parses the labels of s, following the opening brace, into
+// labels and returns what follows the closing brace. The label values escape
+// the backslashes, double quotes and line feeds.
+func parsePromLabels(s string, labels map[string]string) (string, error) {
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if strings.HasPrefix(s, "}") {
+			return s[1:], nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 || len(s) < eq+2 || s[eq+1] != '"' {
+			return "", errors.Errorf("invalid label in `%s`", s)
+		}
+		name := strings.TrimSpace(s[:eq])
+		if name == "" {
+			return "", errors.Errorf("missing label name in `%s`", s)
+		}
+		var value strings.Builder
+		i := eq + 2
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' {
+				value.WriteByte(s[i])
+				continue
+			}
+			if i++; i >= len(s) {
+				break
+			}
+			switch s[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case '\\', '"':
+				value.WriteByte(s[i])
+			default:
+				return "", errors.Errorf("invalid escape \\%c in the value of label %s", s[i], name)
+			}
+		}
+		if i >= len(s) {
+			return "", errors.Errorf("unterminated value of label %s", name)
+		}
+		labels[name] = value.String()
+		s = s[i+1:]
+	}
+}
@@ -0,0 +1,96 @@
+package hutch
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePrometheus(t *testing.T) {
+	body := `
+# HELP rabbitmq_queue_messages Messages in a queue,\nready or not, in \\ units.
+# TYPE rabbitmq_queue_messages gauge
+rabbitmq_queue_messages{vhost="/",queue="orders"} 5
+rabbitmq_queue_messages{vhost="/", queue="say \"hi\"\\n",} 2 1697700000000
+# A comment that is neither HELP nor TYPE.
+# TYPE rabbitmq_latency_seconds histogram
+rabbitmq_latency_seconds_bucket{le="0.5"} 10
+rabbitmq_latency_seconds_bucket{le="+Inf"} 12
+rabbitmq_latency_seconds_sum 3.5
+rabbitmq_latency_seconds_count 12
+rabbitmq_ratio NaN
+rabbitmq_ceiling +Inf
+rabbitmq_floor -Inf -1000
+`
+	families, err := parsePrometheus(body)
+	if err != nil {
+		t.Fatalf("parsePrometheus() error = %v", err)
+	}
+	want := map[string]*promFamily{
+		"rabbitmq_queue_messages": {
+			Type: "gauge",
+			Help: "Messages in a queue,\nready or not, in \\ units.",
+			Metrics: []promMetric{
+				{Name: "rabbitmq_queue_messages", Labels: map[string]string{"vhost": "/", "queue": "orders"}, Value: 5.0},
+				{Name: "rabbitmq_queue_messages", Labels: map[string]string{"vhost": "/", "queue": "say \"hi\"\\n"}, Value: 2.0, Timestamp: 1697700000000},
+			},
+		},
+		"rabbitmq_latency_seconds": {
+			Type: "histogram",
+			Metrics: []promMetric{
+				{Name: "rabbitmq_latency_seconds_bucket", Labels: map[string]string{"le": "0.5"}, Value: 10.0},
+				{Name: "rabbitmq_latency_seconds_bucket", Labels: map[string]string{"le": "+Inf"}, Value: 12.0},
+				{Name: "rabbitmq_latency_seconds_sum", Labels: map[string]string{}, Value: 3.5},
+				{Name: "rabbitmq_latency_seconds_count", Labels: map[string]string{}, Value: 12.0},
+			},
+		},
+		"rabbitmq_ratio": {
+			Type:    "untyped",
+			Metrics: []promMetric{{Name: "rabbitmq_ratio", Labels: map[string]string{}, Value: "NaN"}},
+		},
+		"rabbitmq_ceiling": {
+			Type:    "untyped",
+			Metrics: []promMetric{{Name: "rabbitmq_ceiling", Labels: map[string]string{}, Value: "+Inf"}},
+		},
+		"rabbitmq_floor": {
+			Type:    "untyped",
+			Metrics: []promMetric{{Name: "rabbitmq_floor", Labels: map[string]string{}, Value: "-Inf", Timestamp: -1000}},
+		},
+	}
+	for name, family := range want {
+		if got := families[name]; !reflect.DeepEqual(got, family) {
+			t.Errorf("parsePrometheus() family %s = %+v, want %+v", name, got, family)
+		}
+	}
+	if len(families) != len(want) {
+		t.Errorf("parsePrometheus() = %d families, want %d", len(families), len(want))
+	}
+}
+
+func TestParsePrometheusMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		err  string
+	}{
+		{name: "missing value", line: `rabbitmq_up`, err: "expected a value"},
+		{name: "missing value after labels", line: `rabbitmq_up{node="a"}`, err: "expected a value"},
+		{name: "invalid value", line: `rabbitmq_up one`, err: "invalid value one"},
+		{name: "invalid timestamp", line: `rabbitmq_up 1 now`, err: "invalid timestamp now"},
+		{name: "too many fields", line: `rabbitmq_up 1 2 3`, err: "expected a value"},
+		{name: "missing name", line: `{node="a"} 1`, err: "missing metric name"},
+		{name: "unquoted label value", line: `rabbitmq_up{node=a} 1`, err: "invalid label"},
+		{name: "missing label name", line: `rabbitmq_up{="a"} 1`, err: "missing label name"},
+		{name: "unterminated label value", line: `rabbitmq_up{node="a} 1`, err: "unterminated value of label node"},
+		{name: "unterminated labels", line: `rabbitmq_up{node="a"`, err: "invalid label"},
+		{name: "invalid escape", line: `rabbitmq_up{node="a\tb"} 1`, err: `invalid escape \t`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parsePrometheus("# TYPE rabbitmq_up gauge\n" + test.line + "\n")
+			if err == nil || !strings.Contains(err.Error(), test.err) || !strings.Contains(err.Error(), "line 2") {
+				t.Errorf("parsePrometheus(%q) error = %v, want %q at line 2", test.line, err, test.err)
+			}
+		})
+	}
+}
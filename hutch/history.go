@@ -0,0 +1,460 @@
+package hutch
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robertkrimen/otto"
+	"github.com/spf13/viper"
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+const (
+	historyFile = "history.json"
+
+	defaultHistorySize      = 1000
+	defaultHistoryRetention = 24 * time.Hour
+	defaultEntityPath       = "name"
+)
+
+// point is a sample of a series.
+type point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// series is a ring buffer of the last samples of an entity.
+type series struct {
+	points []point
+	next   int
+	full   bool
+}
+
+func newSeries(size int) *series {
+	return &series{points: make([]point, size)}
+}
+
+func (s *series) add(p point) {
+	s.points[s.next] = p
+	s.next = (s.next + 1) % len(s.points)
+	if s.next == 0 {
+		s.full = true
+	}
+}
+
+// all returns the samples from the oldest to the newest.
+func (s *series) all() []point {
+	if !s.full {
+		return append([]point(nil), s.points[:s.next]...)
+	}
+	return append(append([]point(nil), s.points[s.next:]...), s.points[:s.next]...)
+}
+
+// since returns the samples that are not before start, from the oldest to
+// the newest.
+func (s *series) since(start time.Time) []point {
+	points := s.all()
+	i := sort.Search(len(points), func(i int) bool {
+		return !points[i].Time.Before(start)
+	})
+	return points[i:]
+}
+
+// resize keeps the last size samples of s in a buffer of size samples.
+func (s *series) resize(size int) *series {
+	if size == len(s.points) {
+		return s
+	}
+	resized := newSeries(size)
+	points := s.all()
+	if len(points) > size {
+		points = points[len(points)-size:]
+	}
+	for _, p := range points {
+		resized.add(p)
+	}
+	return resized
+}
+
+type seriesKey struct {
+	Rule   string `json:"rule"`
+	Sample string `json:"sample"`
+	Entity string `json:"entity,omitempty"`
+}
+
+// persistedSeries is how a series is persisted in the state directory.
+type persistedSeries struct {
+	seriesKey
+	Points []point `json:"points"`
+}
+
+// history keeps the samples of the rules, it is persisted in the state
+// directory along with the State when its configuration requires it.
+type history struct {
+	cfg    common.History
+	series map[seriesKey]*series
+}
+
+func newHistory() *history {
+	return &history{
+		series: make(map[seriesKey]*series),
+	}
+}
+
+func (h *history) size() int {
+	if h.cfg.Size > 0 {
+		return h.cfg.Size
+	}
+	return defaultHistorySize
+}
+
+func (h *history) record(key seriesKey, value float64, now time.Time) {
+	s, ok := h.series[key]
+	if !ok {
+		s = newSeries(h.size())
+	}
+	s = s.resize(h.size())
+	s.add(point{Time: now, Value: value})
+	h.series[key] = s
+}
+
+// window returns the samples of key within window before now, or all of
+// them when window is not positive.
+func (h *history) window(key seriesKey, window time.Duration, now time.Time) []point {
+	s, ok := h.series[key]
+	if !ok {
+		return nil
+	}
+	if window <= 0 {
+		return s.all()
+	}
+	return s.since(now.Add(-window))
+}
+
+// entities returns the entities sampled as sample by rule.
+func (h *history) entities(rule, sample string) []string {
+	var entities []string
+	for key := range h.series {
+		if key.Rule == rule && key.Sample == sample {
+			entities = append(entities, key.Entity)
+		}
+	}
+	sort.Strings(entities)
+	return entities
+}
+
+// prune drops the series without samples within the retention.
+func (h *history) prune(now time.Time) {
+	retention := h.cfg.Retention * time.Millisecond
+	if retention <= 0 {
+		retention = defaultHistoryRetention
+	}
+	for key, s := range h.series {
+		points := s.all()
+		if len(points) == 0 || points[len(points)-1].Time.Before(now.Add(-retention)) {
+			delete(h.series, key)
+		}
+	}
+}
+
+func (h *history) persisted() []persistedSeries {
+	persisted := make([]persistedSeries, 0, len(h.series))
+	for key, s := range h.series {
+		persisted = append(persisted, persistedSeries{seriesKey: key, Points: s.all()})
+	}
+	return persisted
+}
+
+func (h *history) restore(persisted []persistedSeries) {
+	for _, ps := range persisted {
+		s := newSeries(h.size())
+		for _, p := range ps.Points {
+			s.add(p)
+		}
+		h.series[ps.seriesKey] = s
+	}
+}
+
+func getHistory() (common.History, error) {
+	var cfg common.History
+	if err := viper.UnmarshalKey("History", &cfg); err != nil {
+		return cfg, errors.Wrap(err, "failed to unmarshal the `History` setting")
+	}
+	return cfg, nil
+}
+
+// recordSamples records the samples of rule found in body, the decoded
+// response body.
+func recordSamples(rule common.Rule, body interface{}, h *history, now time.Time, logger *common.Logger) {
+	for _, sample := range rule.Samples {
+		items := []interface{}{body}
+		entityPath := ""
+		if list, ok := body.([]interface{}); ok {
+			items = list
+			entityPath = sample.Entity
+			if entityPath == "" {
+				entityPath = defaultEntityPath
+			}
+		}
+		for _, item := range items {
+			entity := ""
+			if entityPath != "" {
+				v, ok := lookupPath(item, entityPath)
+				if !ok {
+					continue
+				}
+				entity = toString(v)
+			}
+			v, ok := lookupPath(item, sample.Path)
+			if !ok {
+				logger.With(common.Fields{
+					"sample": sample.Name,
+					"entity": entity,
+				}).Debug("Sample not found in the response")
+				continue
+			}
+			value, ok := toNumber(v)
+			if !ok {
+				logger.With(common.Fields{
+					"sample": sample.Name,
+					"entity": entity,
+				}).Warn("Sample is not a number")
+				continue
+			}
+			h.record(seriesKey{Rule: rule.ID, Sample: sample.Name, Entity: entity}, value, now)
+		}
+	}
+}
+
+// lookupPath returns the value at the dot separated path of v, whose
+// segments are map keys or array indexes.
+func lookupPath(v interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return v, true
+	}
+	for _, segment := range strings.Split(path, ".") {
+		switch val := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = val[segment]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(val) {
+				return nil, false
+			}
+			v = val[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// apply returns the result of the function of check applied to points,
+// false when there are not enough points.
+func apply(check common.Check, points []point) (float64, bool, error) {
+	switch check.Function {
+	case "derivative":
+		if len(points) < 2 {
+			return 0, false, nil
+		}
+		first, last := points[0], points[len(points)-1]
+		seconds := last.Time.Sub(first.Time).Seconds()
+		if seconds <= 0 {
+			return 0, false, nil
+		}
+		return (last.Value - first.Value) / seconds, true, nil
+	case "average":
+		if len(points) == 0 {
+			return 0, false, nil
+		}
+		sum := 0.0
+		for _, p := range points {
+			sum += p.Value
+		}
+		return sum / float64(len(points)), true, nil
+	case "min", "max":
+		if len(points) == 0 {
+			return 0, false, nil
+		}
+		result := points[0].Value
+		for _, p := range points[1:] {
+			if (check.Function == "min" && p.Value < result) || (check.Function == "max" && p.Value > result) {
+				result = p.Value
+			}
+		}
+		return result, true, nil
+	case "time_to_reach":
+		if len(points) < 2 {
+			return 0, false, nil
+		}
+		return timeToReach(points, check.Target), true, nil
+	case "anomaly":
+		value, ok := anomaly(check, points)
+		return value, ok, nil
+	}
+	return 0, false, errors.Errorf("unknown function %s", check.Function)
+}
+
+// timeToReach returns the seconds until target is reached according to the
+// linear regression of points, +Inf when it is not trending towards target.
+func timeToReach(points []point, target float64) float64 {
+	last := points[len(points)-1].Time
+	var sumX, sumY, sumXY, sumXX float64
+	for _, p := range points {
+		x := p.Time.Sub(last).Seconds()
+		sumX += x
+		sumY += p.Value
+		sumXY += x * p.Value
+		sumXX += x * x
+	}
+	n := float64(len(points))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return math.Inf(1)
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	current := (sumY - slope*sumX) / n
+	remaining := target - current
+	switch {
+	case remaining == 0:
+		return 0
+	case slope == 0 || (remaining > 0) != (slope > 0):
+		return math.Inf(1)
+	}
+	return remaining / slope
+}
+
+// firedCheck is a check that fired for an entity.
+type firedCheck struct {
+	check  common.Check
+	entity string
+	value  float64
+}
+
+func (f firedCheck) String() string {
+	s := f.check.Function + "(" + f.check.Sample
+	if f.entity != "" {
+		s += "[" + f.entity + "]"
+	}
+	return s + ") = " + strconv.FormatFloat(f.value, 'g', 6, 64)
+}
+
+// runChecks returns the checks of rule that fire for any of its entities.
+func runChecks(rule common.Rule, h *history, now time.Time) ([]firedCheck, error) {
+	var fired []firedCheck
+	for _, check := range rule.Checks {
+		for _, entity := range h.entities(rule.ID, check.Sample) {
+			key := seriesKey{Rule: rule.ID, Sample: check.Sample, Entity: entity}
+			value, ok, err := apply(check, h.window(key, check.Window*time.Millisecond, now))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid check of sample %s", check.Sample)
+			}
+			if !ok {
+				continue
+			}
+			if (check.Above != nil && value > *check.Above) || (check.Below != nil && value < *check.Below) ||
+				(check.Function == "anomaly" && check.Above == nil && check.Below == nil && math.Abs(value) > sigmas(check)) {
+				fired = append(fired, firedCheck{check: check, entity: entity, value: value})
+			}
+		}
+	}
+	return fired, nil
+}
+
+// historyObject returns the `history` object available to the evaluators,
+// whose functions take the name of a sample, its entity when sampled from
+// an array, and a window in milliseconds. `record` records a sample from
+// the evaluator itself.
+func historyObject(vm *otto.Otto, h *history, rule string, now time.Time) map[string]interface{} {
+	key := func(call otto.FunctionCall) seriesKey {
+		return seriesKey{Rule: rule, Sample: call.Argument(0).String(), Entity: entityArgument(call.Argument(1))}
+	}
+	window := func(call otto.FunctionCall, i int) time.Duration {
+		ms, _ := call.Argument(i).ToInteger()
+		return time.Duration(ms) * time.Millisecond
+	}
+	value := func(v interface{}) otto.Value {
+		result, err := vm.ToValue(v)
+		if err != nil {
+			return otto.UndefinedValue()
+		}
+		return result
+	}
+	function := func(name string) func(otto.FunctionCall) otto.Value {
+		return func(call otto.FunctionCall) otto.Value {
+			target, _ := call.Argument(3).ToFloat()
+			check := common.Check{Function: name, Target: target}
+			result, ok, _ := apply(check, h.window(key(call), window(call, 2), now))
+			if !ok {
+				return otto.UndefinedValue()
+			}
+			return value(result)
+		}
+	}
+
+	return map[string]interface{}{
+		"record": func(call otto.FunctionCall) otto.Value {
+			v, err := call.Argument(2).ToFloat()
+			if err != nil {
+				return otto.UndefinedValue()
+			}
+			h.record(key(call), v, now)
+			return otto.UndefinedValue()
+		},
+		"samples": func(call otto.FunctionCall) otto.Value {
+			points := h.window(key(call), window(call, 2), now)
+			samples := make([]map[string]interface{}, len(points))
+			for i, p := range points {
+				samples[i] = map[string]interface{}{
+					"time":  p.Time.UnixNano() / int64(time.Millisecond),
+					"value": p.Value,
+				}
+			}
+			return value(samples)
+		},
+		"entities": func(call otto.FunctionCall) otto.Value {
+			return value(h.entities(rule, call.Argument(0).String()))
+		},
+		"derivative":  function("derivative"),
+		"average":     function("average"),
+		"min":         function("min"),
+		"max":         function("max"),
+		"timeToReach": function("time_to_reach"),
+		"anomaly":     function("anomaly"),
+	}
+}
+
+func entityArgument(v otto.Value) string {
+	if v.IsUndefined() || v.IsNull() {
+		return ""
+	}
+	return v.String()
+}
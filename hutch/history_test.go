@@ -0,0 +1,287 @@
+package hutch
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+)
+
+// values returns the values of points.
+func values(points []point) []float64 {
+	v := make([]float64, len(points))
+	for i, p := range points {
+		v[i] = p.Value
+	}
+	return v
+}
+
+func TestSeries(t *testing.T) {
+	start := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		size   int
+		values []float64
+		all    []float64
+		since  []float64
+	}{
+		{name: "empty", size: 3, all: []float64{}, since: []float64{}},
+		{name: "partial", size: 3, values: []float64{1, 2}, all: []float64{1, 2}, since: []float64{2}},
+		{name: "full", size: 3, values: []float64{1, 2, 3}, all: []float64{1, 2, 3}, since: []float64{2, 3}},
+		{name: "wrapped", size: 3, values: []float64{1, 2, 3, 4, 5}, all: []float64{3, 4, 5}, since: []float64{3, 4, 5}},
+		{name: "wrapped twice", size: 2, values: []float64{1, 2, 3, 4, 5}, all: []float64{4, 5}, since: []float64{4, 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSeries(test.size)
+			for _, p := range samples(start, time.Minute, test.values...) {
+				s.add(p)
+			}
+			if all := values(s.all()); !reflect.DeepEqual(all, test.all) {
+				t.Errorf("all() = %v, want %v", all, test.all)
+			}
+			if since := values(s.since(start.Add(time.Minute))); !reflect.DeepEqual(since, test.since) {
+				t.Errorf("since() = %v, want %v", since, test.since)
+			}
+		})
+	}
+}
+
+func TestSeriesResize(t *testing.T) {
+	start := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		size int
+		all  []float64
+	}{
+		{name: "same size", size: 4, all: []float64{3, 4, 5, 6}},
+		{name: "smaller", size: 2, all: []float64{5, 6}},
+		{name: "larger", size: 6, all: []float64{3, 4, 5, 6}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSeries(4)
+			for _, p := range samples(start, time.Minute, 1, 2, 3, 4, 5, 6) {
+				s.add(p)
+			}
+			resized := s.resize(test.size)
+			if all := values(resized.all()); !reflect.DeepEqual(all, test.all) {
+				t.Errorf("resize() = %v, want %v", all, test.all)
+			}
+			// The resized series keeps its size once full.
+			resized.add(point{Time: start.Add(time.Hour), Value: 7})
+			if all := resized.all(); len(all) > test.size || all[len(all)-1].Value != 7 {
+				t.Errorf("resize() then add() = %v, want at most %d samples ending with 7", values(all), test.size)
+			}
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	now := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	h := newHistory()
+	h.cfg = common.History{Size: 3, Retention: 3600000}
+	orders := seriesKey{Rule: "backlog", Sample: "messages", Entity: "orders"}
+	payments := seriesKey{Rule: "backlog", Sample: "messages", Entity: "payments"}
+	for i, v := range []float64{1, 2, 3, 4} {
+		h.record(orders, v, now.Add(time.Duration(i)*time.Minute))
+	}
+	h.record(payments, 10, now.Add(-2*time.Hour))
+
+	if got := values(h.window(orders, 0, now.Add(3*time.Minute))); !reflect.DeepEqual(got, []float64{2, 3, 4}) {
+		t.Errorf("window() = %v, want the last 3 samples", got)
+	}
+	if got := values(h.window(orders, time.Minute, now.Add(3*time.Minute))); !reflect.DeepEqual(got, []float64{3, 4}) {
+		t.Errorf("window() = %v, want the samples of the last minute", got)
+	}
+	if got := h.window(seriesKey{Rule: "other"}, 0, now); got != nil {
+		t.Errorf("window() = %v for an unknown series", got)
+	}
+	if got := h.entities("backlog", "messages"); !reflect.DeepEqual(got, []string{"orders", "payments"}) {
+		t.Errorf("entities() = %v", got)
+	}
+
+	// A smaller size keeps the last samples.
+	h.cfg.Size = 2
+	h.record(orders, 5, now.Add(4*time.Minute))
+	if got := values(h.window(orders, 0, now)); !reflect.DeepEqual(got, []float64{4, 5}) {
+		t.Errorf("window() = %v after resizing, want [4 5]", got)
+	}
+
+	// The series without samples within the retention are dropped.
+	h.prune(now.Add(4 * time.Minute))
+	if got := h.entities("backlog", "messages"); !reflect.DeepEqual(got, []string{"orders"}) {
+		t.Errorf("entities() = %v after pruning, want [orders]", got)
+	}
+
+	restored := newHistory()
+	restored.cfg = h.cfg
+	restored.restore(h.persisted())
+	if !reflect.DeepEqual(restored.window(orders, 0, now), h.window(orders, 0, now)) {
+		t.Errorf("restored samples = %v, want %v", restored.window(orders, 0, now), h.window(orders, 0, now))
+	}
+}
+
+func TestRecordSamples(t *testing.T) {
+	now := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	rule := common.Rule{ID: "queues", Samples: []common.Sample{
+		{Name: "messages", Path: "messages"},
+		{Name: "publish", Path: "message_stats.publish_details.rate", Entity: "vhost"},
+	}}
+	body := []interface{}{
+		map[string]interface{}{"name": "orders", "vhost": "/", "messages": 5.0, "message_stats": map[string]interface{}{
+			"publish_details": map[string]interface{}{"rate": "2.5"},
+		}},
+		// Not a number.
+		map[string]interface{}{"name": "payments", "vhost": "payments", "messages": true},
+		// No entity.
+		map[string]interface{}{"messages": 3.0},
+	}
+	h := newHistory()
+	recordSamples(rule, body, h, now, common.Log)
+
+	want := map[seriesKey][]float64{
+		{Rule: "queues", Sample: "messages", Entity: "orders"}: {5},
+		{Rule: "queues", Sample: "publish", Entity: "/"}:       {2.5},
+	}
+	got := make(map[seriesKey][]float64)
+	for key := range h.series {
+		got[key] = values(h.window(key, 0, now))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("recorded samples = %v, want %v", got, want)
+	}
+
+	// A single value is sampled without entity.
+	h = newHistory()
+	recordSamples(common.Rule{ID: "overview", Samples: []common.Sample{{Name: "ready", Path: "queue_totals.messages_ready"}}},
+		map[string]interface{}{"queue_totals": map[string]interface{}{"messages_ready": 42.0}}, h, now, common.Log)
+	if got := values(h.window(seriesKey{Rule: "overview", Sample: "ready"}, 0, now)); !reflect.DeepEqual(got, []float64{42}) {
+		t.Errorf("recorded samples = %v, want [42]", got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	start := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	points := samples(start, 10*time.Second, 10, 30, 20, 40)
+	tests := []struct {
+		function string
+		points   []point
+		value    float64
+		ok       bool
+	}{
+		{function: "derivative", points: points, value: 1, ok: true},
+		{function: "derivative", points: points[:1]},
+		{function: "derivative", points: []point{points[0], points[0]}},
+		{function: "average", points: points, value: 25, ok: true},
+		{function: "average"},
+		{function: "min", points: points, value: 10, ok: true},
+		{function: "max", points: points, value: 40, ok: true},
+		{function: "max"},
+		{function: "time_to_reach", points: points[:1]},
+	}
+	for _, test := range tests {
+		t.Run(test.function, func(t *testing.T) {
+			value, ok, err := apply(common.Check{Function: test.function}, test.points)
+			if err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+			if ok != test.ok || value != test.value {
+				t.Errorf("apply() = %v, %t, want %v, %t", value, ok, test.value, test.ok)
+			}
+		})
+	}
+	if _, _, err := apply(common.Check{Function: "median"}, points); err == nil {
+		t.Error("apply() error = nil, want the unknown function")
+	}
+}
+
+func TestTimeToReach(t *testing.T) {
+	start := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		points []point
+		target float64
+		want   float64
+	}{
+		{name: "rising", points: samples(start, time.Minute, 0, 60, 120), target: 300, want: 180},
+		{name: "falling", points: samples(start, time.Minute, 120, 60, 0), target: -120, want: 120},
+		{name: "noisy trend", points: samples(start, time.Minute, 5, 55, 115, 185), target: 480, want: 300},
+		{name: "reached", points: samples(start, time.Minute, 0, 60, 120), target: 120, want: 0},
+		{name: "past the target", points: samples(start, time.Minute, 0, 60, 120), target: 60, want: math.Inf(1)},
+		{name: "moving away", points: samples(start, time.Minute, 120, 60, 0), target: 300, want: math.Inf(1)},
+		{name: "flat", points: samples(start, time.Minute, 5, 5, 5), target: 10, want: math.Inf(1)},
+		{name: "same time", points: samples(start, 0, 0, 60), target: 120, want: math.Inf(1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := timeToReach(test.points, test.target)
+			if math.IsInf(test.want, 1) && math.IsInf(got, 1) {
+				return
+			}
+			if math.Abs(got-test.want) > 1e-9 {
+				t.Errorf("timeToReach() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHistoryObject(t *testing.T) {
+	now := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	h := newHistory()
+	for i, v := range []float64{100, 200, 300} {
+		h.record(seriesKey{Rule: "backlog", Sample: "messages", Entity: "orders"}, v, now.Add(time.Duration(i-2)*time.Minute))
+	}
+	tests := []struct {
+		name      string
+		evaluator string
+		want      bool
+	}{
+		{
+			name:      "time to reach",
+			evaluator: `function evaluate(body) { return history.timeToReach("messages", "orders", 600000, 1000) === 420; }`,
+			want:      true,
+		},
+		{
+			name:      "derivative",
+			evaluator: `function evaluate(body) { return history.derivative("messages", "orders", 600000) > 1; }`,
+			want:      true,
+		},
+		{
+			name:      "window",
+			evaluator: `function evaluate(body) { return history.samples("messages", "orders", 60000).length === 2; }`,
+			want:      true,
+		},
+		{
+			name:      "not enough samples",
+			evaluator: `function evaluate(body) { return history.average("messages", "payments", 600000) === undefined; }`,
+			want:      true,
+		},
+		{
+			name:      "entities",
+			evaluator: `function evaluate(body) { return history.entities("messages").join() === "orders"; }`,
+			want:      true,
+		},
+		{
+			name: "record",
+			evaluator: `function evaluate(body) {
+				history.record("ready", null, body.ready);
+				return history.samples("ready", null, 0)[0].value === 7;
+			}`,
+			want: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := evaluateRule(test.evaluator, map[string]interface{}{"ready": 7.0}, response{}, h, "backlog", now)
+			if err != nil {
+				t.Fatalf("evaluateRule() error = %v", err)
+			}
+			if result != test.want {
+				t.Errorf("evaluateRule() = %t, want %t", result, test.want)
+			}
+		})
+	}
+}
@@ -2,26 +2,45 @@ package hutch
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/robertkrimen/otto"
 	"github.com/spf13/viper"
 	"github.com/tradeforce/lophutch/common"
+	"github.com/tradeforce/lophutch/discovery"
 	"github.com/zignd/errors"
 )
 
 func Schedule(done <-chan struct{}) error {
 	ticker := time.NewTicker(viper.GetDuration("delay") * time.Millisecond)
-	delays := make(map[string]time.Time)
+	state, err := LoadState()
+	if err != nil {
+		return errors.Wrap(err, "failed to load the state")
+	}
+	state.events = newEventSource(state)
+	defer state.events.stop()
+	if addr := viper.GetString("listen"); addr != "" {
+		go func() {
+			if err := serveAPI(addr, state); err != nil {
+				common.Log.WithError(err).Error("HTTP API stopped")
+			}
+		}()
+	}
 	for {
 		select {
 		case <-ticker.C:
-			if err := Scout(delays); err != nil {
+			if err := Scout(state); err != nil {
 				return errors.Wrap(err, "a scout failed")
 			}
 		case <-done:
@@ -31,37 +50,253 @@ func Schedule(done <-chan struct{}) error {
 	}
 }
 
-func Scout(delays map[string]time.Time) error {
-	servers, err := getServers()
+// requestFunc performs the request of a rule against a server and returns
+// the response.
+type requestFunc func(server common.Server, request common.Request) (response, error)
+
+// response is a response of the Management API.
+type response struct {
+	Status  int
+	Headers map[string]string
+	Body    string
+	// Value is the JSON body decoded while it was read, Body is then empty.
+	Value interface{}
+}
+
+// scoutOptions changes how the rules are processed during a scout.
+type scoutOptions struct {
+	dryRun        bool
+	request       requestFunc
+	probe         probeFunc
+	notifications common.Notifications
+	silences      []common.Silence
+	remediation   common.Remediation
+	limiter       *limiter
+	// event is the event processed instead of a scout, which processes the
+	// rules triggered by it.
+	event *event
+}
+
+// configMu serializes the reads of the configuration by the scouts, the
+// events and the HTTP API, viper writing its settings while unmarshaling
+// them.
+var configMu sync.Mutex
+
+func Scout(state *State) error {
+	configMu.Lock()
+	// A recording is a single scout, the fixtures being overwritten by each
+	// scout.
+	if viper.GetBool("record") && !viper.GetBool("run-once") {
+		configMu.Unlock()
+		return errors.New("`--record` requires `--run-once`")
+	}
+
+	servers, err := getServers(state.discoverer)
 	if err != nil {
+		configMu.Unlock()
 		return errors.Wrap(err, "failed to retrieve the configured servers")
 	}
+	if len(servers) == 0 {
+		configMu.Unlock()
+		common.Log.Warn("No servers were discovered, skipping the scout")
+		return nil
+	}
+	if state.events != nil {
+		state.events.sync(servers)
+	}
+
+	opts, err := getScoutOptions(state)
+	if err != nil {
+		configMu.Unlock()
+		return err
+	}
+
+	var rec *recorder
+	if viper.GetBool("record") {
+		rec = newRecorder(viper.GetString("fixtures-dir"))
+		opts.request = rec.request
+		opts.probe = rec.probe
+		// The recorded outcomes are compared with the ones of the `test`
+		// command, which never executes the actions, so a recording does
+		// not execute them either, as with `--dry-run`.
+		if !opts.dryRun {
+			common.Log.Info("Recording the fixtures, the actions will not be executed")
+			opts.dryRun = true
+		}
+	}
+	runOnce := viper.GetBool("run-once")
+	configMu.Unlock()
+
+	state.mu.Lock()
+	outcomes := scout(servers, state, opts)
+	state.history.prune(time.Now())
+	if !opts.dryRun {
+		err = state.save()
+	}
+	state.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to persist the state")
+	}
+
+	state.notifier.flush(opts, time.Now(), runOnce)
+
+	if rec != nil {
+		if err := rec.save(outcomes); err != nil {
+			return errors.Wrap(err, "failed to save the recorded fixtures")
+		}
+	}
+
+	if opts.dryRun {
+		if err := printOutcomes(os.Stdout, outcomes); err != nil {
+			return errors.Wrap(err, "failed to print the dry run summary")
+		}
+	}
+
+	return nil
+}
+
+// getScoutOptions returns the options of the rules processed now, and
+// updates the history settings of state.
+func getScoutOptions(state *State) (scoutOptions, error) {
+	notifications, err := getNotifications()
+	if err != nil {
+		return scoutOptions{}, errors.Wrap(err, "failed to retrieve the notifications settings")
+	}
+
+	silences, err := getSilences(state.silences)
+	if err != nil {
+		return scoutOptions{}, errors.Wrap(err, "failed to retrieve the silences")
+	}
+
+	remediation, err := getRemediation()
+	if err != nil {
+		return scoutOptions{}, errors.Wrap(err, "failed to retrieve the remediation settings")
+	}
+
+	history, err := getHistory()
+	if err != nil {
+		return scoutOptions{}, errors.Wrap(err, "failed to retrieve the history settings")
+	}
+	state.mu.Lock()
+	state.history.cfg = history
+	state.mu.Unlock()
+
+	return scoutOptions{
+		dryRun:        viper.GetBool("dry-run"),
+		request:       performRequest,
+		probe:         performProbe,
+		notifications: notifications,
+		silences:      silences,
+		remediation:   remediation,
+		limiter:       state.limiter,
+	}, nil
+}
+
+func scout(servers []common.Server, state *State, opts scoutOptions) []Outcome {
+	logger := common.Log.With(common.Fields{"scout": newID()})
+	var outcomes []Outcome
 	for _, server := range servers {
 		for _, rule := range server.Rules {
-			log.Printf("Server: %s | Rule: %s | Processing...", server.Description, rule.Description)
-			if err := processRule(server, rule, delays); err != nil {
+			// The rules with a trigger are processed by the event source.
+			if len(rule.Trigger) > 0 {
+				continue
+			}
+			outcome := Outcome{Server: server.Description, Rule: rule.ID}
+			fields := common.Fields{
+				"server": server.Description,
+				"rule":   rule.ID,
+			}
+			if labels := ruleLabels(server, rule); len(labels) > 0 {
+				fields["labels"] = labels
+			}
+			ruleLogger := logger.With(fields)
+			ruleLogger.Debug("Processing...")
+			start := time.Now()
+			if err := processRule(server, rule, state, opts, ruleLogger, &outcome); err != nil {
 				err = errors.Wrapcf(err, map[string]interface{}{
 					"server": server.Description,
 					"rule":   rule.Description,
 				}, "failed to process rule %s", rule.Description)
-				log.Printf("Server: %s | Rule: %s | Processing... Fail - %s", server.Description, rule.Description, err.Error())
+				ruleLogger.WithError(err).With(common.Fields{"duration": time.Since(start)}).Error("Processing... Fail")
+				outcome.Error = err.Error()
+				outcomes = append(outcomes, outcome)
 				continue
 			}
-			log.Printf("Server: %s | Rule: %s | Processing... OK", server.Description, rule.Description)
+			ruleLogger.With(common.Fields{"duration": time.Since(start)}).Info("Processing... OK")
+			outcomes = append(outcomes, outcome)
 		}
 	}
+	return outcomes
+}
 
-	return nil
+// newID returns a random identifier, like the ones used to correlate the log
+// entries of a scout.
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
 }
 
-func getServers() ([]common.Server, error) {
+func getServers(discoverer *discovery.Discoverer) ([]common.Server, error) {
 	var servers []common.Server
 	if err := viper.UnmarshalKey("Servers", &servers); err != nil {
 		return nil, errors.Wrap(err, "failed to unmarshal the `Servers` setting")
 	}
 
-	if len(servers) == 0 {
-		return nil, errors.New("`Servers` setting has no servers")
+	var cfg common.Discovery
+	if err := viper.UnmarshalKey("Discovery", &cfg); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal the `Discovery` setting")
+	}
+	// A provider failing, e.g. while the DNS is unavailable, does not stop
+	// the scouts of the other servers.
+	discovered, err := discoverer.Servers(cfg)
+	if err != nil {
+		common.Log.WithError(err).Warn("Failed to discover the servers")
+	}
+	descriptions := make(map[string]bool, len(servers)+len(discovered))
+	for _, server := range servers {
+		descriptions[server.Description] = true
+	}
+	for _, server := range discovered {
+		if descriptions[server.Description] {
+			continue
+		}
+		descriptions[server.Description] = true
+		servers = append(servers, server)
+	}
+
+	if len(servers) == 0 && len(cfg.Providers) == 0 {
+		return nil, errors.New("`Servers` setting has no servers and no discovery providers")
+	}
+
+	t, err := getTemplates()
+	if err != nil {
+		return nil, err
+	}
+	for i, server := range servers {
+		for j, rule := range server.Rules {
+			if servers[i].Rules[j], err = t.expandRule(rule); err != nil {
+				return nil, errors.Wrapf(err, "invalid rule of server %s", server.Description)
+			}
+		}
+		rules, err := packRules(server, t)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rule pack of server %s", server.Description)
+		}
+		servers[i].Rules = append(servers[i].Rules, rules...)
+	}
+	if err := attachRules(servers, t); err != nil {
+		return nil, err
+	}
+
+	for _, server := range servers {
+		for _, rule := range server.Rules {
+			if len(rule.Trigger) > 0 && len(rule.Escalation) > 0 {
+				return nil, errors.Errorf("rule %s of server %s can not escalate, it is triggered by events", rule.ID, server.Description)
+			}
+		}
 	}
 
 	// TODO: Add more validations
@@ -69,103 +304,378 @@ func getServers() ([]common.Server, error) {
 	return servers, nil
 }
 
-func processRule(server common.Server, rule common.Rule, delays map[string]time.Time) error {
-	bodyStr, err := performRequest(server, rule.Request)
-	if err != nil {
-		return errors.Wrap(err, "failed to perform the configured HTTP request")
+// attachRules adds the rules of the `rules` setting to the servers matched by
+// their selector. The server description is appended to the ID of the rules
+// so that each server has its own state.
+func attachRules(servers []common.Server, t templates) error {
+	var rules []common.Rule
+	if err := viper.UnmarshalKey("Rules", &rules); err != nil {
+		return errors.Wrap(err, "failed to unmarshal the `Rules` setting")
 	}
+	for _, rule := range rules {
+		rule, err := t.expandRule(rule)
+		if err != nil {
+			return errors.Wrap(err, "invalid rule of the `Rules` setting")
+		}
+		sel, err := parseSelector(rule.Selector)
+		if err != nil {
+			return errors.Wrapf(err, "invalid selector of rule %s", rule.ID)
+		}
+		for i, server := range servers {
+			if !sel.matches(server.Labels) {
+				continue
+			}
+			attached := rule
+			attached.ID = rule.ID + "@" + server.Description
+			servers[i].Rules = append(append([]common.Rule(nil), servers[i].Rules...), attached)
+		}
+	}
+	return nil
+}
 
-	log.Printf("Server: %s | Rule: %s | Evaluating rule...", server.Description, rule.Description)
-	result, err := evaluateRule(rule.Evaluator, bodyStr)
+func getNotifications() (common.Notifications, error) {
+	var notifications common.Notifications
+	if err := viper.UnmarshalKey("Notifications", &notifications); err != nil {
+		return notifications, errors.Wrap(err, "failed to unmarshal the `Notifications` setting")
+	}
+	t, err := getTemplates()
 	if err != nil {
-		return errors.Wrapc(err, map[string]interface{}{
-			"evaluator": rule.Evaluator,
-			"body":      bodyStr,
-		}, "failed to evaluate rule")
+		return notifications, err
+	}
+	if notifications.Actions, err = t.expandActions(notifications.Actions, nil); err != nil {
+		return notifications, errors.Wrap(err, "invalid `Notifications` setting")
+	}
+	return notifications, nil
+}
+
+// processRule evaluates rule and executes its actions when it fires. The
+// caller holds state.mu, which is released while the actions are executed.
+func processRule(server common.Server, rule common.Rule, state *State, opts scoutOptions, logger *common.Logger, outcome *Outcome) error {
+	now := time.Now()
+	var result bool
+	switch {
+	case opts.event != nil:
+		var err error
+		if result, err = eventRule(rule, *opts.event, state, logger, outcome, now); err != nil {
+			return err
+		}
+	case rule.Builtin != nil:
+		findings, err := runBuiltin(server, *rule.Builtin, opts.request, now)
+		if err != nil {
+			return errors.Wrapf(err, "failed to run the built-in check %s", rule.Builtin.Check)
+		}
+		for _, finding := range findings {
+			logger.With(common.Fields{"finding": finding}).Info("Built-in check found")
+		}
+		outcome.Findings = findings
+		result = len(findings) > 0
+	case rule.Drift != nil:
+		drift, err := checkDrift(server, *rule.Drift, opts.request)
+		if err != nil {
+			return errors.Wrapf(err, "failed to check the drift from %s", rule.Drift.File)
+		}
+		findings := drift.findings()
+		for _, finding := range findings {
+			logger.With(common.Fields{"finding": finding}).Info("Drift found")
+		}
+		outcome.Findings = findings
+		if len(findings) > 0 {
+			outcome.Drift = &drift
+		}
+		result = len(findings) > 0
+	case rule.Changes != nil:
+		var err error
+		if result, err = changesRule(server, rule, state, opts, logger, outcome, now); err != nil {
+			return err
+		}
+	default:
+		var err error
+		if result, err = requestRule(server, &rule, state, opts, logger, outcome); err != nil {
+			return err
+		}
 	}
 
+	rs := state.rule(rule.ID)
+
 	if !result {
-		log.Printf("Server: %s | Rule: %s | Evaluated to false", server.Description, rule.Description)
+		logger.Debug("Evaluated to false")
+		if !rs.FiringSince.IsZero() {
+			logger.With(common.Fields{"since": rs.FiringSince}).Info("Resolved")
+			rs.resolve()
+		}
 		return nil
 	}
 
-	log.Printf("Server: %s | Rule: %s | Evaluated to true", server.Description, rule.Description)
+	logger.Info("Evaluated to true")
+	outcome.Result = true
+	if rs.FiringSince.IsZero() {
+		rs.FiringSince = now
+	}
+
+	if silence, ok := matchSilence(opts.silences, server, rule, now); ok {
+		logger.With(common.Fields{
+			"silence": silence.ID,
+			"reason":  silence.Reason,
+		}).Info("Silenced")
+		outcome.Silenced = silence.ID
+		return nil
+	}
+
+	if err := escalate(server, rule, state, rs, now, opts, logger, outcome); err != nil {
+		return errors.Wrap(err, "failed to escalate")
+	}
+
+	if rs.Delay.After(now) {
+		logger.With(common.Fields{"until": rs.Delay}).Info("Delayed")
+		outcome.Delayed = true
+		return nil
+	}
 
-	delay, ok := delays[rule.ID]
-	if ok {
-		if delay.Before(time.Now()) {
-			delete(delays, rule.ID)
+	if rule.DeadLetters != nil {
+		summary, err := deadLetters(server, rule, opts)
+		if err != nil {
+			// The actions are executed anyway, without the messages.
+			logger.WithError(err).Warn("Failed to sample the dead letters")
 		} else {
-			log.Printf("Server: %s | Rule: %s | Delayed", server.Description, rule.Description)
-			return nil
+			logger.With(common.Fields{"sampled": summary.Sampled}).Debug("Sampled the dead letters")
+			outcome.DeadLetters = &summary
 		}
 	}
 
-	log.Printf("Server: %s | Rule: %s | Executing actions...", server.Description, rule.Description)
+	if len(opts.notifications.Actions) > 0 {
+		group := state.notifier.add(opts.notifications, Alert{
+			Server: server,
+			Rule:   rule,
+			Time:   now,
+		})
+		logger.With(common.Fields{"group": group}).Debug("Grouped notification")
+	}
 
-	for _, action := range rule.Actions {
-		log.Printf("Server: %s | Rule: %s | Executing action %s...", server.Description, rule.Description, action.Description)
-		if err := act(action); err != nil {
-			err = errors.Wrapcf(err, map[string]interface{}{
-				"action": action,
-			}, "failed to execute action %s", action.Description)
-			log.Printf("Server: %s | Rule: %s | Executing action %s... Fail - %s", server.Description, rule.Description, action.Description, err.Error())
-			break
-		}
-		log.Printf("Server: %s | Rule: %s | Executing action %s... OK", server.Description, rule.Description, action.Description)
+	logger.Info("Executing actions...")
+	start := time.Now()
+
+	var executed actionsResult
+	var err error
+	state.unlocked(func() {
+		executed, err = executeActions(rule.Actions, server, rule, opts, logger, outcome)
+	})
+	if err != nil {
+		return err
+	}
+	outcome.Status = executed.status()
+	// The changes are reported unless every action failed.
+	if outcome.snapshot != nil && outcome.Status != "failed" {
+		rs.Snapshot = outcome.snapshot
 	}
 
-	log.Printf("Server: %s | Rule: %s | Executing actions... OK", server.Description, rule.Description)
+	actionsLogger := logger.With(common.Fields{
+		"duration": time.Since(start),
+		"status":   outcome.Status,
+	})
+	if executed.failed > 0 {
+		actionsLogger.With(common.Fields{
+			"failed":  executed.failed,
+			"skipped": executed.skipped,
+		}).Error("Executing actions... Fail")
+		if rule.SkipDelayOnFailure {
+			logger.Info("Not delaying due to failed actions")
+			return nil
+		}
+	} else {
+		actionsLogger.Info("Executing actions... OK")
+	}
 
-	delays[rule.ID] = time.Now().Add(rule.Delay * time.Millisecond)
+	rs.Delay = time.Now().Add(rule.Delay * time.Millisecond)
 
 	return nil
 }
 
-func performRequest(server common.Server, request common.Request) (string, error) {
-	urlStr := fmt.Sprintf("%s://%s:%d%s", server.Protocol, server.Host, server.Port, request.Path)
-	req, err := http.NewRequest(request.Method, urlStr, nil)
+// requestRule requests the Management API, or probes the server, and
+// evaluates the response. The actions of rule are replaced by the ones its
+// `on_status` setting maps the status of the response to.
+func requestRule(server common.Server, rule *common.Rule, state *State, opts scoutOptions, logger *common.Logger, outcome *Outcome) (bool, error) {
+	request := rule.Request
+	if request.Templated {
+		path, err := render("path", request.Path, templateData(server, *rule))
+		if err != nil {
+			return false, errors.Wrapc(err, map[string]interface{}{
+				"path": request.Path,
+			}, "failed to render the request path")
+		}
+		request.Path = path
+	}
+
+	var (
+		resp response
+		err  error
+	)
+	if rule.Probe != nil {
+		if resp.Body, err = opts.probe(server, *rule.Probe); err != nil {
+			return false, errors.Wrap(err, "failed to perform the configured AMQP probe")
+		}
+		resp.Status = http.StatusOK
+	} else if resp, err = opts.request(server, request); err != nil {
+		return false, errors.Wrap(err, "failed to perform the configured HTTP request")
+	}
+
+	now := time.Now()
+	if actions, ok := matchStatus(rule.OnStatus, resp.Status); ok {
+		logger.With(common.Fields{"status": resp.Status}).Info("Response status matched")
+		outcome.ResponseStatus = resp.Status
+		rule.Actions = actions
+		return true, nil
+	}
+	if resp.Status != http.StatusOK && !rule.Request.AnyStatus {
+		return false, errors.Errorcf(map[string]interface{}{
+			"method": request.Method,
+			"path":   request.Path,
+			"status": resp.Status,
+		}, "HTTP request returned an unexpected response, %d %s", resp.Status, http.StatusText(resp.Status))
+	}
+	return evaluate(*rule, resp, state, now, logger, outcome)
+}
+
+func performRequest(server common.Server, request common.Request) (response, error) {
+	port := server.Port
+	if request.Port != 0 {
+		port = request.Port
+	}
+	urlStr := fmt.Sprintf("%s://%s:%d%s", server.Protocol, server.Host, port, requestPath(request))
+	var body io.Reader
+	if request.Body != "" {
+		body = strings.NewReader(request.Body)
+	}
+	req, err := http.NewRequest(request.Method, urlStr, body)
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to create an HTTP request to %s", urlStr)
+		return response{}, errors.Wrapf(err, "failed to create an HTTP request to %s", urlStr)
 	}
 	req.SetBasicAuth(server.User, server.Password)
+	if request.Body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to perform an HTTP %s request to %s", request.Method, request.Path)
+		return response{}, errors.Wrapf(err, "failed to perform an HTTP %s request to %s", request.Method, request.Path)
 	}
 	defer func() {
 		res.Body.Close()
 	}()
 
-	if res.StatusCode != 200 {
-		return "", errors.Errorcf(map[string]interface{}{
-			"request":  req,
-			"response": res,
-		}, "HTTP request returned an unexpected response, %s", res.Status)
+	headers := make(map[string]string, len(res.Header))
+	for name := range res.Header {
+		headers[name] = res.Header.Get(name)
+	}
+	resp := response{
+		Status:  res.StatusCode,
+		Headers: headers,
+	}
+
+	// Successful JSON responses, which can be large, are decoded as they
+	// are read instead of being buffered.
+	if res.StatusCode == http.StatusOK && isJSON(request.Format) {
+		if resp.Value, err = decodeJSON(res.Body, request.Columns); err != nil {
+			return response{}, errors.Wrapf(err, "failed to decode the response to the HTTP %s request to %s", request.Method, request.Path)
+		}
+		return resp, nil
 	}
 
 	buf := bytes.Buffer{}
 	if _, err := buf.ReadFrom(res.Body); err != nil {
-		return "", errors.Wrap(err, "failed to read the response body and append it to a buffer")
+		return response{}, errors.Wrap(err, "failed to read the response body and append it to a buffer")
 	}
+	resp.Body = buf.String()
+	return resp, nil
+}
 
-	return buf.String(), nil
+// evaluate records the samples of rule and runs its evaluator and checks
+// against resp.
+func evaluate(rule common.Rule, resp response, state *State, now time.Time, logger *common.Logger, outcome *Outcome) (bool, error) {
+	format := rule.Request.Format
+	if rule.Probe != nil {
+		format = formatJSON
+	}
+	var body interface{}
+	if len(rule.Samples) > 0 || rule.Evaluator != "" {
+		var err error
+		if body, err = bodyValue(format, rule.Request.Columns, resp); err != nil {
+			return false, errors.Wrap(err, "failed to decode the response body")
+		}
+	}
+	if len(rule.Samples) > 0 && resp.Status == http.StatusOK {
+		recordSamples(rule, body, state.history, now, logger)
+	}
+
+	result := false
+	if rule.Evaluator != "" {
+		logger.Debug("Evaluating rule...")
+		var err error
+		result, err = evaluateRule(rule.Evaluator, body, resp, state.history, rule.ID, now)
+		if err != nil {
+			return false, errors.Wrapc(err, map[string]interface{}{
+				"evaluator": rule.Evaluator,
+				"body":      resp.Body,
+			}, "failed to evaluate rule")
+		}
+	}
+
+	fired, err := runChecks(rule, state.history, now)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to run the checks")
+	}
+	for _, check := range fired {
+		logger.With(common.Fields{"check": check.String()}).Info("Check fired")
+		outcome.Checks = append(outcome.Checks, check.String())
+	}
+	return result || len(fired) > 0, nil
+}
+
+// matchStatus returns the actions onStatus maps to status, either by its
+// code, e.g. `404`, or by its class, e.g. `4xx`.
+func matchStatus(onStatus map[string][]common.Action, status int) ([]common.Action, bool) {
+	if len(onStatus) == 0 {
+		return nil, false
+	}
+	code := strconv.Itoa(status)
+	class := code[:1] + "xx"
+	var classActions []common.Action
+	classFound := false
+	for key, actions := range onStatus {
+		switch strings.ToLower(key) {
+		case code:
+			return actions, true
+		case class:
+			classActions, classFound = actions, true
+		}
+	}
+	return classActions, classFound
 }
 
-func evaluateRule(evaluator string, bodyStr string) (bool, error) {
+// evaluateRule runs the evaluate function of evaluator with body, the
+// decoded body of resp, whose status and headers are available through the
+// `response` object and the samples of the rule through the `history`
+// object.
+func evaluateRule(evaluator string, body interface{}, resp response, h *history, rule string, now time.Time) (bool, error) {
 	vm := otto.New()
-	if err := vm.Set("_body", bodyStr); err != nil {
+	if err := vm.Set("_body", jsValue(body)); err != nil {
 		return false, errors.Wrap(err, "failed to set the body variable")
 	}
+	if err := vm.Set("response", map[string]interface{}{
+		"status":  resp.Status,
+		"headers": resp.Headers,
+	}); err != nil {
+		return false, errors.Wrap(err, "failed to set the response variable")
+	}
+	if err := vm.Set("history", historyObject(vm, h, rule, now)); err != nil {
+		return false, errors.Wrap(err, "failed to set the history variable")
+	}
 
 	script := fmt.Sprintf(`
 		%s
-		_result = evaluate(JSON.parse(_body));
+		_result = evaluate(_body);
 	`, evaluator)
 
-	_, err := vm.Run(script)
-	if err != nil {
+	if _, err := vm.Run(script); err != nil {
 		return false, errors.Wrapc(err, map[string]interface{}{
 			"script": script,
 		}, "failed to run the script")
@@ -188,7 +698,66 @@ func evaluateRule(evaluator string, bodyStr string) (bool, error) {
 	return result, nil
 }
 
+// actionData is what the templates of the actions of a rule of server can
+// refer to: the templateData of the rule, and the Findings of its built-in,
+// drift or changes check with the Drift and Changes themselves, its sampled
+// DeadLetters and the Event that triggered it, from outcome.
+func actionData(server common.Server, rule common.Rule, outcome *Outcome) map[string]interface{} {
+	data := templateData(server, rule)
+	data["Findings"] = outcome.Findings
+	data["Drift"] = outcome.Drift
+	data["Changes"] = outcome.Changes
+	data["DeadLetters"] = outcome.DeadLetters
+	data["Event"] = outcome.Event
+	return data
+}
+
+// templateData is what the templates of a rule of server can refer to: the
+// Server, the Rule and their merged Labels.
+func templateData(server common.Server, rule common.Rule) map[string]interface{} {
+	return map[string]interface{}{
+		"Server": server,
+		"Rule":   rule,
+		"Labels": ruleLabels(server, rule),
+	}
+}
+
+// renderActionWith resolves the templates in the arguments of action using
+// data, the arguments of the actions that are not templated are unchanged.
+func renderActionWith(action common.Action, data interface{}) (common.Action, error) {
+	if !action.Templated {
+		return action, nil
+	}
+	args := make([]string, 0, len(action.Args))
+	for _, arg := range action.Args {
+		rendered, err := render("arg", arg, data)
+		if err != nil {
+			return action, errors.Wrapc(err, map[string]interface{}{
+				"arg": arg,
+			}, "failed to render the argument template")
+		}
+		args = append(args, rendered)
+	}
+	action.Args = args
+	return action, nil
+}
+
+func render(name, text string, data interface{}) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse the template")
+	}
+	buf := bytes.Buffer{}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", errors.Wrap(err, "failed to execute the template")
+	}
+	return buf.String(), nil
+}
+
 func act(action common.Action) error {
+	if action.Builtin != "" {
+		return errors.Errorf("the built-in action %s can only be an action of a rule", action.Builtin)
+	}
 	cmd := exec.Command(action.Cmd, action.Args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
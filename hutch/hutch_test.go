@@ -0,0 +1,400 @@
+package hutch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/tradeforce/lophutch/common"
+)
+
+// configure replaces the settings by the ones of the YAML config for the
+// duration of the test, with a temporary state directory.
+func configure(t *testing.T, config string) {
+	t.Helper()
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatalf("failed to read the configuration: %v", err)
+	}
+	viper.Set("state-dir", t.TempDir())
+	t.Cleanup(viper.Reset)
+}
+
+// captureLog replaces the application logger by one writing JSON entries of
+// every level into the returned buffer for the duration of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	logger, err := common.NewLogger(&buf, "json", common.DebugLevel)
+	if err != nil {
+		t.Fatalf("NewLogger() error = %v", err)
+	}
+	previous := common.Log
+	common.Log = logger
+	t.Cleanup(func() { common.Log = previous })
+	return &buf
+}
+
+// logEntries decodes the entries written by the logger of captureLog.
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for dec.More() {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("invalid log entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestRenderActionWith(t *testing.T) {
+	data := map[string]interface{}{
+		"Rule": common.Rule{ID: "rule-1"},
+	}
+	tests := []struct {
+		name   string
+		action common.Action
+		args   []string
+	}{
+		{
+			name:   "literal arguments are unchanged",
+			action: common.Action{Args: []string{"--format", "{{.Name}}", "{{"}},
+			args:   []string{"--format", "{{.Name}}", "{{"},
+		},
+		{
+			name:   "templated arguments are rendered",
+			action: common.Action{Args: []string{"{{.Rule.ID}} fired"}, Templated: true},
+			args:   []string{"rule-1 fired"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action, err := renderActionWith(test.action, data)
+			if err != nil {
+				t.Fatalf("renderActionWith() error = %v", err)
+			}
+			if !reflect.DeepEqual(action.Args, test.args) {
+				t.Errorf("renderActionWith() args = %q, want %q", action.Args, test.args)
+			}
+		})
+	}
+}
+
+func TestRenderActionWithInvalidTemplate(t *testing.T) {
+	action := common.Action{Args: []string{"{{.Name}}"}, Templated: true}
+	if _, err := renderActionWith(action, map[string]interface{}{}); err == nil {
+		t.Error("renderActionWith() error = nil, want the missing key")
+	}
+}
+
+func TestExecuteActionsKeepsLiteralArguments(t *testing.T) {
+	rule := common.Rule{
+		ID: "rule-1",
+		Actions: []common.Action{{
+			Description: "inspect",
+			Cmd:         "docker",
+			Args:        []string{"inspect", "--format", "{{.Name}}"},
+		}},
+	}
+	outcome := Outcome{}
+	_, err := executeActions(rule.Actions, common.Server{}, rule, scoutOptions{dryRun: true}, common.Log, &outcome)
+	if err != nil {
+		t.Fatalf("executeActions() error = %v", err)
+	}
+	if len(outcome.Actions) != 1 || !reflect.DeepEqual(outcome.Actions[0].Args, rule.Actions[0].Args) {
+		t.Errorf("executeActions() actions = %+v, want the arguments unchanged", outcome.Actions)
+	}
+}
+
+// The request paths and dead-letter queue names are templates only when
+// templated, like the action arguments.
+func TestTemplatedSettings(t *testing.T) {
+	server := common.Server{
+		Description: "main",
+		Protocol:    "http",
+		Host:        "rabbit-1",
+		Port:        15672,
+		Labels:      map[string]string{"vhost": "orders/eu"},
+	}
+	tests := []struct {
+		name      string
+		path      string
+		queue     string
+		templated bool
+		wantPath  string
+		wantQueue string
+	}{
+		{
+			name:      "literal",
+			path:      "/api/queues/%2F/{{x}}",
+			queue:     "{{x}}.dlq",
+			wantPath:  "/api/queues/%2F/{{x}}",
+			wantQueue: "{{x}}.dlq",
+		},
+		{
+			name:      "templated",
+			path:      "/api/queues/{{urlquery .Labels.vhost}}/orders",
+			queue:     "{{.Labels.vhost}}.dlq",
+			templated: true,
+			wantPath:  "/api/queues/orders%2Feu/orders",
+			wantQueue: "orders/eu.dlq",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var paths []string
+			opts := scoutOptions{
+				request: func(server common.Server, request common.Request) (response, error) {
+					paths = append(paths, request.Path)
+					return response{Status: http.StatusOK, Body: "[]"}, nil
+				},
+			}
+			rule := common.Rule{
+				ID:        "rule-1",
+				Request:   common.Request{Method: "GET", Path: test.path, Templated: test.templated},
+				Evaluator: "function evaluate(body) { return false; }",
+			}
+			if _, err := requestRule(server, &rule, NewState(), opts, common.Log, &Outcome{}); err != nil {
+				t.Fatalf("requestRule() error = %v", err)
+			}
+			if !reflect.DeepEqual(paths, []string{test.wantPath}) {
+				t.Errorf("requestRule() paths = %q, want %q", paths, test.wantPath)
+			}
+
+			rule.DeadLetters = &common.DeadLetters{Vhost: "/", Queue: test.queue, Templated: test.templated}
+			summary, err := deadLetters(server, rule, opts)
+			if err != nil {
+				t.Fatalf("deadLetters() error = %v", err)
+			}
+			if summary.Queue != test.wantQueue {
+				t.Errorf("deadLetters() queue = %q, want %q", summary.Queue, test.wantQueue)
+			}
+		})
+	}
+}
+
+// The discovered servers sharing the rules of their provider are alerted
+// separately.
+func TestDiscoveredServersHaveTheirOwnRuleState(t *testing.T) {
+	busy := ordersAPI(t)
+	defer busy.Close()
+	quiet := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"name": "orders", "vhost": "/", "messages": 0}`)
+	}))
+	defer quiet.Close()
+
+	var servers strings.Builder
+	servers.WriteString("servers:\n")
+	for i, addr := range []string{busy.URL, quiet.URL} {
+		u, err := url.Parse(addr)
+		if err != nil {
+			t.Fatalf("invalid address %s: %v", addr, err)
+		}
+		fmt.Fprintf(&servers, "- description: rabbit-%d\n  host: %s\n  port: %s\n", i+1, u.Hostname(), u.Port())
+	}
+	path := filepath.Join(t.TempDir(), "servers.yaml")
+	if err := os.WriteFile(path, []byte(servers.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	configure(t, fmt.Sprintf(`
+discovery:
+  providers:
+  - type: file
+    path: %s
+    server:
+      protocol: http
+      user: guest
+      password: guest
+      rules:
+      - id: orders-backlog
+        request:
+          method: GET
+          path: /api/queues/%%2F/orders
+        evaluator: |
+          function evaluate(queue) {
+            return queue.messages > 0;
+          }
+        actions:
+        - description: notify
+          cmd: notify-ops
+`, path))
+	viper.Set("dry-run", true)
+	viper.Set("run-once", true)
+
+	state := NewState()
+	if err := Scout(state); err != nil {
+		t.Fatalf("Scout() error = %v", err)
+	}
+	firing := map[string]bool{}
+	for id, rs := range state.rules {
+		firing[id] = !rs.FiringSince.IsZero()
+	}
+	want := map[string]bool{"orders-backlog@rabbit-1": true, "orders-backlog@rabbit-2": false}
+	if !reflect.DeepEqual(firing, want) {
+		t.Errorf("firing rules = %v, want %v", firing, want)
+	}
+}
+
+// A discovery provider failing does not stop the scouts.
+func TestScoutWithFailingDiscovery(t *testing.T) {
+	api := ordersAPI(t)
+	defer api.Close()
+	const discovery = `
+discovery:
+  providers:
+  - type: http
+    url: http://127.0.0.1:1/servers
+`
+	tests := []struct {
+		name   string
+		config string
+		firing []string
+	}{
+		{name: "configured servers", config: ordersConfig(t, api.URL) + discovery, firing: []string{"orders-backlog"}},
+		{name: "no servers", config: discovery},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configure(t, test.config)
+			viper.Set("dry-run", true)
+			viper.Set("run-once", true)
+
+			state := NewState()
+			if err := Scout(state); err != nil {
+				t.Fatalf("Scout() error = %v", err)
+			}
+			var firing []string
+			for id, rs := range state.rules {
+				if !rs.FiringSince.IsZero() {
+					firing = append(firing, id)
+				}
+			}
+			if !reflect.DeepEqual(firing, test.firing) {
+				t.Errorf("firing rules = %v, want %v", firing, test.firing)
+			}
+		})
+	}
+}
+
+func TestMatchStatus(t *testing.T) {
+	missing := []common.Action{{Description: "queue missing"}}
+	clientError := []common.Action{{Description: "client error"}}
+	serverError := []common.Action{{Description: "server error"}}
+	onStatus := map[string][]common.Action{"404": missing, "4XX": clientError, "5xx": serverError}
+	tests := []struct {
+		name     string
+		onStatus map[string][]common.Action
+		status   int
+		actions  []common.Action
+		matched  bool
+	}{
+		{name: "code over its class", onStatus: onStatus, status: 404, actions: missing, matched: true},
+		{name: "class", onStatus: onStatus, status: 403, actions: clientError, matched: true},
+		{name: "other class", onStatus: onStatus, status: 503, actions: serverError, matched: true},
+		{name: "no match", onStatus: onStatus, status: 200},
+		{name: "no mapping", status: 404},
+		{name: "empty actions", onStatus: map[string][]common.Action{"404": nil}, status: 404, matched: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actions, matched := matchStatus(test.onStatus, test.status)
+			if matched != test.matched || !reflect.DeepEqual(actions, test.actions) {
+				t.Errorf("matchStatus() = %+v, %t, want %+v, %t", actions, matched, test.actions, test.matched)
+			}
+		})
+	}
+}
+
+// The responses other than 200 fire the actions their status is mapped to,
+// are evaluated with `any_status`, and are errors otherwise.
+func TestProcessRuleStatus(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "30")
+		switch r.URL.EscapedPath() {
+		case "/api/queues/%2F/orders":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": "Object Not Found", "reason": "Not Found"}`)
+		case "/api/overview":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error": "unavailable"}`)
+		default:
+			fmt.Fprint(w, `{"messages": 0}`)
+		}
+	}))
+	defer api.Close()
+	u, err := url.Parse(api.URL)
+	if err != nil {
+		t.Fatalf("invalid address %s: %v", api.URL, err)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		t.Fatalf("invalid port %s: %v", u.Port(), err)
+	}
+	server := common.Server{Description: "main", Protocol: "http", Host: u.Hostname(), Port: port}
+	onStatus := map[string][]common.Action{
+		"404": {{Description: "queue missing", Cmd: "notify-ops"}},
+		"5xx": {{Description: "server error", Cmd: "notify-ops"}},
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		onStatus map[string][]common.Action
+		any      bool
+		status   int
+		actions  []string
+		invalid  bool
+	}{
+		{name: "mapped code", path: "/api/queues/%2F/orders", onStatus: onStatus, status: 404, actions: []string{"queue missing"}},
+		{name: "mapped class", path: "/api/overview", onStatus: onStatus, status: 503, actions: []string{"server error"}},
+		{name: "unmapped status", path: "/api/queues/%2F/orders", onStatus: map[string][]common.Action{"5xx": onStatus["5xx"]}, invalid: true},
+		{name: "unexpected status", path: "/api/overview", invalid: true},
+		{name: "any status", path: "/api/overview", any: true, actions: []string{"notify"}},
+		{name: "successful", path: "/api/nodes"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := common.Rule{
+				ID:      "rule-1",
+				Request: common.Request{Method: "GET", Path: test.path, AnyStatus: test.any},
+				Evaluator: `function evaluate(body) {
+					return response.status === 503 && response.headers["Retry-After"] === "30" && body.error === "unavailable";
+				}`,
+				OnStatus: test.onStatus,
+				Actions:  []common.Action{{Description: "notify", Cmd: "notify-ops"}},
+			}
+			opts := scoutOptions{dryRun: true, request: performRequest}
+			outcome := Outcome{}
+			state := NewState()
+			state.mu.Lock()
+			err := processRule(server, rule, state, opts, common.Log, &outcome)
+			state.mu.Unlock()
+			if (err != nil) != test.invalid {
+				t.Fatalf("processRule() error = %v, want an error %t", err, test.invalid)
+			}
+			var actions []string
+			for _, action := range outcome.Actions {
+				actions = append(actions, action.Description)
+			}
+			if outcome.ResponseStatus != test.status || !reflect.DeepEqual(actions, test.actions) {
+				t.Errorf("processRule() = status %d, actions %v, want %d, %v", outcome.ResponseStatus, actions, test.status, test.actions)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package hutch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// limiter enforces the rate limits of the actions and the circuit breaker of
+// the remediation, it is safe for concurrent use.
+type limiter struct {
+	mu sync.Mutex
+	// executions are the recent executions of the actions with a rate
+	// limit, by actionKey.
+	executions map[string]*actionExecutions
+	all        []time.Time
+	failures   []time.Time
+	openedAt   time.Time
+}
+
+// actionExecutions are the executions of an action within the window of its
+// rate limit.
+type actionExecutions struct {
+	window time.Duration
+	times  []time.Time
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		executions: make(map[string]*actionExecutions),
+	}
+}
+
+// limiterStatus is the current state of a limiter, ActionExecutions counting
+// the executions of the actions with a rate limit within its window.
+type limiterStatus struct {
+	Executions       int            `json:"executions"`
+	Failures         int            `json:"failures"`
+	ActionExecutions map[string]int `json:"action_executions"`
+	CircuitBreaker   breakerStatus  `json:"circuit_breaker"`
+}
+
+type breakerStatus struct {
+	Open     bool       `json:"open"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+func actionKey(rule common.Rule, action common.Action) string {
+	return rule.ID + "/" + action.Description
+}
+
+// since returns the times that are not before start.
+func since(times []time.Time, start time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(start) {
+		i++
+	}
+	return times[i:]
+}
+
+// allow reports why the action of rule can not be executed at now, or
+// reserves its execution and returns an empty string when it can, so that
+// the actions executed in parallel can not exceed the limits together.
+func (l *limiter) allow(cfg common.Remediation, rule common.Rule, action common.Action, now time.Time) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.open(cfg.CircuitBreaker, now) {
+		return "circuit breaker open"
+	}
+	if cfg.RateLimit != nil && cfg.RateLimit.Max > 0 {
+		recent := since(l.all, now.Add(-cfg.RateLimit.Window*time.Millisecond))
+		if len(recent) >= cfg.RateLimit.Max {
+			return "global rate limit"
+		}
+	}
+	if action.RateLimit != nil && action.RateLimit.Max > 0 {
+		key := actionKey(rule, action)
+		e, ok := l.executions[key]
+		if !ok {
+			e = &actionExecutions{}
+			l.executions[key] = e
+		}
+		e.window = action.RateLimit.Window * time.Millisecond
+		e.times = since(e.times, now.Add(-e.window))
+		if len(e.times) >= action.RateLimit.Max {
+			return "action rate limit"
+		}
+		e.times = append(e.times, now)
+	}
+	l.all = append(l.all, now)
+	return ""
+}
+
+// open reports if the circuit breaker is open at now, closing it once its
+// cooldown elapsed. The caller must hold l.mu.
+func (l *limiter) open(cfg common.CircuitBreaker, now time.Time) bool {
+	if l.openedAt.IsZero() {
+		return false
+	}
+	if cfg.Cooldown > 0 && !l.openedAt.Add(cfg.Cooldown*time.Millisecond).After(now) {
+		common.Log.With(common.Fields{"opened_at": l.openedAt}).Info("Circuit breaker closed")
+		l.openedAt = time.Time{}
+		l.all = nil
+		l.failures = nil
+		return false
+	}
+	return true
+}
+
+// record accounts for the result of an execution of the action of rule,
+// reserved by allow, and returns true if it opened the circuit breaker.
+func (l *limiter) record(cfg common.Remediation, rule common.Rule, action common.Action, failed bool, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if failed {
+		l.failures = append(l.failures, now)
+	}
+
+	l.prune(cfg, now)
+
+	breaker := cfg.CircuitBreaker
+	if !l.openedAt.IsZero() || breaker.Window <= 0 {
+		return false
+	}
+	start := now.Add(-breaker.Window * time.Millisecond)
+	if (breaker.MaxExecutions > 0 && len(since(l.all, start)) >= breaker.MaxExecutions) ||
+		(breaker.MaxFailures > 0 && len(since(l.failures, start)) >= breaker.MaxFailures) {
+		l.openedAt = now
+		return true
+	}
+	return false
+}
+
+// prune drops the times that no longer fall within any window, and the
+// actions without recent executions. The caller must hold l.mu.
+func (l *limiter) prune(cfg common.Remediation, now time.Time) {
+	window := cfg.CircuitBreaker.Window
+	if cfg.RateLimit != nil && cfg.RateLimit.Window > window {
+		window = cfg.RateLimit.Window
+	}
+	l.all = since(l.all, now.Add(-window*time.Millisecond))
+	l.failures = since(l.failures, now.Add(-cfg.CircuitBreaker.Window*time.Millisecond))
+	for key, e := range l.executions {
+		if e.times = since(e.times, now.Add(-e.window)); len(e.times) == 0 {
+			delete(l.executions, key)
+		}
+	}
+}
+
+// status returns the counts within the windows of cfg at now.
+func (l *limiter) status(cfg common.Remediation, now time.Time) limiterStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	status := limiterStatus{
+		ActionExecutions: make(map[string]int, len(l.executions)),
+		CircuitBreaker: breakerStatus{
+			Open: l.open(cfg.CircuitBreaker, now),
+		},
+	}
+	window := cfg.CircuitBreaker.Window
+	if cfg.RateLimit != nil && cfg.RateLimit.Window > window {
+		window = cfg.RateLimit.Window
+	}
+	status.Executions = len(since(l.all, now.Add(-window*time.Millisecond)))
+	status.Failures = len(since(l.failures, now.Add(-cfg.CircuitBreaker.Window*time.Millisecond)))
+	for key, e := range l.executions {
+		if n := len(since(e.times, now.Add(-e.window))); n > 0 {
+			status.ActionExecutions[key] = n
+		}
+	}
+	if status.CircuitBreaker.Open {
+		openedAt := l.openedAt
+		status.CircuitBreaker.OpenedAt = &openedAt
+	}
+	return status
+}
+
+// tripped executes the actions of the circuit breaker after it opened.
+func tripped(cfg common.Remediation, rule common.Rule, logger *common.Logger) {
+	logger = logger.With(common.Fields{"circuit_breaker": true})
+	logger.Error("Circuit breaker opened, stopping the remediation")
+	for _, action := range cfg.CircuitBreaker.Actions {
+		actionLogger := logger.With(common.Fields{"action": action.Description})
+		action, err := renderActionWith(action, map[string]interface{}{
+			"Rule":           rule,
+			"CircuitBreaker": cfg.CircuitBreaker,
+		})
+		if err != nil {
+			err = errors.Wrapf(err, "failed to render circuit breaker action %s", action.Description)
+			actionLogger.WithError(err).Error("Executing action... Fail")
+			continue
+		}
+		if err := act(action); err != nil {
+			actionLogger.WithError(err).Error("Executing action... Fail")
+			continue
+		}
+		actionLogger.Info("Executing action... OK")
+	}
+}
+
+func getRemediation() (common.Remediation, error) {
+	var remediation common.Remediation
+	if err := viper.UnmarshalKey("Remediation", &remediation); err != nil {
+		return remediation, errors.Wrap(err, "failed to unmarshal the `Remediation` setting")
+	}
+	t, err := getTemplates()
+	if err != nil {
+		return remediation, err
+	}
+	breaker := &remediation.CircuitBreaker
+	if breaker.Actions, err = t.expandActions(breaker.Actions, nil); err != nil {
+		return remediation, errors.Wrap(err, "invalid `Remediation` setting")
+	}
+	return remediation, nil
+}
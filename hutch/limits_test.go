@@ -0,0 +1,87 @@
+package hutch
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+)
+
+func TestLimiterParallelActions(t *testing.T) {
+	var executed int32
+	withBuiltin(t, "count", func(action common.Action, ctx actionContext, logger *common.Logger) error {
+		atomic.AddInt32(&executed, 1)
+		return nil
+	})
+	tests := []struct {
+		name        string
+		remediation common.Remediation
+		rateLimit   *common.RateLimit
+	}{
+		{
+			name:        "global rate limit",
+			remediation: common.Remediation{RateLimit: &common.RateLimit{Max: 2, Window: 60000}},
+		},
+		{
+			name:      "action rate limit",
+			rateLimit: &common.RateLimit{Max: 2, Window: 60000},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreInt32(&executed, 0)
+			action := common.Action{Description: "count", Builtin: "count", Group: "parallel", RateLimit: test.rateLimit}
+			rule := firingRule(action, action, action, action)
+			opts := firingOptions()
+			opts.remediation = test.remediation
+
+			outcome := Outcome{}
+			result, err := executeActions(rule.Actions, common.Server{}, rule, opts, common.Log, &outcome)
+			if err != nil {
+				t.Fatalf("executeActions() error = %v", err)
+			}
+			if result.succeeded != 2 || result.limited != 2 || atomic.LoadInt32(&executed) != 2 {
+				t.Errorf("executeActions() = %+v with %d executions, want 2 executed and 2 limited", result, executed)
+			}
+		})
+	}
+}
+
+// Only the executions of the actions with a rate limit are kept, within its
+// window.
+func TestLimiterExecutions(t *testing.T) {
+	limited := common.Action{Description: "limited", RateLimit: &common.RateLimit{Max: 10, Window: 60000}}
+	unlimited := common.Action{Description: "unlimited"}
+	rule := common.Rule{ID: "rule-1"}
+	cfg := common.Remediation{}
+	l := newLimiter()
+	start := time.Now()
+
+	tests := []struct {
+		name   string
+		action common.Action
+		at     time.Duration
+		want   map[string]int
+	}{
+		{name: "unlimited", action: unlimited, want: map[string]int{}},
+		{name: "limited", action: limited, want: map[string]int{"rule-1/limited": 1}},
+		{name: "limited again", action: limited, at: 30 * time.Second, want: map[string]int{"rule-1/limited": 2}},
+		{name: "first execution out of the window", action: unlimited, at: 70 * time.Second, want: map[string]int{"rule-1/limited": 1}},
+		{name: "all executions out of the window", action: unlimited, at: 100 * time.Second, want: map[string]int{}},
+	}
+	for _, test := range tests {
+		now := start.Add(test.at)
+		if reason := l.allow(cfg, rule, test.action, now); reason != "" {
+			t.Fatalf("%s: allow() = %q", test.name, reason)
+		}
+		l.record(cfg, rule, test.action, false, now)
+		if got := l.status(cfg, now).ActionExecutions; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: status() action executions = %v, want %v", test.name, got, test.want)
+		}
+		if len(l.executions) != len(test.want) {
+			t.Errorf("%s: executions kept for %d actions, want %d", test.name, len(l.executions), len(test.want))
+		}
+	}
+}
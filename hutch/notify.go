@@ -0,0 +1,144 @@
+package hutch
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// Alert is a rule that fired and whose actions were not delayed.
+type Alert struct {
+	Server common.Server
+	Rule   common.Rule
+	Time   time.Time
+}
+
+// alertGroup holds the alerts sharing the same values for the labels used to
+// group the notifications.
+type alertGroup struct {
+	Labels map[string]string
+	Alerts []Alert
+	Since  time.Time
+}
+
+// notifier groups the alerts until their window elapses, when a single
+// notification is sent for each group. It is shared by the scouts and the
+// events, mu guarding the groups.
+type notifier struct {
+	mu     sync.Mutex
+	groups map[string]*alertGroup
+}
+
+func newNotifier() *notifier {
+	return &notifier{
+		groups: make(map[string]*alertGroup),
+	}
+}
+
+// groupLabels returns the values of the groupBy labels for the alert. The
+// `server` and `rule` labels resolve to the server description and the rule
+// ID, the remaining ones are looked up in the labels of the rule and then in
+// the ones of its server.
+func groupLabels(groupBy []string, alert Alert) map[string]string {
+	all := ruleLabels(alert.Server, alert.Rule)
+	labels := make(map[string]string, len(groupBy))
+	for _, name := range groupBy {
+		switch name {
+		case "server":
+			labels[name] = alert.Server.Description
+		case "rule":
+			labels[name] = alert.Rule.ID
+		default:
+			labels[name] = all[name]
+		}
+	}
+	return labels
+}
+
+func groupKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// add appends alert to its group, creating the group if needed, and returns
+// the key of the group.
+func (n *notifier) add(cfg common.Notifications, alert Alert) string {
+	labels := groupLabels(cfg.GroupBy, alert)
+	key := groupKey(labels)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	group, ok := n.groups[key]
+	if !ok {
+		group = &alertGroup{
+			Labels: labels,
+			Since:  alert.Time,
+		}
+		n.groups[key] = group
+	}
+	group.Alerts = append(group.Alerts, alert)
+	return key
+}
+
+// flush sends a notification for each group whose window has elapsed, or
+// for every group when all is true. The notifications are sent without
+// holding n.mu, so that the rules processed meanwhile can add their alerts.
+func (n *notifier) flush(opts scoutOptions, now time.Time, all bool) {
+	for key, group := range n.due(opts.notifications.Window*time.Millisecond, now, all) {
+		logger := common.Log.With(common.Fields{
+			"group":  key,
+			"alerts": len(group.Alerts),
+		})
+		for _, action := range opts.notifications.Actions {
+			actionLogger := logger.With(common.Fields{"action": action.Description})
+			action, err := renderActionWith(action, map[string]interface{}{
+				"Group":  group.Labels,
+				"Alerts": group.Alerts,
+			})
+			if err != nil {
+				err = errors.Wrapf(err, "failed to render notification action %s", action.Description)
+				actionLogger.WithError(err).Error("Sending notification... Fail")
+				continue
+			}
+			if opts.dryRun {
+				actionLogger.With(common.Fields{
+					"cmd":  action.Cmd,
+					"args": strings.Join(action.Args, " "),
+				}).Info("Skipping notification due to dry run")
+				continue
+			}
+			start := time.Now()
+			if err := act(action); err != nil {
+				err = errors.Wrapcf(err, map[string]interface{}{
+					"action": action,
+				}, "failed to execute notification action %s", action.Description)
+				actionLogger.WithError(err).With(common.Fields{"duration": time.Since(start)}).Error("Sending notification... Fail")
+				continue
+			}
+			actionLogger.With(common.Fields{"duration": time.Since(start)}).Info("Sending notification... OK")
+		}
+	}
+}
+
+// due removes the groups whose window has elapsed, or every group when all
+// is true, and returns them by key.
+func (n *notifier) due(window time.Duration, now time.Time, all bool) map[string]*alertGroup {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	due := make(map[string]*alertGroup)
+	for key, group := range n.groups {
+		if !all && group.Since.Add(window).After(now) {
+			continue
+		}
+		delete(n.groups, key)
+		due[key] = group
+	}
+	return due
+}
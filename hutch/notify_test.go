@@ -0,0 +1,121 @@
+package hutch
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+)
+
+func TestGroupLabels(t *testing.T) {
+	alert := Alert{
+		Server: common.Server{Description: "main", Labels: map[string]string{"env": "prod", "vhost": "/"}},
+		Rule:   common.Rule{ID: "backlog", Labels: map[string]string{"vhost": "orders", "severity": "critical"}},
+	}
+	tests := []struct {
+		name    string
+		groupBy []string
+		labels  map[string]string
+	}{
+		{name: "none", labels: map[string]string{}},
+		{name: "server and rule", groupBy: []string{"server", "rule"}, labels: map[string]string{"server": "main", "rule": "backlog"}},
+		{name: "server label", groupBy: []string{"env"}, labels: map[string]string{"env": "prod"}},
+		{name: "rule label over the server one", groupBy: []string{"vhost", "severity"}, labels: map[string]string{"vhost": "orders", "severity": "critical"}},
+		{name: "missing label", groupBy: []string{"team"}, labels: map[string]string{"team": ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if labels := groupLabels(test.groupBy, alert); !reflect.DeepEqual(labels, test.labels) {
+				t.Errorf("groupLabels() = %v, want %v", labels, test.labels)
+			}
+		})
+	}
+}
+
+func TestNotifierDue(t *testing.T) {
+	since := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		now  time.Time
+		all  bool
+		due  bool
+	}{
+		{name: "within the window", now: since.Add(59 * time.Second)},
+		{name: "window elapsed", now: since.Add(time.Minute), due: true},
+		{name: "all", now: since, all: true, due: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newNotifier()
+			n.add(common.Notifications{GroupBy: []string{"server"}}, Alert{Server: common.Server{Description: "main"}, Time: since})
+			due := n.due(time.Minute, test.now, test.all)
+			if (len(due) == 1) != test.due {
+				t.Errorf("due() = %v, want the group due %t", due, test.due)
+			}
+			if remaining := len(n.groups); remaining != 1-len(due) {
+				t.Errorf("%d groups remaining after %d due", remaining, len(due))
+			}
+		})
+	}
+}
+
+// The rules firing together are notified once per group, while their own
+// actions are executed for each of them.
+func TestNotificationsGroupTheFiringRules(t *testing.T) {
+	log := captureLog(t)
+	opts := firingOptions()
+	opts.dryRun = true
+	opts.notifications = common.Notifications{
+		Window:  60000,
+		GroupBy: []string{"server"},
+		Actions: []common.Action{{
+			Description: "notify the group",
+			Cmd:         "notify-group",
+			Args:        []string{"{{len .Alerts}} rules fired on {{.Group.server}}"},
+			Templated:   true,
+		}},
+	}
+	state := NewState()
+	servers := map[string]int{"rabbit-1": 3, "rabbit-2": 1}
+	for description, rules := range servers {
+		for i := 0; i < rules; i++ {
+			rule := firingRule(common.Action{Description: "remediate", Cmd: "remediate"})
+			rule.ID = fmt.Sprintf("%s-%d", description, i)
+			outcome := Outcome{}
+			state.mu.Lock()
+			err := processRule(common.Server{Description: description}, rule, state, opts, common.Log, &outcome)
+			state.mu.Unlock()
+			if err != nil {
+				t.Fatalf("processRule() error = %v", err)
+			}
+			if len(outcome.Actions) != 1 {
+				t.Errorf("rule %s actions = %+v, want its own action", rule.ID, outcome.Actions)
+			}
+		}
+	}
+
+	// The window has not elapsed yet.
+	state.notifier.flush(opts, time.Now(), false)
+	if len(state.notifier.groups) != 2 {
+		t.Fatalf("%d notification groups, want one per server", len(state.notifier.groups))
+	}
+	state.notifier.flush(opts, time.Now().Add(time.Minute), false)
+
+	var sent []string
+	for _, entry := range logEntries(t, log) {
+		if entry["msg"] == "Skipping notification due to dry run" {
+			sent = append(sent, entry["args"].(string))
+		}
+	}
+	sort.Strings(sent)
+	want := []string{"1 rules fired on rabbit-2", "3 rules fired on rabbit-1"}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("notifications = %q, want %q", sent, want)
+	}
+	if len(state.notifier.groups) != 0 {
+		t.Errorf("%d notification groups left after their window", len(state.notifier.groups))
+	}
+}
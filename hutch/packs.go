@@ -0,0 +1,379 @@
+package hutch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/tradeforce/lophutch/management"
+	"github.com/zignd/errors"
+)
+
+// packRule is a rule of a built-in rule pack. Its check returns what it
+// found crossing the thresholds, the rule fires when anything is found.
+type packRule struct {
+	name        string
+	description string
+	thresholds  map[string]float64
+	check       func(c *management.Client, b common.Builtin, now time.Time) ([]string, error)
+}
+
+// packs are the built-in rule packs by name.
+var packs = map[string][]packRule{
+	"nodes": {
+		{
+			name:        "memory-alarm",
+			description: "Node memory alarm or usage close to the high watermark",
+			thresholds:  map[string]float64{"memory_ratio": 0.9},
+			check: nodeCheck(func(n management.Node, t map[string]float64) string {
+				if n.MemAlarm {
+					return fmt.Sprintf("node %s raised the memory alarm", n.Name)
+				}
+				if ratio(n.MemUsed, n.MemLimit) >= t["memory_ratio"] {
+					return fmt.Sprintf("node %s uses %s of its memory limit", n.Name, percent(n.MemUsed, n.MemLimit))
+				}
+				return ""
+			}),
+		},
+		{
+			name:        "disk-alarm",
+			description: "Node disk alarm or free disk space close to the limit",
+			thresholds:  map[string]float64{"disk_free_ratio": 1.5},
+			check: nodeCheck(func(n management.Node, t map[string]float64) string {
+				if n.DiskFreeAlarm {
+					return fmt.Sprintf("node %s raised the disk alarm", n.Name)
+				}
+				if n.DiskFreeLimit > 0 && float64(n.DiskFree) < float64(n.DiskFreeLimit)*t["disk_free_ratio"] {
+					return fmt.Sprintf("node %s has %d bytes of free disk space for a limit of %d", n.Name, n.DiskFree, n.DiskFreeLimit)
+				}
+				return ""
+			}),
+		},
+		{
+			name:        "file-descriptors",
+			description: "Node file descriptors close to exhaustion",
+			thresholds:  map[string]float64{"fd_ratio": 0.9},
+			check: nodeCheck(func(n management.Node, t map[string]float64) string {
+				if ratio(n.FDUsed, n.FDTotal) >= t["fd_ratio"] {
+					return fmt.Sprintf("node %s uses %s of its file descriptors", n.Name, percent(n.FDUsed, n.FDTotal))
+				}
+				return ""
+			}),
+		},
+		{
+			name:        "sockets",
+			description: "Node sockets close to exhaustion",
+			thresholds:  map[string]float64{"sockets_ratio": 0.9},
+			check: nodeCheck(func(n management.Node, t map[string]float64) string {
+				if ratio(n.SocketsUsed, n.SocketsTotal) >= t["sockets_ratio"] {
+					return fmt.Sprintf("node %s uses %s of its sockets", n.Name, percent(n.SocketsUsed, n.SocketsTotal))
+				}
+				return ""
+			}),
+		},
+		{
+			name:        "partitions",
+			description: "Network partition between the nodes",
+			check: nodeCheck(func(n management.Node, t map[string]float64) string {
+				if len(n.Partitions) > 0 {
+					return fmt.Sprintf("node %s is partitioned from %s", n.Name, strings.Join(n.Partitions, ", "))
+				}
+				return ""
+			}),
+		},
+		{
+			name:        "processes",
+			description: "High Erlang process count",
+			thresholds:  map[string]float64{"proc_ratio": 0.8},
+			check: nodeCheck(func(n management.Node, t map[string]float64) string {
+				if ratio(n.ProcUsed, n.ProcTotal) >= t["proc_ratio"] {
+					return fmt.Sprintf("node %s uses %s of its Erlang processes", n.Name, percent(n.ProcUsed, n.ProcTotal))
+				}
+				return ""
+			}),
+		},
+		{
+			name:        "connection-churn",
+			description: "High rate of opened or closed connections",
+			thresholds:  map[string]float64{"churn_rate": 10},
+			check: nodeCheck(func(n management.Node, t map[string]float64) string {
+				opened, closed := n.ConnectionCreatedDetails.Rate, n.ConnectionClosedDetails.Rate
+				if opened >= t["churn_rate"] || closed >= t["churn_rate"] {
+					return fmt.Sprintf("node %s opens %.1f and closes %.1f connections per second", n.Name, opened, closed)
+				}
+				return ""
+			}),
+		},
+	},
+	"queues": {
+		{
+			name:        "no-consumers",
+			description: "Queue with messages and no consumers",
+			thresholds:  map[string]float64{"min_messages": 1},
+			check: queueCheck(func(q management.Queue, t map[string]float64, now time.Time) string {
+				if q.Consumers == 0 && float64(q.Messages) >= t["min_messages"] {
+					return fmt.Sprintf("queue %s has %d messages and no consumers", queueName(q), q.Messages)
+				}
+				return ""
+			}),
+		},
+		{
+			name:        "unacked-growth",
+			description: "Growing number of unacknowledged messages",
+			thresholds:  map[string]float64{"unacked_rate": 1},
+			check: queueCheck(func(q management.Queue, t map[string]float64, now time.Time) string {
+				rate := q.MessagesUnacknowledgedDetails.Rate
+				if rate > 0 && rate >= t["unacked_rate"] {
+					return fmt.Sprintf("queue %s has %d unacknowledged messages growing by %.1f per second", queueName(q), q.MessagesUnacknowledged, rate)
+				}
+				return ""
+			}),
+		},
+		{
+			name:        "length",
+			description: "Queue over a length threshold",
+			thresholds:  map[string]float64{"max_length": 10000},
+			check: queueCheck(func(q management.Queue, t map[string]float64, now time.Time) string {
+				if float64(q.Messages) >= t["max_length"] {
+					return fmt.Sprintf("queue %s has %d messages", queueName(q), q.Messages)
+				}
+				return ""
+			}),
+		},
+		{
+			name:        "age",
+			description: "Queue whose oldest message is over an age threshold",
+			thresholds:  map[string]float64{"max_age": float64(time.Hour / time.Millisecond)},
+			check: queueCheck(func(q management.Queue, t map[string]float64, now time.Time) string {
+				if q.HeadMessageTimestamp == nil || *q.HeadMessageTimestamp <= 0 {
+					return ""
+				}
+				head := time.Unix(*q.HeadMessageTimestamp, 0)
+				if float64(now.Sub(head)/time.Millisecond) >= t["max_age"] {
+					return fmt.Sprintf("queue %s has a message waiting since %s", queueName(q), head.UTC().Format(time.RFC3339))
+				}
+				return ""
+			}),
+		},
+	},
+}
+
+func nodeCheck(f func(n management.Node, t map[string]float64) string) func(*management.Client, common.Builtin, time.Time) ([]string, error) {
+	return func(c *management.Client, b common.Builtin, now time.Time) ([]string, error) {
+		nodes, err := c.Nodes()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list the nodes")
+		}
+		var findings []string
+		for _, node := range nodes {
+			if finding := f(node, b.Thresholds); finding != "" {
+				findings = append(findings, finding)
+			}
+		}
+		return findings, nil
+	}
+}
+
+func queueCheck(f func(q management.Queue, t map[string]float64, now time.Time) string) func(*management.Client, common.Builtin, time.Time) ([]string, error) {
+	return func(c *management.Client, b common.Builtin, now time.Time) ([]string, error) {
+		queues, err := c.Queues(b.Vhost)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to list the queues")
+		}
+		var findings []string
+		for _, queue := range queues {
+			if finding := f(queue, b.Thresholds, now); finding != "" {
+				findings = append(findings, finding)
+			}
+		}
+		return findings, nil
+	}
+}
+
+func ratio(used, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return float64(used) / float64(total)
+}
+
+func percent(used, total int64) string {
+	return fmt.Sprintf("%.0f%%", ratio(used, total)*100)
+}
+
+func queueName(q management.Queue) string {
+	return fmt.Sprintf("%s in %s", q.Name, q.Vhost)
+}
+
+// findPackRule returns the rule of the built-in check, named after its pack
+// and rule, e.g. `nodes/memory-alarm`.
+func findPackRule(check string) (packRule, bool) {
+	parts := strings.SplitN(strings.ToLower(check), "/", 2)
+	if len(parts) != 2 {
+		return packRule{}, false
+	}
+	for _, rule := range packs[parts[0]] {
+		if rule.name == parts[1] {
+			return rule, true
+		}
+	}
+	return packRule{}, false
+}
+
+// packRules returns the rules of the packs enabled on server, whose IDs are
+// the names of their checks followed by the server description so that each
+// server has its own state.
+func packRules(server common.Server, t templates) ([]common.Rule, error) {
+	var rules []common.Rule
+	for _, pack := range server.Packs {
+		available, ok := packs[strings.ToLower(pack.Name)]
+		if !ok {
+			return nil, errors.Errorf("unknown rule pack %s, expected one of %s", pack.Name, strings.Join(packNames(), ", "))
+		}
+		base, err := t.expandRule(pack.Rule)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rule of the rule pack %s", pack.Name)
+		}
+
+		enabled := make(map[string]bool, len(pack.Rules))
+		for _, name := range pack.Rules {
+			enabled[strings.ToLower(name)] = true
+		}
+		known := make(map[string]bool)
+		for _, pr := range available {
+			for name := range pr.thresholds {
+				known[name] = true
+			}
+		}
+		overrides := make(map[string]float64, len(pack.Thresholds))
+		for name, value := range pack.Thresholds {
+			if !known[strings.ToLower(name)] {
+				return nil, errors.Errorf("unknown threshold %s of the rule pack %s", name, pack.Name)
+			}
+			overrides[strings.ToLower(name)] = value
+		}
+
+		for _, pr := range available {
+			if len(pack.Rules) > 0 && !enabled[pr.name] {
+				continue
+			}
+			delete(enabled, pr.name)
+			thresholds := make(map[string]float64, len(pr.thresholds))
+			for name, value := range pr.thresholds {
+				thresholds[name] = value
+				if v, ok := overrides[name]; ok {
+					thresholds[name] = v
+				}
+			}
+
+			check := strings.ToLower(pack.Name) + "/" + pr.name
+			labels := map[string]string{"pack": strings.ToLower(pack.Name)}
+			for k, v := range base.Labels {
+				labels[k] = v
+			}
+			rule := base
+			rule.ID = check + "@" + server.Description
+			if rule.Description == "" {
+				rule.Description = pr.description
+			}
+			rule.Labels = labels
+			rule.Builtin = &common.Builtin{
+				Check:      check,
+				Vhost:      pack.Vhost,
+				Thresholds: thresholds,
+			}
+			rules = append(rules, rule)
+		}
+		for name := range enabled {
+			return nil, errors.Errorf("unknown rule %s of the rule pack %s", name, pack.Name)
+		}
+	}
+	return rules, nil
+}
+
+func packNames() []string {
+	names := make([]string, 0, len(packs))
+	for name := range packs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runBuiltin runs the built-in check b against server, the requests of the
+// management client going through request so that they are recorded and
+// replayed like the requests of the other rules.
+func runBuiltin(server common.Server, b common.Builtin, request requestFunc, now time.Time) ([]string, error) {
+	pr, ok := findPackRule(b.Check)
+	if !ok {
+		return nil, errors.Errorf("unknown built-in check %s", b.Check)
+	}
+	thresholds := make(map[string]float64, len(pr.thresholds))
+	for name, value := range pr.thresholds {
+		thresholds[name] = value
+	}
+	for name, value := range b.Thresholds {
+		thresholds[strings.ToLower(name)] = value
+	}
+	b.Thresholds = thresholds
+
+	client := management.NewWithClient(server, &http.Client{
+		Transport: requestTransport{server: server, request: request},
+	})
+	return pr.check(client, b, now)
+}
+
+// requestTransport performs the GET requests of a management client, and the
+// POST requests peeking the messages of a queue, through a requestFunc.
+type requestTransport struct {
+	server  common.Server
+	request requestFunc
+}
+
+func (t requestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	peek := req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/get")
+	if req.Method != http.MethodGet && !peek {
+		return nil, errors.Errorf("built-in checks can not perform %s requests", req.Method)
+	}
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, errors.Wrap(err, "failed to read the request body")
+		}
+		req.Body.Close()
+	}
+	if peek {
+		var get struct {
+			AckMode string `json:"ackmode"`
+		}
+		if err := json.Unmarshal(body, &get); err != nil || get.AckMode != "ack_requeue_true" {
+			return nil, errors.New("built-in checks can only get the messages of a queue with requeue")
+		}
+	}
+	resp, err := t.request(t.server, common.Request{
+		Method: req.Method,
+		Path:   req.URL.RequestURI(),
+		Format: formatText,
+		Body:   string(body),
+	})
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header, len(resp.Headers))
+	for name, value := range resp.Headers {
+		header.Set(name, value)
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", resp.Status, http.StatusText(resp.Status)),
+		StatusCode: resp.Status,
+		Header:     header,
+		Body:       ioutil.NopCloser(strings.NewReader(resp.Body)),
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,63 @@
+package hutch
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tradeforce/lophutch/common"
+)
+
+func TestPackRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "every rule",
+			rules: nil,
+			want: []string{
+				"nodes/memory-alarm@main", "nodes/disk-alarm@main", "nodes/file-descriptors@main", "nodes/sockets@main",
+				"nodes/partitions@main", "nodes/processes@main", "nodes/connection-churn@main",
+			},
+		},
+		{
+			name:  "one rule",
+			rules: []string{"memory-alarm"},
+			want:  []string{"nodes/memory-alarm@main"},
+		},
+		{
+			name:  "some rules",
+			rules: []string{"Sockets", "disk-alarm"},
+			want:  []string{"nodes/disk-alarm@main", "nodes/sockets@main"},
+		},
+		{
+			name:    "unknown rule",
+			rules:   []string{"memory-alarm", "uptime"},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := common.Server{Description: "main", Packs: []common.Pack{{Name: "nodes", Rules: test.rules}}}
+			rules, err := packRules(server, templates{})
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("packRules() = %d rules, want an error", len(rules))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("packRules() error = %v", err)
+			}
+			var ids []string
+			for _, rule := range rules {
+				ids = append(ids, rule.ID)
+			}
+			if !reflect.DeepEqual(ids, test.want) {
+				t.Errorf("packRules() = %v, want %v", ids, test.want)
+			}
+		})
+	}
+}
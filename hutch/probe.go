@@ -0,0 +1,189 @@
+package hutch
+
+import (
+	"encoding/json"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+const (
+	probeMethod = "AMQP"
+
+	defaultProbePort    = 5672
+	defaultProbeTLSPort = 5671
+	defaultProbeQueue   = "lophutch.probe"
+	defaultProbeTimeout = 5 * time.Second
+)
+
+// probeFunc runs an AMQP probe against a server and returns its result as
+// the body evaluated by the rule.
+type probeFunc func(server common.Server, probe common.Probe) (string, error)
+
+// probeResult is the body evaluated by the rules with a probe, Latency is
+// the round trip of the message in milliseconds.
+type probeResult struct {
+	Success bool    `json:"success"`
+	Latency float64 `json:"latency"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// probeRequest identifies probe as a request, for the fixtures.
+func probeRequest(probe common.Probe) common.Request {
+	path := "/" + url.PathEscape(probeVhost(probe)) + "/" + url.PathEscape(probeQueue(probe))
+	if probe.Port != 0 {
+		path += "?port=" + strconv.Itoa(probe.Port)
+	}
+	return common.Request{Method: probeMethod, Path: path}
+}
+
+func probeVhost(probe common.Probe) string {
+	if probe.Vhost == "" {
+		return "/"
+	}
+	return probe.Vhost
+}
+
+func probeQueue(probe common.Probe) string {
+	if probe.Queue == "" {
+		return defaultProbeQueue
+	}
+	return probe.Queue
+}
+
+// performProbe publishes a message to the probe queue, with publisher
+// confirms, and consumes it back. A failed probe is not an error, it is
+// reported as an unsuccessful result to the evaluator.
+func performProbe(server common.Server, probe common.Probe) (string, error) {
+	start := time.Now()
+	result := probeResult{Success: true}
+	if err := roundTrip(server, probe); err != nil {
+		result = probeResult{Error: err.Error()}
+	}
+	result.Latency = float64(time.Since(start)) / float64(time.Millisecond)
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode the probe result")
+	}
+	return string(b), nil
+}
+
+// amqpURI returns the URI of the AMQP connections to vhost of server on port,
+// 5671 with TLS when the server protocol is `https` and 5672 otherwise when
+// it is zero.
+func amqpURI(server common.Server, port int, vhost string) amqp.URI {
+	uri := amqp.URI{
+		Scheme:   "amqp",
+		Host:     server.Host,
+		Port:     port,
+		Username: server.User,
+		Password: server.Password,
+		Vhost:    vhost,
+	}
+	if server.Protocol == "https" {
+		uri.Scheme = "amqps"
+	}
+	if uri.Port == 0 {
+		uri.Port = defaultProbePort
+		if uri.Scheme == "amqps" {
+			uri.Port = defaultProbeTLSPort
+		}
+	}
+	if uri.Vhost == "" {
+		uri.Vhost = "/"
+	}
+	return uri
+}
+
+func roundTrip(server common.Server, probe common.Probe) error {
+	timeout := probe.Timeout * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	uri := amqpURI(server, probe.Port, probeVhost(probe))
+
+	conn, err := amqp.DialConfig(uri.String(), amqp.Config{
+		Dial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.DialTimeout(network, addr, timeout)
+			if err != nil {
+				return nil, err
+			}
+			// The deadline only covers the handshake, it is cleared once
+			// the connection is open.
+			if err := conn.SetDeadline(deadline); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to %s:%d", uri.Host, uri.Port)
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return errors.Wrap(err, "failed to open a channel")
+	}
+	defer ch.Close()
+
+	queue := probeQueue(probe)
+	if _, err := ch.QueueDeclare(queue, false, false, false, false, nil); err != nil {
+		return errors.Wrapf(err, "failed to declare the probe queue %s", queue)
+	}
+	if err := ch.Confirm(false); err != nil {
+		return errors.Wrap(err, "failed to enable the publisher confirms")
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	deliveries, err := ch.Consume(queue, "", true, false, false, false, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to consume the probe queue %s", queue)
+	}
+
+	id := newID()
+	if err := ch.Publish("", queue, true, false, amqp.Publishing{
+		MessageId: id,
+		Timestamp: time.Now(),
+		Body:      []byte("lophutch probe"),
+	}); err != nil {
+		return errors.Wrapf(err, "failed to publish to the probe queue %s", queue)
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	confirmed, consumed := false, false
+	for !confirmed || !consumed {
+		select {
+		case confirm, ok := <-confirms:
+			if !ok {
+				return errors.New("channel closed before the message was confirmed")
+			}
+			if !confirm.Ack {
+				return errors.New("the message was not acknowledged by the server")
+			}
+			confirmed = true
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return errors.New("channel closed before the message was consumed")
+			}
+			// Messages left by previous probes are discarded.
+			if delivery.MessageId == id {
+				consumed = true
+			}
+		case <-timer.C:
+			return errors.Errorcf(map[string]interface{}{
+				"confirmed": confirmed,
+				"consumed":  consumed,
+			}, "probe timed out after %s", timeout)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package hutch
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+)
+
+// closedPort returns a port nothing listens on.
+func closedPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+func TestPerformProbe(t *testing.T) {
+	tests := []struct {
+		name    string
+		port    func(t *testing.T) int
+		timeout time.Duration
+		success bool
+		err     string
+	}{
+		{
+			name: "success",
+			port: func(t *testing.T) int {
+				return newAMQPStandIn(t, false).port()
+			},
+			success: true,
+		},
+		{
+			name: "timeout",
+			port: func(t *testing.T) int {
+				return newAMQPStandIn(t, true).port()
+			},
+			timeout: 200,
+			err:     "probe timed out after 200ms",
+		},
+		{
+			name:    "connection failure",
+			port:    closedPort,
+			timeout: 200,
+			err:     "failed to connect to 127.0.0.1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := common.Server{Host: "127.0.0.1", User: "guest", Password: "guest"}
+			probe := common.Probe{Port: test.port(t), Queue: "lophutch.test", Timeout: 2000}
+			if test.timeout > 0 {
+				probe.Timeout = test.timeout
+			}
+			body, err := performProbe(server, probe)
+			if err != nil {
+				t.Fatalf("performProbe() error = %v", err)
+			}
+			var result probeResult
+			if err := json.Unmarshal([]byte(body), &result); err != nil {
+				t.Fatalf("performProbe() = %s, not a probe result: %v", body, err)
+			}
+			if result.Success != test.success || !strings.Contains(result.Error, test.err) {
+				t.Errorf("performProbe() = %+v, want success %t and error %q", result, test.success, test.err)
+			}
+			if result.Latency <= 0 {
+				t.Errorf("performProbe() latency = %g, want a positive latency", result.Latency)
+			}
+		})
+	}
+}
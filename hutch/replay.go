@@ -0,0 +1,311 @@
+package hutch
+
+import (
+	"net"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/tradeforce/lophutch/common"
+	"github.com/tradeforce/lophutch/management"
+	"github.com/zignd/errors"
+)
+
+const (
+	defaultReplayCount    = 100
+	defaultReplayRate     = 10
+	defaultReplayTruncate = 256
+	defaultReplayTimeout  = 10 * time.Second
+
+	defaultExchange = "amq.default"
+)
+
+// replayOptions are the options of the `replay_dead_letters` built-in action.
+// Rate is the number of messages moved per second, Port the AMQP port of the
+// server as for the probes, and DryRun lists the messages that would be moved
+// without moving them. Truncate and Redact apply to the payloads reported
+// with the errors, as to the sampled dead letters, whose settings they
+// default to.
+type replayOptions struct {
+	Vhost    string
+	Queue    string
+	Count    int
+	Rate     float64
+	Port     int
+	Truncate int
+	Redact   []string
+	DryRun   bool `mapstructure:"dry_run"`
+}
+
+// replayDeadLetters is the `replay_dead_letters` built-in action, which moves
+// up to Count messages of a dead-letter queue, the one sampled by the rule by
+// default, back to the exchange and routing key they were published with
+// according to their `x-death` header. The messages that can not be moved
+// are put back at the end of the queue. The messages are fetched through
+// AMQP and only acknowledged once the server confirmed their publishing, so
+// that a message is never lost, at worst moved twice.
+func replayDeadLetters(action common.Action, ctx actionContext, logger *common.Logger) error {
+	options := replayOptions{Count: defaultReplayCount, Rate: defaultReplayRate, Truncate: defaultReplayTruncate}
+	if cfg := ctx.rule.DeadLetters; cfg != nil {
+		if cfg.Truncate > 0 {
+			options.Truncate = cfg.Truncate
+		}
+		options.Redact = cfg.Redact
+	}
+	if err := decodeOptions(action.Options, &options); err != nil {
+		return err
+	}
+	if options.Queue == "" && ctx.outcome.DeadLetters != nil {
+		options.Vhost = ctx.outcome.DeadLetters.Vhost
+		options.Queue = ctx.outcome.DeadLetters.Queue
+	}
+	if options.Queue == "" {
+		return errors.New("the queue option is required when the rule does not sample dead letters")
+	}
+	if options.Count <= 0 || options.Rate <= 0 {
+		return errors.Errorf("the count and rate options must be positive, got %d and %g", options.Count, options.Rate)
+	}
+	logger = logger.With(common.Fields{"vhost": options.Vhost, "queue": options.Queue})
+
+	client := management.New(ctx.server)
+	queue, err := client.Queue(options.Vhost, options.Queue)
+	if err != nil {
+		return errors.Wrapf(err, "failed to retrieve the queue %s", options.Queue)
+	}
+	// The messages put back at the end of the queue are not moved again.
+	count := options.Count
+	if ready := int(queue.MessagesReady); ready < count {
+		count = ready
+	}
+
+	if options.DryRun {
+		messages, err := client.GetMessages(options.Vhost, options.Queue, management.GetOptions{Count: count, Requeue: true})
+		if err != nil {
+			return errors.Wrapf(err, "failed to get the messages of the queue %s", options.Queue)
+		}
+		for i, message := range messages {
+			exchange, routingKey, reason := replayTarget(xDeath(message))
+			messageLogger := logger.With(common.Fields{"message": i + 1})
+			if reason != "" {
+				messageLogger.With(common.Fields{"reason": reason}).Info("Would skip the message")
+				continue
+			}
+			messageLogger.With(common.Fields{"exchange": exchange, "routing_key": routingKey}).Info("Would move the message")
+		}
+		logger.With(common.Fields{"listed": len(messages)}).Info("Listed the dead letters")
+		return nil
+	}
+	if count == 0 {
+		logger.With(common.Fields{"moved": 0, "skipped": 0}).Info("Replayed the dead letters")
+		return nil
+	}
+
+	r, err := newReplayer(ctx.server, options)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	interval := time.Duration(float64(time.Second) / options.Rate)
+	moved, skipped := 0, 0
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		delivery, ok, err := r.ch.Get(options.Queue, false)
+		if err != nil {
+			return errors.Wrapcf(err, map[string]interface{}{
+				"moved":   moved,
+				"skipped": skipped,
+			}, "failed to get a message of the queue %s", options.Queue)
+		}
+		if !ok {
+			break
+		}
+		messageLogger := logger.With(common.Fields{"message": i + 1})
+
+		exchange, routingKey, reason := replayTarget(deliveryDeaths(delivery))
+		if reason == "" {
+			routed, err := r.publish(exchange, routingKey, delivery)
+			switch {
+			case err != nil:
+				reason = err.Error()
+			case !routed:
+				reason = "not routed"
+			default:
+				if err := delivery.Ack(false); err != nil {
+					return errors.Wrapcf(err, r.context(delivery, moved, skipped), "failed to acknowledge a moved message of the queue %s", options.Queue)
+				}
+				moved++
+				messageLogger.With(common.Fields{"exchange": exchange, "routing_key": routingKey}).Info("Moved the message")
+				continue
+			}
+		}
+
+		if _, err := r.publish(defaultExchange, options.Queue, delivery); err != nil {
+			// The message is left unacknowledged, the server requeues it.
+			return errors.Wrapcf(err, r.context(delivery, moved, skipped), "failed to put a skipped message back into the queue %s", options.Queue)
+		}
+		if err := delivery.Ack(false); err != nil {
+			return errors.Wrapcf(err, r.context(delivery, moved, skipped), "failed to acknowledge a skipped message of the queue %s", options.Queue)
+		}
+		skipped++
+		messageLogger.With(common.Fields{"reason": reason}).Warn("Skipped the message")
+	}
+
+	logger.With(common.Fields{"moved": moved, "skipped": skipped}).Info("Replayed the dead letters")
+	return nil
+}
+
+// replayer moves messages over an AMQP channel with publisher confirms.
+type replayer struct {
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	options  replayOptions
+}
+
+func newReplayer(server common.Server, options replayOptions) (*replayer, error) {
+	uri := amqpURI(server, options.Port, options.Vhost)
+	conn, err := amqp.DialConfig(uri.String(), amqp.Config{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout(network, addr, defaultReplayTimeout)
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s:%d", uri.Host, uri.Port)
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to open a channel")
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to enable the publisher confirms")
+	}
+	return &replayer{
+		conn:     conn,
+		ch:       ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  ch.NotifyReturn(make(chan amqp.Return, 1)),
+		options:  options,
+	}, nil
+}
+
+func (r *replayer) close() {
+	r.conn.Close()
+}
+
+// publish publishes delivery to exchange with routingKey and waits for the
+// server to confirm it, reporting whether it was routed to a queue.
+func (r *replayer) publish(exchange, routingKey string, delivery amqp.Delivery) (bool, error) {
+	if exchange == defaultExchange {
+		exchange = ""
+	}
+	err := r.ch.Publish(exchange, routingKey, true, false, amqp.Publishing{
+		Headers:         delivery.Headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		Expiration:      delivery.Expiration,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		UserId:          delivery.UserId,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "failed to publish the message")
+	}
+
+	timer := time.NewTimer(defaultReplayTimeout)
+	defer timer.Stop()
+	select {
+	case confirm, ok := <-r.confirms:
+		if !ok {
+			return false, errors.New("channel closed before the message was confirmed")
+		}
+		if !confirm.Ack {
+			return false, errors.New("the message was not acknowledged by the server")
+		}
+	case <-timer.C:
+		return false, errors.Errorf("the message was not confirmed after %s", defaultReplayTimeout)
+	}
+	// The server returns an unroutable message before confirming it.
+	select {
+	case <-r.returns:
+		return false, nil
+	default:
+		return true, nil
+	}
+}
+
+// context describes delivery for the errors, its payload truncated and
+// redacted as the one of the sampled dead letters.
+func (r *replayer) context(delivery amqp.Delivery, moved, skipped int) map[string]interface{} {
+	body := delivery.Body
+	if r.options.Truncate > 0 && len(body) > r.options.Truncate {
+		body = body[:r.options.Truncate]
+	}
+	return map[string]interface{}{
+		"moved":         moved,
+		"skipped":       skipped,
+		"message_id":    delivery.MessageId,
+		"payload_bytes": len(delivery.Body),
+		"payload": redactPayload(management.Message{
+			Payload:         string(body),
+			PayloadEncoding: "string",
+		}, r.options.Redact),
+	}
+}
+
+// deliveryDeaths returns the entries of the `x-death` header of delivery,
+// the most recent first.
+func deliveryDeaths(delivery amqp.Delivery) []deadLetter {
+	entries, _ := delivery.Headers["x-death"].([]interface{})
+	deaths := make([]deadLetter, 0, len(entries))
+	for _, entry := range entries {
+		fields, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+		death := deadLetter{}
+		death.Queue, _ = fields["queue"].(string)
+		death.Reason, _ = fields["reason"].(string)
+		death.Exchange, _ = fields["exchange"].(string)
+		if count, ok := fields["count"].(int64); ok {
+			death.Count = int(count)
+		}
+		death.Time, _ = fields["time"].(time.Time)
+		keys, _ := fields["routing-keys"].([]interface{})
+		for _, key := range keys {
+			if key, ok := key.(string); ok {
+				death.RoutingKeys = append(death.RoutingKeys, key)
+			}
+		}
+		deaths = append(deaths, death)
+	}
+	return deaths
+}
+
+// replayTarget returns the exchange and routing key a message with the
+// deaths of its `x-death` header is moved to, or why it can not be moved.
+func replayTarget(deaths []deadLetter) (string, string, string) {
+	if len(deaths) == 0 {
+		return "", "", "no x-death header"
+	}
+	death := deaths[0]
+	if len(death.RoutingKeys) == 0 {
+		return "", "", "no routing key in the x-death header"
+	}
+	exchange := death.Exchange
+	if exchange == "" {
+		exchange = defaultExchange
+	}
+	return exchange, death.RoutingKeys[0], ""
+}
@@ -0,0 +1,175 @@
+package hutch
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// deadLetterMessage returns a message dead-lettered from the orders queue,
+// after being published to exchange with routingKey, or without an `x-death`
+// header when routingKey is empty.
+func deadLetterMessage(id, exchange, routingKey, body string) standInMessage {
+	headers := map[string]interface{}{}
+	if routingKey != "" {
+		headers["x-death"] = []interface{}{map[string]interface{}{
+			"count":        int64(1),
+			"exchange":     exchange,
+			"queue":        "orders",
+			"reason":       "rejected",
+			"routing-keys": []interface{}{routingKey},
+			"time":         time.Unix(1697700000, 0),
+		}}
+	}
+	return standInMessage{routingKey: "orders.dlq", properties: amqpProperties(id, headers), body: []byte(body)}
+}
+
+// replayServer returns the server of a Management API stand-in reporting
+// ready messages in its queues.
+func replayServer(t *testing.T, ready int) common.Server {
+	t.Helper()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"name": "orders.dlq", "vhost": "/", "messages_ready": %d}`, ready)
+	}))
+	t.Cleanup(api.Close)
+	u, err := url.Parse(api.URL)
+	if err != nil {
+		t.Fatalf("invalid address %s: %v", api.URL, err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	return common.Server{Protocol: "http", Host: "127.0.0.1", Port: port, User: "guest", Password: "guest"}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []standInMessage
+		reject   bool
+		orders   []string
+		dlq      []string
+		err      string
+	}{
+		{
+			name: "moved and skipped",
+			messages: []standInMessage{
+				deadLetterMessage("1", "orders-x", "orders", `{"order":1}`),
+				deadLetterMessage("2", "", "", `{"order":2}`),
+				deadLetterMessage("3", "", "missing", `{"order":3}`),
+				deadLetterMessage("4", "", "orders", `{"order":4}`),
+			},
+			orders: []string{`{"order":1}`, `{"order":4}`},
+			dlq:    []string{`{"order":2}`, `{"order":3}`},
+		},
+		{
+			// The message is kept in the queue when it can be neither moved
+			// nor put back.
+			name:     "rejected publishings",
+			messages: []standInMessage{deadLetterMessage("1", "orders-x", "orders", `{"order":1,"card":"4111"}`)},
+			reject:   true,
+			dlq:      []string{`{"order":1,"card":"4111"}`},
+			err:      "failed to put a skipped message back into the queue orders.dlq",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			broker := newAMQPStandIn(t, false)
+			broker.declare("orders")
+			broker.declare("orders.dlq", test.messages...)
+			broker.bind("orders-x", "orders", "orders")
+			if test.reject {
+				broker.rejectPublishings()
+			}
+
+			action := common.Action{Builtin: "replay_dead_letters", Options: map[string]interface{}{
+				"queue": "orders.dlq",
+				"vhost": "/",
+				"port":  broker.port(),
+				"rate":  1000,
+			}}
+			rule := common.Rule{ID: "dead-letters", DeadLetters: &common.DeadLetters{Queue: "orders.dlq", Redact: []string{"card"}}}
+			ctx := actionContext{server: replayServer(t, len(test.messages)), rule: rule, outcome: &Outcome{}}
+			err := replayDeadLetters(action, ctx, common.Log)
+			if test.err == "" && err != nil {
+				t.Fatalf("replayDeadLetters() error = %v", err)
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("replayDeadLetters() error = %v, want %q", err, test.err)
+				}
+				// The payload is redacted in the context of the error.
+				e, ok := err.(*errors.Error)
+				if !ok {
+					t.Fatalf("replayDeadLetters() error = %T, want a wrapped error", err)
+				}
+				want := map[string]interface{}{"order": float64(1), "card": redacted}
+				if !reflect.DeepEqual(e.Context["payload"], want) {
+					t.Errorf("replayDeadLetters() error payload = %v, want %v", e.Context["payload"], want)
+				}
+			}
+
+			if got := broker.bodies(t, "orders"); !reflect.DeepEqual(got, test.orders) {
+				t.Errorf("orders = %q, want %q", got, test.orders)
+			}
+			if got := broker.bodies(t, "orders.dlq"); !reflect.DeepEqual(got, test.dlq) {
+				t.Errorf("orders.dlq = %q, want %q", got, test.dlq)
+			}
+		})
+	}
+}
+
+func TestReplayDeadLettersReleasesTheStateLock(t *testing.T) {
+	broker := newAMQPStandIn(t, false)
+	broker.declare("orders")
+	broker.declare("orders.dlq",
+		deadLetterMessage("1", "", "orders", `{"order":1}`),
+		deadLetterMessage("2", "", "orders", `{"order":2}`),
+	)
+	rule := firingRule(common.Action{Builtin: "replay_dead_letters", Options: map[string]interface{}{
+		"queue": "orders.dlq",
+		"port":  broker.port(),
+		"rate":  2,
+	}})
+	server := replayServer(t, 2)
+	state := NewState()
+	done := make(chan error, 1)
+	go func() {
+		outcome := Outcome{}
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		done <- processRule(server, rule, state, firingOptions(), common.Log, &outcome)
+	}()
+
+	// The state is available while the replay waits between the messages.
+	deadline := time.Now().Add(5 * time.Second)
+	for broker.length("orders") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the first message was not moved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !state.mu.TryLock() {
+		t.Fatal("the state is locked while the dead letters are replayed")
+	}
+	moved := broker.length("orders")
+	state.mu.Unlock()
+	if moved != 1 {
+		t.Errorf("%d messages moved once the state was locked, want the replay in progress", moved)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("processRule() error = %v", err)
+	}
+	if got, want := broker.bodies(t, "orders"), []string{`{"order":1}`, `{"order":2}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("orders = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,82 @@
+package hutch
+
+import (
+	"strings"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// requirement is a condition on a label of a selector: `key=value`,
+// `key!=value`, `key`, which requires the label, or `!key`, which requires
+// its absence.
+type requirement struct {
+	key    string
+	value  string
+	negate bool
+	exists bool
+}
+
+// selector matches the labels satisfying every one of its requirements, an
+// empty selector matches any labels.
+type selector []requirement
+
+// parseSelector parses the comma separated requirements of s.
+func parseSelector(s string) (selector, error) {
+	var sel selector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var req requirement
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			req = requirement{key: kv[0], value: kv[1], negate: true}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			req = requirement{key: kv[0], value: kv[1]}
+		case strings.HasPrefix(part, "!"):
+			req = requirement{key: part[1:], exists: true, negate: true}
+		default:
+			req = requirement{key: part, exists: true}
+		}
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if req.key == "" {
+			return nil, errors.Errorf("invalid requirement `%s` in selector `%s`", part, s)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+func (s selector) matches(labels map[string]string) bool {
+	for _, req := range s {
+		value, ok := labels[req.key]
+		if req.exists {
+			if ok == req.negate {
+				return false
+			}
+			continue
+		}
+		if (ok && value == req.value) == req.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleLabels returns the labels of server with the ones of rule, which take
+// precedence.
+func ruleLabels(server common.Server, rule common.Rule) map[string]string {
+	labels := make(map[string]string, len(server.Labels)+len(rule.Labels))
+	for k, v := range server.Labels {
+		labels[k] = v
+	}
+	for k, v := range rule.Labels {
+		labels[k] = v
+	}
+	return labels
+}
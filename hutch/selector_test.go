@@ -0,0 +1,149 @@
+package hutch
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/tradeforce/lophutch/discovery"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     selector
+		invalid  bool
+	}{
+		{selector: ""},
+		{selector: " , "},
+		{
+			selector: "env=prod, team = payments",
+			want:     selector{{key: "env", value: "prod"}, {key: "team", value: "payments"}},
+		},
+		{selector: "env!=dev", want: selector{{key: "env", value: "dev", negate: true}}},
+		{selector: "vhost", want: selector{{key: "vhost", exists: true}}},
+		{selector: "!canary", want: selector{{key: "canary", exists: true, negate: true}}},
+		{selector: "env=", want: selector{{key: "env"}}},
+		{selector: "query=a=b", want: selector{{key: "query", value: "a=b"}}},
+		{selector: "=prod", invalid: true},
+		{selector: "env=prod, !=dev", invalid: true},
+		{selector: "!", invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			sel, err := parseSelector(test.selector)
+			if (err != nil) != test.invalid {
+				t.Fatalf("parseSelector() error = %v, want an error %t", err, test.invalid)
+			}
+			if !reflect.DeepEqual(sel, test.want) {
+				t.Errorf("parseSelector() = %+v, want %+v", sel, test.want)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"env": "prod", "team": "payments", "vhost": ""}
+	tests := []struct {
+		selector string
+		matches  bool
+	}{
+		{selector: "", matches: true},
+		{selector: "env=prod", matches: true},
+		{selector: "env=prod, team=payments", matches: true},
+		{selector: "env=prod, team=orders"},
+		{selector: "env!=dev", matches: true},
+		{selector: "env!=prod"},
+		{selector: "region!=eu", matches: true},
+		{selector: "team", matches: true},
+		{selector: "vhost", matches: true},
+		{selector: "region"},
+		{selector: "!region", matches: true},
+		{selector: "!team"},
+		{selector: "region="},
+		{selector: "vhost=", matches: true},
+	}
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			sel, err := parseSelector(test.selector)
+			if err != nil {
+				t.Fatalf("parseSelector() error = %v", err)
+			}
+			if matches := sel.matches(labels); matches != test.matches {
+				t.Errorf("matches() = %t, want %t", matches, test.matches)
+			}
+		})
+	}
+}
+
+func TestRuleLabels(t *testing.T) {
+	server := common.Server{Labels: map[string]string{"env": "prod", "vhost": "/"}}
+	rule := common.Rule{Labels: map[string]string{"vhost": "orders", "severity": "critical"}}
+	want := map[string]string{"env": "prod", "vhost": "orders", "severity": "critical"}
+	if labels := ruleLabels(server, rule); !reflect.DeepEqual(labels, want) {
+		t.Errorf("ruleLabels() = %v, want %v", labels, want)
+	}
+	if server.Labels["vhost"] != "/" {
+		t.Errorf("ruleLabels() modified the labels of the server: %v", server.Labels)
+	}
+}
+
+// The rules of the `rules` setting are attached to each server matched by
+// their selector, with their own ID.
+func TestAttachRules(t *testing.T) {
+	configure(t, `
+servers:
+- description: payments
+  labels:
+    env: prod
+    team: payments
+  rules:
+  - id: own
+- description: orders
+  labels:
+    env: prod
+    team: orders
+- description: staging
+  labels:
+    env: staging
+rules:
+- id: backlog
+  selector: env=prod
+- id: payments-consumers
+  selector: env=prod, team=payments
+- id: everywhere
+- id: unlabeled
+  selector: "!env"
+`)
+	servers, err := getServers(discovery.New())
+	if err != nil {
+		t.Fatalf("getServers() error = %v", err)
+	}
+	rules := make(map[string][]string)
+	for _, server := range servers {
+		for _, rule := range server.Rules {
+			rules[server.Description] = append(rules[server.Description], rule.ID)
+		}
+	}
+	want := map[string][]string{
+		"payments": {"own", "backlog@payments", "payments-consumers@payments", "everywhere@payments"},
+		"orders":   {"backlog@orders", "everywhere@orders"},
+		"staging":  {"everywhere@staging"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules = %v, want %v", rules, want)
+	}
+}
+
+func TestAttachRulesInvalidSelector(t *testing.T) {
+	configure(t, `
+servers:
+- description: main
+rules:
+- id: backlog
+  selector: "=prod"
+`)
+	if _, err := getServers(discovery.New()); err == nil {
+		t.Error("getServers() error = nil, want the invalid selector")
+	}
+}
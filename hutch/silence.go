@@ -0,0 +1,212 @@
+package hutch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+const silencesFile = "silences.json"
+
+// silenceStore persists the silences created at runtime, through the HTTP API
+// or the `silence` command, so that they survive restarts.
+type silenceStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newSilenceStore(dir string) *silenceStore {
+	return &silenceStore{path: filepath.Join(dir, silencesFile)}
+}
+
+// load returns the persisted silences, a missing file means there are none.
+func (s *silenceStore) load() ([]common.Silence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+func (s *silenceStore) read() ([]common.Silence, error) {
+	var silences []common.Silence
+	if err := readJSON(s.path, &silences); err != nil {
+		if _, statErr := os.Stat(s.path); os.IsNotExist(statErr) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read the silences from %s", s.path)
+	}
+	return silences, nil
+}
+
+// write replaces the persisted silences, the file is renamed into place so
+// that a concurrent read never sees a partial write.
+func (s *silenceStore) write(silences []common.Silence) error {
+	if err := writeAtomic(s.path, silences); err != nil {
+		return errors.Wrap(err, "failed to persist the silences")
+	}
+	return nil
+}
+
+// add validates and persists silence, its ID and creation time are set by
+// the store.
+func (s *silenceStore) add(silence common.Silence) (common.Silence, error) {
+	silence.ID = newID()
+	silence.CreatedAt = time.Now()
+	if silence.Start.IsZero() {
+		silence.Start = silence.CreatedAt
+	}
+	if err := validateSilence(silence); err != nil {
+		return silence, errors.Wrap(err, "invalid silence")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	silences, err := s.read()
+	if err != nil {
+		return silence, err
+	}
+	if err := s.write(append(silences, silence)); err != nil {
+		return silence, err
+	}
+
+	common.Log.With(silenceFields(silence)).Info("Silence created")
+
+	return silence, nil
+}
+
+// expire ends the silence identified by id now. The silence is kept so that
+// who created and expired it can still be audited.
+func (s *silenceStore) expire(id, by string) (common.Silence, error) {
+	if by == "" {
+		return common.Silence{}, errors.New("who is expiring the silence is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	silences, err := s.read()
+	if err != nil {
+		return common.Silence{}, err
+	}
+	for i, silence := range silences {
+		if silence.ID != id {
+			continue
+		}
+		now := time.Now()
+		if silence.End.After(now) {
+			silence.End = now
+		}
+		silence.ExpiredBy = by
+		silences[i] = silence
+		if err := s.write(silences); err != nil {
+			return silence, err
+		}
+		common.Log.With(silenceFields(silence)).Info("Silence expired")
+		return silence, nil
+	}
+	return common.Silence{}, errors.Errorf("silence %s not found", id)
+}
+
+func silenceFields(silence common.Silence) common.Fields {
+	return common.Fields{
+		"silence":    silence.ID,
+		"created_by": silence.CreatedBy,
+		"reason":     silence.Reason,
+		"start":      silence.Start.Format(time.RFC3339),
+		"end":        silence.End.Format(time.RFC3339),
+		"expired_by": silence.ExpiredBy,
+	}
+}
+
+func validateSilence(silence common.Silence) error {
+	if silence.Server == "" && silence.Rule == "" && len(silence.Labels) == 0 {
+		return errors.New("at least one of server, rule or labels must be provided")
+	}
+	if !silence.End.After(silence.Start) {
+		return errors.Errorf("end %s must be after start %s", silence.End.Format(time.RFC3339), silence.Start.Format(time.RFC3339))
+	}
+	if silence.CreatedBy == "" {
+		return errors.New("who is creating the silence is required")
+	}
+	if silence.Reason == "" {
+		return errors.New("the reason of the silence is required")
+	}
+	return nil
+}
+
+// getSilences returns the silences of the configuration file followed by the
+// persisted ones.
+func getSilences(store *silenceStore) ([]common.Silence, error) {
+	var silences []common.Silence
+	if err := common.UnmarshalKey("Silences", &silences); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal the `Silences` setting")
+	}
+	for i := range silences {
+		if silences[i].ID == "" {
+			silences[i].ID = fmt.Sprintf("config-%d", i)
+		}
+	}
+	persisted, err := store.load()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load the persisted silences")
+	}
+	return append(silences, persisted...), nil
+}
+
+// matchSilence returns the first of silences that is active at now and
+// matches the rule of server.
+func matchSilence(silences []common.Silence, server common.Server, rule common.Rule, now time.Time) (common.Silence, bool) {
+	for _, silence := range silences {
+		if now.Before(silence.Start) || !now.Before(silence.End) {
+			continue
+		}
+		if silence.Server != "" && silence.Server != server.Description {
+			continue
+		}
+		if silence.Rule != "" && silence.Rule != rule.ID {
+			continue
+		}
+		labels := ruleLabels(server, rule)
+		matched := true
+		for k, v := range silence.Labels {
+			if labels[k] != v {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return silence, true
+		}
+	}
+	return common.Silence{}, false
+}
+
+// AddSilence persists silence so that it is taken into account by the
+// following scouts.
+func AddSilence(silence common.Silence) (common.Silence, error) {
+	return newSilenceStore(common.StateDir()).add(silence)
+}
+
+// ExpireSilence ends the persisted silence identified by id.
+func ExpireSilence(id, by string) (common.Silence, error) {
+	return newSilenceStore(common.StateDir()).expire(id, by)
+}
+
+// ListSilences writes the configured and persisted silences to w as JSON.
+func ListSilences(w io.Writer) error {
+	silences, err := getSilences(newSilenceStore(common.StateDir()))
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(silences); err != nil {
+		return errors.Wrap(err, "failed to encode the silences")
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package hutch
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/tradeforce/lophutch/common"
+)
+
+func TestMatchSilence(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	server := common.Server{Description: "main", Labels: map[string]string{"env": "prod"}}
+	rule := common.Rule{ID: "backlog", Labels: map[string]string{"vhost": "orders"}}
+	tests := []struct {
+		name    string
+		silence common.Silence
+		now     time.Time
+		matched bool
+	}{
+		{name: "server", silence: common.Silence{Server: "main"}, now: start, matched: true},
+		{name: "other server", silence: common.Silence{Server: "other"}, now: start},
+		{name: "rule", silence: common.Silence{Rule: "backlog"}, now: start, matched: true},
+		{name: "other rule", silence: common.Silence{Rule: "consumers"}, now: start},
+		{name: "server label", silence: common.Silence{Labels: map[string]string{"env": "prod"}}, now: start, matched: true},
+		{
+			name:    "server and rule labels",
+			silence: common.Silence{Labels: map[string]string{"env": "prod", "vhost": "orders"}},
+			now:     start,
+			matched: true,
+		},
+		{name: "other label", silence: common.Silence{Labels: map[string]string{"env": "dev"}}, now: start},
+		{name: "every matcher", silence: common.Silence{Server: "main", Rule: "backlog", Labels: map[string]string{"vhost": "orders"}}, now: start, matched: true},
+		{name: "one matcher differs", silence: common.Silence{Server: "main", Rule: "consumers"}, now: start},
+		{name: "before the start", silence: common.Silence{Server: "main"}, now: start.Add(-time.Second)},
+		{name: "before the end", silence: common.Silence{Server: "main"}, now: end.Add(-time.Second), matched: true},
+		{name: "at the end", silence: common.Silence{Server: "main"}, now: end},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			silence := test.silence
+			silence.ID, silence.Start, silence.End = "silence-1", start, end
+			_, matched := matchSilence([]common.Silence{silence}, server, rule, test.now)
+			if matched != test.matched {
+				t.Errorf("matchSilence() = %t, want %t", matched, test.matched)
+			}
+		})
+	}
+}
+
+func TestSilenceStoreAddValidation(t *testing.T) {
+	end := time.Now().Add(time.Hour)
+	valid := common.Silence{Rule: "backlog", End: end, CreatedBy: "alice", Reason: "upgrade"}
+	tests := []struct {
+		name   string
+		modify func(s *common.Silence)
+		err    string
+	}{
+		{name: "no matcher", modify: func(s *common.Silence) { s.Rule = "" }, err: "at least one of server, rule or labels"},
+		{name: "end before start", modify: func(s *common.Silence) { s.Start = end.Add(time.Minute) }, err: "must be after start"},
+		{name: "no end", modify: func(s *common.Silence) { s.End = time.Time{} }, err: "must be after start"},
+		{name: "no author", modify: func(s *common.Silence) { s.CreatedBy = "" }, err: "who is creating the silence"},
+		{name: "no reason", modify: func(s *common.Silence) { s.Reason = "" }, err: "the reason of the silence"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newSilenceStore(t.TempDir())
+			silence := valid
+			test.modify(&silence)
+			if _, err := store.add(silence); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("add() error = %v, want %q", err, test.err)
+			}
+			if silences, err := store.load(); err != nil || len(silences) > 0 {
+				t.Errorf("load() = %+v, %v, want no silence persisted", silences, err)
+			}
+		})
+	}
+}
+
+// The silences survive restarts, and the expired ones are kept for their
+// audit.
+func TestSilenceStore(t *testing.T) {
+	dir := t.TempDir()
+	before := time.Now()
+	added, err := newSilenceStore(dir).add(common.Silence{
+		Server:    "main",
+		End:       before.Add(time.Hour),
+		CreatedBy: "alice",
+		Reason:    "upgrade",
+	})
+	if err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	if added.ID == "" || added.CreatedAt.Before(before) || !added.Start.Equal(added.CreatedAt) {
+		t.Errorf("add() = %+v, want an ID, and the creation time as start", added)
+	}
+
+	store := newSilenceStore(dir)
+	silences, err := store.load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if len(silences) != 1 || silences[0].ID != added.ID || silences[0].CreatedBy != "alice" || silences[0].Reason != "upgrade" {
+		t.Fatalf("load() = %+v, want the added silence", silences)
+	}
+
+	if _, err := store.expire(added.ID, ""); err == nil {
+		t.Error("expire() error = nil, want who is expiring the silence to be required")
+	}
+	if _, err := store.expire("unknown", "bob"); err == nil {
+		t.Error("expire() error = nil, want the unknown silence")
+	}
+	expired, err := store.expire(added.ID, "bob")
+	if err != nil {
+		t.Fatalf("expire() error = %v", err)
+	}
+	if expired.ExpiredBy != "bob" || expired.End.After(time.Now()) {
+		t.Errorf("expire() = %+v, want the silence ended by bob", expired)
+	}
+	if _, matched := matchSilence([]common.Silence{expired}, common.Server{Description: "main"}, common.Rule{}, time.Now()); matched {
+		t.Error("the expired silence still matches")
+	}
+
+	// Expiring an ended silence keeps its end.
+	again, err := store.expire(added.ID, "carol")
+	if err != nil {
+		t.Fatalf("expire() error = %v", err)
+	}
+	if !again.End.Equal(expired.End) || again.ExpiredBy != "carol" {
+		t.Errorf("expire() = %+v, want the end %s kept", again, expired.End)
+	}
+
+	silences, err = newSilenceStore(dir).load()
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if len(silences) != 1 || silences[0].ExpiredBy != "carol" || silences[0].CreatedBy != "alice" {
+		t.Errorf("load() = %+v, want the expired silence with its audit", silences)
+	}
+}
+
+func TestGetSilences(t *testing.T) {
+	configure(t, `
+silences:
+- rule: backlog
+  start: 2024-01-01T12:00:00Z
+  end: 2024-01-01T14:00:00Z
+  created_by: alice
+  reason: upgrade
+- id: maintenance
+  labels:
+    env: prod
+  start: "2024-01-02T00:00:00+01:00"
+  end: "2024-01-03T00:00:00+01:00"
+  created_by: bob
+  reason: maintenance window
+`)
+	store := newSilenceStore(viper.GetString("state-dir"))
+	persisted, err := store.add(common.Silence{Server: "main", End: time.Now().Add(time.Hour), CreatedBy: "carol", Reason: "incident"})
+	if err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+
+	silences, err := getSilences(store)
+	if err != nil {
+		t.Fatalf("getSilences() error = %v", err)
+	}
+	want := []common.Silence{
+		{
+			ID:        "config-0",
+			Rule:      "backlog",
+			Start:     time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+			End:       time.Date(2024, 1, 1, 14, 0, 0, 0, time.UTC),
+			CreatedBy: "alice",
+			Reason:    "upgrade",
+		},
+		{
+			ID:        "maintenance",
+			Labels:    map[string]string{"env": "prod"},
+			Start:     time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC),
+			End:       time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC),
+			CreatedBy: "bob",
+			Reason:    "maintenance window",
+		},
+	}
+	if len(silences) != 3 {
+		t.Fatalf("getSilences() = %+v, want the configured silences followed by the persisted one", silences)
+	}
+	for i, silence := range silences[:2] {
+		if !silence.Start.Equal(want[i].Start) || !silence.End.Equal(want[i].End) {
+			t.Errorf("silence %d window = %s to %s, want %s to %s", i, silence.Start, silence.End, want[i].Start, want[i].End)
+		}
+		silence.Start, silence.End = want[i].Start, want[i].End
+		if !reflect.DeepEqual(silence, want[i]) {
+			t.Errorf("silence %d = %+v, want %+v", i, silence, want[i])
+		}
+	}
+	if silences[2].ID != persisted.ID {
+		t.Errorf("silence 2 = %+v, want the persisted %s", silences[2], persisted.ID)
+	}
+}
+
+// A silenced rule is evaluated, but its actions are not executed.
+func TestProcessSilencedRule(t *testing.T) {
+	executed := 0
+	withBuiltin(t, "count", func(action common.Action, ctx actionContext, logger *common.Logger) error {
+		executed++
+		return nil
+	})
+	opts := firingOptions()
+	opts.silences = []common.Silence{{
+		ID:    "silence-1",
+		Rule:  "rule-1",
+		Start: time.Now().Add(-time.Minute),
+		End:   time.Now().Add(time.Hour),
+	}}
+	state := NewState()
+	outcome := Outcome{}
+	state.mu.Lock()
+	err := processRule(common.Server{}, firingRule(common.Action{Description: "count", Builtin: "count"}), state, opts, common.Log, &outcome)
+	state.mu.Unlock()
+	if err != nil {
+		t.Fatalf("processRule() error = %v", err)
+	}
+	if !outcome.Result || outcome.Silenced != "silence-1" || executed != 0 {
+		t.Errorf("processRule() outcome = %+v with %d executions, want the rule silenced", outcome, executed)
+	}
+	if state.rules["rule-1"].FiringSince.IsZero() {
+		t.Error("the silenced rule is not firing")
+	}
+}
@@ -0,0 +1,179 @@
+package hutch
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/tradeforce/lophutch/discovery"
+	"github.com/zignd/errors"
+)
+
+const rulesFile = "rules.json"
+
+// State is what is kept between scouts.
+type State struct {
+	mu         sync.Mutex
+	rules      map[string]*ruleState
+	path       string
+	notifier   *notifier
+	silences   *silenceStore
+	limiter    *limiter
+	discoverer *discovery.Discoverer
+	history    *history
+	// events is the event source of the rules with a trigger, which only
+	// runs on schedule.
+	events *eventSource
+}
+
+// ruleState is what is kept between scouts for each rule, identified by its
+// ID, and persisted when the State is loaded from the state directory.
+type ruleState struct {
+	// Delay is when the actions of the rule can be executed again.
+	Delay time.Time `json:"delay,omitempty"`
+	// FiringSince is when the rule started evaluating to true, it is zero
+	// while the rule evaluates to false.
+	FiringSince time.Time `json:"firing_since,omitempty"`
+	// Step is the number of escalation steps already executed.
+	Step int `json:"step,omitempty"`
+	// AcknowledgedBy is who acknowledged the rule, which stops its
+	// escalation until it resolves.
+	AcknowledgedBy string    `json:"acknowledged_by,omitempty"`
+	AcknowledgedAt time.Time `json:"acknowledged_at,omitempty"`
+	// Snapshot is the last snapshot of the collections of a changes rule.
+	Snapshot topologySnapshot `json:"snapshot,omitempty"`
+}
+
+// resolve clears the firing state of a rule that no longer fires.
+func (rs *ruleState) resolve() {
+	rs.FiringSince = time.Time{}
+	rs.Step = 0
+	rs.AcknowledgedBy = ""
+	rs.AcknowledgedAt = time.Time{}
+}
+
+// NewState returns the State of an application that has not scouted yet, it
+// is not persisted.
+func NewState() *State {
+	return &State{
+		rules:      make(map[string]*ruleState),
+		notifier:   newNotifier(),
+		silences:   newSilenceStore(common.StateDir()),
+		limiter:    newLimiter(),
+		discoverer: discovery.New(),
+		history:    newHistory(),
+	}
+}
+
+// LoadState returns the State persisted in the state directory, the State is
+// persisted again after each scout.
+func LoadState() (*State, error) {
+	state := NewState()
+	state.path = filepath.Join(common.StateDir(), rulesFile)
+	if err := readJSON(state.path, &state.rules); err != nil {
+		if _, statErr := os.Stat(state.path); !os.IsNotExist(statErr) {
+			return nil, errors.Wrapf(err, "failed to read the rules state from %s", state.path)
+		}
+	}
+	if state.rules == nil {
+		state.rules = make(map[string]*ruleState)
+	}
+
+	var persisted []persistedSeries
+	historyPath := filepath.Join(common.StateDir(), historyFile)
+	if err := readJSON(historyPath, &persisted); err != nil {
+		if _, statErr := os.Stat(historyPath); !os.IsNotExist(statErr) {
+			return nil, errors.Wrapf(err, "failed to read the history from %s", historyPath)
+		}
+	}
+	state.history.restore(persisted)
+	return state, nil
+}
+
+// save persists the state of the rules, and their history when configured
+// to, if the State was loaded from the state directory.
+func (s *State) save() error {
+	if s.path == "" {
+		return nil
+	}
+	if err := writeAtomic(s.path, s.rules); err != nil {
+		return errors.Wrap(err, "failed to persist the rules state")
+	}
+	if s.history.cfg.Persist {
+		path := filepath.Join(filepath.Dir(s.path), historyFile)
+		if err := writeAtomic(path, s.history.persisted()); err != nil {
+			return errors.Wrap(err, "failed to persist the history")
+		}
+	}
+	return nil
+}
+
+// writeAtomic writes v as JSON to a temporary file moved to path.
+func writeAtomic(path string, v interface{}) error {
+	tmp := path + ".tmp"
+	if err := writeJSON(tmp, v); err != nil {
+		return errors.Wrapf(err, "failed to write %s", tmp)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrapf(err, "failed to move %s to %s", tmp, path)
+	}
+	return nil
+}
+
+// rule returns the state of the rule identified by id, creating it if
+// needed.
+func (s *State) rule(id string) *ruleState {
+	rs, ok := s.rules[id]
+	if !ok {
+		rs = &ruleState{}
+		s.rules[id] = rs
+	}
+	return rs
+}
+
+// unlocked runs f without holding s.mu, which the caller holds, so that the
+// actions executed by f do not block the API and the events meanwhile.
+func (s *State) unlocked(f func()) {
+	s.mu.Unlock()
+	defer s.mu.Lock()
+	f()
+}
+
+// acknowledge stops the escalation of the firing rule identified by id.
+func (s *State) acknowledge(id, by string) (ruleState, error) {
+	if by == "" {
+		return ruleState{}, errors.New("who is acknowledging the rule is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs, ok := s.rules[id]
+	if !ok || rs.FiringSince.IsZero() {
+		return ruleState{}, errors.Errorf("rule %s is not firing", id)
+	}
+	rs.AcknowledgedBy = by
+	rs.AcknowledgedAt = time.Now()
+	if err := s.save(); err != nil {
+		return *rs, errors.Wrap(err, "failed to persist the acknowledgement")
+	}
+
+	common.Log.With(common.Fields{
+		"rule":            id,
+		"acknowledged_by": by,
+	}).Info("Rule acknowledged")
+
+	return *rs, nil
+}
+
+// snapshot returns a copy of the state of the rules.
+func (s *State) snapshot() map[string]ruleState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rules := make(map[string]ruleState, len(s.rules))
+	for id, rs := range s.rules {
+		rules[id] = *rs
+	}
+	return rules
+}
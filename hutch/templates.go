@@ -0,0 +1,376 @@
+package hutch
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// placeholder matches the `${name}` parameters of the rule templates and of
+// the named actions.
+var placeholder = regexp.MustCompile(`\$\{([A-Za-z0-9_.-]+)\}`)
+
+// templates are the named actions and rule templates the configuration can
+// refer to, by their lowercase name.
+type templates struct {
+	actions map[string]common.Action
+	rules   map[string]common.Rule
+}
+
+func getTemplates() (templates, error) {
+	var t templates
+	if err := viper.UnmarshalKey("Actions", &t.actions); err != nil {
+		return t, errors.Wrap(err, "failed to unmarshal the `Actions` setting")
+	}
+	if err := viper.UnmarshalKey("Rule_Templates", &t.rules); err != nil {
+		return t, errors.Wrap(err, "failed to unmarshal the `Rule_Templates` setting")
+	}
+	// The names are looked up in lowercase since viper may lowercase the
+	// keys of the maps it reads.
+	actions := make(map[string]common.Action, len(t.actions))
+	for name, action := range t.actions {
+		actions[strings.ToLower(name)] = action
+	}
+	rules := make(map[string]common.Rule, len(t.rules))
+	for name, rule := range t.rules {
+		rules[strings.ToLower(name)] = rule
+	}
+	t.actions, t.rules = actions, rules
+	return t, nil
+}
+
+// expandRule resolves the template and the named actions rule refers to.
+// The fields set in rule override the ones of its template, except Labels
+// which are merged, and the parameters of rule override the ones of the
+// template.
+func (t templates) expandRule(rule common.Rule) (common.Rule, error) {
+	if rule.Template == "" && len(rule.Params) == 0 && !usesActions(rule) {
+		return rule, nil
+	}
+
+	templated := rule.Template != ""
+	params := make(map[string]string)
+	ruleParams := rule.Params
+	if templated {
+		tmpl, ok := t.rules[strings.ToLower(rule.Template)]
+		if !ok {
+			return rule, errors.Errorcf(map[string]interface{}{
+				"rule": rule.ID,
+			}, "rule template %s is not defined", rule.Template)
+		}
+		mergeParams(params, tmpl.Params)
+		rule = overlayRule(tmpl, rule)
+	}
+	mergeParams(params, ruleParams)
+	rule.Template = ""
+	rule.Params = nil
+
+	if templated || len(params) > 0 {
+		if err := substitute(&rule, params); err != nil {
+			return rule, errors.Wrapcf(err, map[string]interface{}{
+				"rule": rule.ID,
+			}, "failed to expand rule %s", rule.ID)
+		}
+	}
+
+	var err error
+	if rule.Actions, err = t.expandActions(rule.Actions, params); err != nil {
+		return rule, errors.Wrapf(err, "failed to expand the actions of rule %s", rule.ID)
+	}
+	for i, step := range rule.Escalation {
+		if rule.Escalation[i].Actions, err = t.expandActions(step.Actions, params); err != nil {
+			return rule, errors.Wrapf(err, "failed to expand the escalation actions of rule %s", rule.ID)
+		}
+	}
+	for status, actions := range rule.OnStatus {
+		if rule.OnStatus[status], err = t.expandActions(actions, params); err != nil {
+			return rule, errors.Wrapf(err, "failed to expand the %s status actions of rule %s", status, rule.ID)
+		}
+	}
+	return rule, nil
+}
+
+// expandActions resolves the named actions of actions, whose placeholders
+// are replaced by the parameters of each action or else by params.
+func (t templates) expandActions(actions []common.Action, params map[string]string) ([]common.Action, error) {
+	if len(actions) == 0 {
+		return actions, nil
+	}
+	expanded := make([]common.Action, len(actions))
+	for i, action := range actions {
+		if action.Use == "" {
+			expanded[i] = action
+			continue
+		}
+		named, ok := t.actions[strings.ToLower(action.Use)]
+		if !ok {
+			return nil, errors.Errorf("action %s is not defined", action.Use)
+		}
+		actionParams := make(map[string]string)
+		mergeParams(actionParams, named.Params)
+		mergeParams(actionParams, params)
+		mergeParams(actionParams, action.Params)
+		action = overlayAction(named, action)
+		action.Use = ""
+		action.Params = nil
+		if err := substitute(&action, actionParams); err != nil {
+			return nil, errors.Wrapf(err, "failed to expand action %s", action.Description)
+		}
+		expanded[i] = action
+	}
+	return expanded, nil
+}
+
+func usesActions(rule common.Rule) bool {
+	for _, action := range rule.Actions {
+		if action.Use != "" {
+			return true
+		}
+	}
+	for _, step := range rule.Escalation {
+		for _, action := range step.Actions {
+			if action.Use != "" {
+				return true
+			}
+		}
+	}
+	for _, actions := range rule.OnStatus {
+		for _, action := range actions {
+			if action.Use != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func mergeParams(dst, src map[string]string) {
+	for k, v := range src {
+		dst[strings.ToLower(k)] = v
+	}
+}
+
+// overlayRule returns tmpl with the fields set in rule.
+func overlayRule(tmpl, rule common.Rule) common.Rule {
+	labels := make(map[string]string, len(tmpl.Labels)+len(rule.Labels))
+	for k, v := range tmpl.Labels {
+		labels[k] = v
+	}
+	for k, v := range rule.Labels {
+		labels[k] = v
+	}
+	if len(labels) > 0 {
+		tmpl.Labels = labels
+	}
+	if rule.ID != "" {
+		tmpl.ID = rule.ID
+	}
+	if rule.Description != "" {
+		tmpl.Description = rule.Description
+	}
+	if rule.Request.Method != "" {
+		tmpl.Request.Method = rule.Request.Method
+	}
+	if rule.Request.Path != "" {
+		tmpl.Request.Path = rule.Request.Path
+	}
+	if rule.Evaluator != "" {
+		tmpl.Evaluator = rule.Evaluator
+	}
+	if rule.Delay != 0 {
+		tmpl.Delay = rule.Delay
+	}
+	if len(rule.Actions) > 0 {
+		tmpl.Actions = rule.Actions
+	}
+	if len(rule.Escalation) > 0 {
+		tmpl.Escalation = rule.Escalation
+	}
+	if len(rule.OnStatus) > 0 {
+		tmpl.OnStatus = rule.OnStatus
+	}
+	if len(rule.Samples) > 0 {
+		tmpl.Samples = rule.Samples
+	}
+	if len(rule.Checks) > 0 {
+		tmpl.Checks = rule.Checks
+	}
+	if rule.Probe != nil {
+		tmpl.Probe = rule.Probe
+	}
+	if rule.Builtin != nil {
+		tmpl.Builtin = rule.Builtin
+	}
+	if rule.Drift != nil {
+		tmpl.Drift = rule.Drift
+	}
+	if rule.Changes != nil {
+		tmpl.Changes = rule.Changes
+	}
+	if rule.DeadLetters != nil {
+		tmpl.DeadLetters = rule.DeadLetters
+	}
+	if len(rule.Trigger) > 0 {
+		tmpl.Trigger = rule.Trigger
+	}
+	if rule.Selector != "" {
+		tmpl.Selector = rule.Selector
+	}
+	if rule.Request.Format != "" {
+		tmpl.Request.Format = rule.Request.Format
+	}
+	if len(rule.Request.Columns) > 0 {
+		tmpl.Request.Columns = rule.Request.Columns
+	}
+	if rule.Request.Port != 0 {
+		tmpl.Request.Port = rule.Request.Port
+	}
+	if rule.Request.Body != "" {
+		tmpl.Request.Body = rule.Request.Body
+	}
+	if rule.Request.AnyStatus {
+		tmpl.Request.AnyStatus = true
+	}
+	if rule.SkipDelayOnFailure {
+		tmpl.SkipDelayOnFailure = true
+	}
+	return tmpl
+}
+
+// overlayAction returns named with the fields set in action.
+func overlayAction(named, action common.Action) common.Action {
+	if action.Description != "" {
+		named.Description = action.Description
+	}
+	if action.Cmd != "" {
+		named.Cmd = action.Cmd
+	}
+	if len(action.Args) > 0 {
+		named.Args = action.Args
+	}
+	if action.Templated {
+		named.Templated = true
+	}
+	if action.Builtin != "" {
+		named.Builtin = action.Builtin
+	}
+	if len(action.Options) > 0 {
+		options := make(map[string]interface{}, len(named.Options)+len(action.Options))
+		for k, v := range named.Options {
+			options[k] = v
+		}
+		for k, v := range action.Options {
+			options[k] = v
+		}
+		named.Options = options
+	}
+	if action.OnFailure != "" {
+		named.OnFailure = action.OnFailure
+	}
+	if action.Retries != 0 {
+		named.Retries = action.Retries
+	}
+	if action.Backoff != 0 {
+		named.Backoff = action.Backoff
+	}
+	if action.Group != "" {
+		named.Group = action.Group
+	}
+	if action.RateLimit != nil {
+		named.RateLimit = action.RateLimit
+	}
+	return named
+}
+
+// substitute replaces the `${name}` placeholders of every string of v, a
+// pointer to a rule or an action, by the parameter name of params. A
+// placeholder without parameter is an error.
+func substitute(v interface{}, params map[string]string) error {
+	stringOptions(v)
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode the template")
+	}
+	var tree interface{}
+	if err := json.Unmarshal(b, &tree); err != nil {
+		return errors.Wrap(err, "failed to decode the template")
+	}
+	var missing []string
+	tree = substituteValue(tree, params, &missing)
+	if len(missing) > 0 {
+		return errors.Errorcf(map[string]interface{}{
+			"params": missing,
+		}, "missing parameters %s", strings.Join(missing, ", "))
+	}
+	if b, err = json.Marshal(tree); err != nil {
+		return errors.Wrap(err, "failed to encode the expanded template")
+	}
+	// v is reset first since decoding into its slices and pointers would
+	// modify the templates they are shared with.
+	elem := reflect.ValueOf(v).Elem()
+	elem.Set(reflect.Zero(elem.Type()))
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.Wrap(err, "failed to decode the expanded template")
+	}
+	return nil
+}
+
+// stringOptions converts the options of the actions of v, a pointer to a
+// rule or an action, with stringKeys since JSON can not encode the
+// map[interface{}]interface{} values they have when read from YAML.
+func stringOptions(v interface{}) {
+	switch v := v.(type) {
+	case *common.Action:
+		for k, val := range v.Options {
+			v.Options[k] = stringKeys(val)
+		}
+	case *common.Rule:
+		for i := range v.Actions {
+			stringOptions(&v.Actions[i])
+		}
+		for _, step := range v.Escalation {
+			for i := range step.Actions {
+				stringOptions(&step.Actions[i])
+			}
+		}
+		for _, actions := range v.OnStatus {
+			for i := range actions {
+				stringOptions(&actions[i])
+			}
+		}
+	}
+}
+
+func substituteValue(v interface{}, params map[string]string, missing *[]string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return placeholder.ReplaceAllStringFunc(v, func(m string) string {
+			name := strings.ToLower(placeholder.FindStringSubmatch(m)[1])
+			value, ok := params[name]
+			if !ok {
+				for _, n := range *missing {
+					if n == name {
+						return m
+					}
+				}
+				*missing = append(*missing, name)
+				return m
+			}
+			return value
+		})
+	case map[string]interface{}:
+		for k, val := range v {
+			v[k] = substituteValue(val, params, missing)
+		}
+	case []interface{}:
+		for i, val := range v {
+			v[i] = substituteValue(val, params, missing)
+		}
+	}
+	return v
+}
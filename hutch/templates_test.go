@@ -0,0 +1,152 @@
+package hutch
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/tradeforce/lophutch/discovery"
+)
+
+func TestSubstitute(t *testing.T) {
+	params := map[string]string{"queue": "orders", "channel": "#ops"}
+	tests := []struct {
+		name   string
+		action common.Action
+		want   common.Action
+	}{
+		{
+			name: "strings",
+			action: common.Action{
+				Description: "notify ${channel}",
+				Cmd:         "send-msg-slack",
+				Args:        []string{"--channel", "${channel}", "--message", "${queue} has ${QUEUE} messages"},
+			},
+			want: common.Action{
+				Description: "notify #ops",
+				Cmd:         "send-msg-slack",
+				Args:        []string{"--channel", "#ops", "--message", "orders has orders messages"},
+			},
+		},
+		{
+			name: "options read from YAML",
+			action: common.Action{
+				Builtin: "purge_queue",
+				Options: map[string]interface{}{
+					"queue": "${queue}",
+					"match": map[interface{}]interface{}{
+						"vhost": "/",
+						"names": []interface{}{"${queue}", map[interface{}]interface{}{1: "${channel}", true: "${channel}"}},
+					},
+				},
+			},
+			want: common.Action{
+				Builtin: "purge_queue",
+				Options: map[string]interface{}{
+					"queue": "orders",
+					"match": map[string]interface{}{
+						"vhost": "/",
+						"names": []interface{}{"orders", map[string]interface{}{"1": "#ops", "true": "#ops"}},
+					},
+				},
+			},
+		},
+		{
+			name:   "literal templates",
+			action: common.Action{Args: []string{"{{.Rule.ID}}", "$queue", "${}"}, Templated: true},
+			want:   common.Action{Args: []string{"{{.Rule.ID}}", "$queue", "${}"}, Templated: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action := test.action
+			if err := substitute(&action, params); err != nil {
+				t.Fatalf("substitute() error = %v", err)
+			}
+			if !reflect.DeepEqual(action, test.want) {
+				t.Errorf("substitute() = %+v, want %+v", action, test.want)
+			}
+		})
+	}
+}
+
+func TestSubstituteMissingParameters(t *testing.T) {
+	action := common.Action{Args: []string{"${queue}", "${channel}", "${queue}"}}
+	err := substitute(&action, map[string]string{})
+	if err == nil || !strings.Contains(err.Error(), "missing parameters queue, channel") {
+		t.Errorf("substitute() error = %v, want the missing queue and channel parameters", err)
+	}
+}
+
+// The named actions and rule templates of the configuration are expanded,
+// with the nested options the YAML parser decodes.
+func TestExpandRules(t *testing.T) {
+	configure(t, `
+actions:
+  purge:
+    builtin: purge_queue
+    options:
+      queue: ${queue}
+      match:
+        vhost: /
+      # The maps of a list are decoded with their boolean keys, like on.
+      headers:
+      - on: ${queue}
+rule_templates:
+  backlog:
+    id: backlog-${queue}
+    request:
+      method: GET
+      path: /api/queues/%2F/${queue}
+    actions:
+    - use: purge
+servers:
+- description: main
+  rules:
+  - template: backlog
+    params:
+      queue: orders
+  - template: backlog
+    params:
+      queue: payments
+    actions:
+    - use: purge
+      options:
+        match:
+          vhost: payments
+`)
+	servers, err := getServers(discovery.New())
+	if err != nil {
+		t.Fatalf("getServers() error = %v", err)
+	}
+	want := []common.Rule{
+		{
+			ID:      "backlog-orders",
+			Request: common.Request{Method: "GET", Path: "/api/queues/%2F/orders"},
+			Actions: []common.Action{{
+				Builtin: "purge_queue",
+				Options: map[string]interface{}{
+					"queue":   "orders",
+					"match":   map[string]interface{}{"vhost": "/"},
+					"headers": []interface{}{map[string]interface{}{"true": "orders"}},
+				},
+			}},
+		},
+		{
+			ID:      "backlog-payments",
+			Request: common.Request{Method: "GET", Path: "/api/queues/%2F/payments"},
+			Actions: []common.Action{{
+				Builtin: "purge_queue",
+				Options: map[string]interface{}{
+					"queue":   "payments",
+					"match":   map[string]interface{}{"vhost": "payments"},
+					"headers": []interface{}{map[string]interface{}{"true": "payments"}},
+				},
+			}},
+		},
+	}
+	if len(servers) != 1 || !reflect.DeepEqual(servers[0].Rules, want) {
+		t.Errorf("getServers() = %+v, want the rules %+v", servers, want)
+	}
+}
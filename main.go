@@ -1,31 +1,104 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/tradeforce/lophutch/common"
 	"github.com/tradeforce/lophutch/hutch"
+	"github.com/zignd/errors"
 )
 
 func init() {
 	if err := common.ConfigFlags(); err != nil {
-		log.Fatalf("Error:\n%+v", err)
+		common.Log.WithError(err).Fatal("Failed to configure the application")
 	}
 }
 
 var done = make(chan struct{})
 
 func main() {
+	if pflag.Arg(0) == "silence" {
+		if err := silence(pflag.Arg(1), pflag.Arg(2)); err != nil {
+			common.Log.WithError(err).Fatal("Failed to manage the silences")
+		}
+		return
+	}
+
+	if pflag.Arg(0) == "test" {
+		ok, err := hutch.Test(os.Stdout, viper.GetString("fixtures-dir"))
+		if err != nil {
+			common.Log.WithError(err).Fatal("Failed to test the rules")
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
 	if viper.GetBool("run-once") {
-		delays := make(map[string]time.Time)
-		if err := hutch.Scout(delays); err != nil {
-			log.Fatalf("Error:\n%+v", err)
+		state, err := hutch.LoadState()
+		if err != nil {
+			common.Log.WithError(err).Fatal("Failed to load the state")
+		}
+		if err := hutch.Scout(state); err != nil {
+			common.Log.WithError(err).Fatal("Failed to scout the servers")
 		}
 	} else {
 		if err := hutch.Schedule(done); err != nil {
-			log.Fatalf("Error:\n%+v", err)
+			common.Log.WithError(err).Fatal("Failed to schedule the scouts")
+		}
+	}
+}
+
+// silence executes the `silence add`, `silence list` and `silence expire <id>`
+// commands.
+func silence(cmd, id string) error {
+	switch cmd {
+	case "list":
+		return hutch.ListSilences(os.Stdout)
+	case "expire":
+		if id == "" {
+			return errors.New("the ID of the silence is required")
+		}
+		_, err := hutch.ExpireSilence(id, viper.GetString("silence-created-by"))
+		return err
+	case "add":
+		s := common.Silence{
+			Server:    viper.GetString("silence-server"),
+			Rule:      viper.GetString("silence-rule"),
+			CreatedBy: viper.GetString("silence-created-by"),
+			Reason:    viper.GetString("silence-reason"),
+			Start:     time.Now(),
+		}
+		if start := viper.GetString("silence-start"); start != "" {
+			t, err := time.Parse(time.RFC3339, start)
+			if err != nil {
+				return errors.Wrap(err, "invalid `--silence-start` flag")
+			}
+			s.Start = t
+		}
+		s.End = s.Start.Add(viper.GetDuration("silence-duration"))
+		for _, label := range viper.GetStringSlice("silence-label") {
+			parts := strings.SplitN(label, "=", 2)
+			if len(parts) != 2 {
+				return errors.Errorf("invalid label %s, expected the `name=value` form", label)
+			}
+			if s.Labels == nil {
+				s.Labels = make(map[string]string)
+			}
+			s.Labels[parts[0]] = parts[1]
+		}
+		s, err := hutch.AddSilence(s)
+		if err != nil {
+			return err
 		}
+		fmt.Println(s.ID)
+		return nil
 	}
+	return errors.Errorf("unknown silence command %s, expected add, list or expire", cmd)
 }
@@ -0,0 +1,371 @@
+// Package management is a typed client of the RabbitMQ Management API.
+package management
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// Client requests the Management API of a server with its connection
+// settings.
+type Client struct {
+	server common.Server
+	http   *http.Client
+}
+
+// New returns a client of the Management API of server.
+func New(server common.Server) *Client {
+	return &Client{
+		server: server,
+		http:   &http.Client{Timeout: defaultTimeout},
+	}
+}
+
+// NewWithClient returns a client of the Management API of server performing
+// its requests with client.
+func NewWithClient(server common.Server, client *http.Client) *Client {
+	return &Client{
+		server: server,
+		http:   client,
+	}
+}
+
+// StatusError is returned when the Management API answers with a status
+// other than 2xx.
+type StatusError struct {
+	Method string
+	Path   string
+	Status int
+	Reason string
+}
+
+func (e *StatusError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("%s %s returned %d %s: %s", e.Method, e.Path, e.Status, http.StatusText(e.Status), e.Reason)
+	}
+	return fmt.Sprintf("%s %s returned %d %s", e.Method, e.Path, e.Status, http.StatusText(e.Status))
+}
+
+// IsNotFound reports whether err, or one of its causes, is a StatusError
+// with the 404 status, e.g. for a deleted queue.
+func IsNotFound(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *StatusError:
+			return e.Status == http.StatusNotFound
+		case *errors.Error:
+			err = e.Cause
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// Overview returns the overview of the cluster.
+func (c *Client) Overview() (Overview, error) {
+	var overview Overview
+	err := c.get("/api/overview", &overview)
+	return overview, err
+}
+
+// Nodes returns the nodes of the cluster.
+func (c *Client) Nodes() ([]Node, error) {
+	var nodes []Node
+	err := c.get("/api/nodes", &nodes)
+	return nodes, err
+}
+
+// Queues returns the queues of vhost, or of every virtual host when vhost is
+// empty.
+func (c *Client) Queues(vhost string) ([]Queue, error) {
+	var queues []Queue
+	err := c.get(collection("/api/queues", vhost), &queues)
+	return queues, err
+}
+
+// Queue returns the queue name of vhost.
+func (c *Client) Queue(vhost, name string) (Queue, error) {
+	var queue Queue
+	err := c.get(path("/api/queues", vhost, name), &queue)
+	return queue, err
+}
+
+// Exchanges returns the exchanges of vhost, or of every virtual host when
+// vhost is empty.
+func (c *Client) Exchanges(vhost string) ([]Exchange, error) {
+	var exchanges []Exchange
+	err := c.get(collection("/api/exchanges", vhost), &exchanges)
+	return exchanges, err
+}
+
+// Bindings returns the bindings of vhost, or of every virtual host when
+// vhost is empty.
+func (c *Client) Bindings(vhost string) ([]Binding, error) {
+	var bindings []Binding
+	err := c.get(collection("/api/bindings", vhost), &bindings)
+	return bindings, err
+}
+
+// Connections returns the client connections.
+func (c *Client) Connections() ([]Connection, error) {
+	var connections []Connection
+	err := c.get("/api/connections", &connections)
+	return connections, err
+}
+
+// Channels returns the channels of every connection.
+func (c *Client) Channels() ([]Channel, error) {
+	var channels []Channel
+	err := c.get("/api/channels", &channels)
+	return channels, err
+}
+
+// Consumers returns the consumers of vhost, or of every virtual host when
+// vhost is empty.
+func (c *Client) Consumers(vhost string) ([]Consumer, error) {
+	var consumers []Consumer
+	err := c.get(collection("/api/consumers", vhost), &consumers)
+	return consumers, err
+}
+
+// Policies returns the policies of vhost, or of every virtual host when
+// vhost is empty.
+func (c *Client) Policies(vhost string) ([]Policy, error) {
+	var policies []Policy
+	err := c.get(collection("/api/policies", vhost), &policies)
+	return policies, err
+}
+
+// Definitions exports the definitions of the cluster.
+func (c *Client) Definitions() (Definitions, error) {
+	var definitions Definitions
+	err := c.get("/api/definitions", &definitions)
+	return definitions, err
+}
+
+// ImportDefinitions imports definitions, creating the objects that do not
+// exist and updating the others.
+func (c *Client) ImportDefinitions(definitions Definitions) error {
+	return c.do(http.MethodPost, "/api/definitions", definitions, nil)
+}
+
+// DeclareVhost creates vhost.
+func (c *Client) DeclareVhost(vhost Vhost) error {
+	return c.do(http.MethodPut, path("/api/vhosts", vhost.Name), struct{}{}, nil)
+}
+
+// DeclareQueue creates queue.
+func (c *Client) DeclareQueue(queue QueueDefinition) error {
+	return c.do(http.MethodPut, path("/api/queues", queue.Vhost, queue.Name), map[string]interface{}{
+		"durable":     queue.Durable,
+		"auto_delete": queue.AutoDelete,
+		"arguments":   queue.Arguments,
+	}, nil)
+}
+
+// DeclareExchange creates exchange.
+func (c *Client) DeclareExchange(exchange ExchangeDefinition) error {
+	return c.do(http.MethodPut, path("/api/exchanges", exchange.Vhost, exchange.Name), map[string]interface{}{
+		"type":        exchange.Type,
+		"durable":     exchange.Durable,
+		"auto_delete": exchange.AutoDelete,
+		"internal":    exchange.Internal,
+		"arguments":   exchange.Arguments,
+	}, nil)
+}
+
+// Bind creates binding.
+func (c *Client) Bind(binding Binding) error {
+	kind := "q"
+	if binding.DestinationType == "exchange" {
+		kind = "e"
+	}
+	p := path("/api/bindings", binding.Vhost, "e", binding.Source, kind, binding.Destination)
+	return c.do(http.MethodPost, p, map[string]interface{}{
+		"routing_key": binding.RoutingKey,
+		"arguments":   binding.Arguments,
+	}, nil)
+}
+
+// PutPolicy creates or updates policy.
+func (c *Client) PutPolicy(policy Policy) error {
+	return c.do(http.MethodPut, path("/api/policies", policy.Vhost, policy.Name), map[string]interface{}{
+		"pattern":    policy.Pattern,
+		"apply-to":   policy.ApplyTo,
+		"definition": policy.Definition,
+		"priority":   policy.Priority,
+	}, nil)
+}
+
+// PutUser creates or updates user.
+func (c *Client) PutUser(user User) error {
+	body := map[string]interface{}{
+		"password_hash": user.PasswordHash,
+		"tags":          user.Tags,
+	}
+	if user.HashingAlgorithm != "" {
+		body["hashing_algorithm"] = user.HashingAlgorithm
+	}
+	return c.do(http.MethodPut, path("/api/users", user.Name), body, nil)
+}
+
+// PutPermission grants permission.
+func (c *Client) PutPermission(permission Permission) error {
+	return c.do(http.MethodPut, path("/api/permissions", permission.Vhost, permission.User), map[string]interface{}{
+		"configure": permission.Configure,
+		"write":     permission.Write,
+		"read":      permission.Read,
+	}, nil)
+}
+
+// PurgeQueue removes the ready messages of the queue name of vhost.
+func (c *Client) PurgeQueue(vhost, name string) error {
+	return c.do(http.MethodDelete, path("/api/queues", vhost, name, "contents"), nil, nil)
+}
+
+// DeleteQueue deletes the queue name of vhost.
+func (c *Client) DeleteQueue(vhost, name string) error {
+	return c.do(http.MethodDelete, path("/api/queues", vhost, name), nil, nil)
+}
+
+// CloseConnection closes the connection name, giving reason to the client.
+func (c *Client) CloseConnection(name, reason string) error {
+	req := path("/api/connections", name)
+	if reason != "" {
+		return c.doHeaders(http.MethodDelete, req, nil, nil, map[string]string{"X-Reason": reason})
+	}
+	return c.do(http.MethodDelete, req, nil, nil)
+}
+
+// GetOptions tells how GetMessages fetches the messages of a queue.
+// Requeue puts the messages back in the queue, which otherwise removes them,
+// and Truncate limits the size of the returned payloads when positive.
+type GetOptions struct {
+	Count    int
+	Requeue  bool
+	Truncate int
+}
+
+// GetMessages fetches messages from the queue name of vhost.
+func (c *Client) GetMessages(vhost, name string, opts GetOptions) ([]Message, error) {
+	ackMode := "ack_requeue_false"
+	if opts.Requeue {
+		ackMode = "ack_requeue_true"
+	}
+	body := map[string]interface{}{
+		"count":    opts.Count,
+		"ackmode":  ackMode,
+		"encoding": "auto",
+	}
+	if opts.Truncate > 0 {
+		body["truncate"] = opts.Truncate
+	}
+	var messages []Message
+	err := c.do(http.MethodPost, path("/api/queues", vhost, name, "get"), body, &messages)
+	return messages, err
+}
+
+// Publish publishes publishing to the exchange name of vhost, the default
+// exchange being named `amq.default`, and reports whether it was routed to
+// a queue.
+func (c *Client) Publish(vhost, name string, publishing Publishing) (bool, error) {
+	if publishing.Properties == nil {
+		publishing.Properties = map[string]interface{}{}
+	}
+	if publishing.PayloadEncoding == "" {
+		publishing.PayloadEncoding = "string"
+	}
+	var result struct {
+		Routed bool `json:"routed"`
+	}
+	err := c.do(http.MethodPost, path("/api/exchanges", vhost, name, "publish"), publishing, &result)
+	return result.Routed, err
+}
+
+func (c *Client) get(p string, v interface{}) error {
+	return c.do(http.MethodGet, p, nil, v)
+}
+
+// do performs a request of the Management API, encoding body as JSON when
+// it is not nil and decoding the response into v when it is not nil.
+func (c *Client) do(method, p string, body, v interface{}) error {
+	return c.doHeaders(method, p, body, v, nil)
+}
+
+func (c *Client) doHeaders(method, p string, body, v interface{}, headers map[string]string) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode the body of the %s request to %s", method, p)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	urlStr := fmt.Sprintf("%s://%s:%d%s", c.server.Protocol, c.server.Host, c.server.Port, p)
+	req, err := http.NewRequest(method, urlStr, r)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create an HTTP request to %s", urlStr)
+	}
+	req.SetBasicAuth(c.server.User, c.server.Password)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to perform an HTTP %s request to %s", method, p)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		statusErr := &StatusError{Method: method, Path: p, Status: res.StatusCode}
+		var reason struct {
+			Reason string `json:"reason"`
+		}
+		if b, err := ioutil.ReadAll(res.Body); err == nil && json.Unmarshal(b, &reason) == nil {
+			statusErr.Reason = reason.Reason
+		}
+		return statusErr
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return errors.Wrapf(err, "failed to decode the response to the HTTP %s request to %s", method, p)
+	}
+	return nil
+}
+
+// path joins base with the escaped segments, such as virtual host names.
+func path(base string, segments ...string) string {
+	p := base
+	for _, segment := range segments {
+		p += "/" + url.PathEscape(segment)
+	}
+	return p
+}
+
+// collection returns the path of the objects of vhost under base, or of
+// every virtual host when vhost is empty.
+func collection(base, vhost string) string {
+	if vhost == "" {
+		return base
+	}
+	return path(base, vhost)
+}
@@ -0,0 +1,323 @@
+package management
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/tradeforce/lophutch/common"
+	"github.com/zignd/errors"
+)
+
+// apiRequest is a request received by the Management API stand-in.
+type apiRequest struct {
+	Method string
+	Path   string
+	Body   map[string]interface{}
+	Header http.Header
+}
+
+// apiStandIn serves the recorded responses of testdata by the method and
+// the escaped path of the requests, and records the requests.
+type apiStandIn struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []apiRequest
+}
+
+// newAPIStandIn starts a stand-in answering the requests of responses, by
+// `METHOD path`, with the body of the fixture file or `{}` when empty, and
+// the others with 404.
+func newAPIStandIn(t *testing.T, responses map[string]string) *apiStandIn {
+	t.Helper()
+	s := &apiStandIn{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := apiRequest{Method: r.Method, Path: r.URL.EscapedPath(), Header: r.Header}
+		if b, _ := ioutil.ReadAll(r.Body); len(b) > 0 {
+			json.Unmarshal(b, &req.Body)
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		s.mu.Unlock()
+
+		if user, password, _ := r.BasicAuth(); user != "monitor" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"not_authorised","reason":"Login failed"}`))
+			return
+		}
+		file, ok := responses[r.Method+" "+req.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"Object Not Found","reason":"Not Found"}`))
+			return
+		}
+		body := []byte("{}")
+		if file != "" {
+			var err error
+			if body, err = ioutil.ReadFile(filepath.Join("testdata", file)); err != nil {
+				t.Errorf("failed to read the fixture %s: %v", file, err)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// client returns a client of the stand-in.
+func (s *apiStandIn) client(t *testing.T) *Client {
+	t.Helper()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("invalid stand-in address %s: %v", s.URL, err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	return New(common.Server{Protocol: "http", Host: u.Hostname(), Port: port, User: "monitor", Password: "secret"})
+}
+
+func (s *apiStandIn) received() []apiRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]apiRequest(nil), s.requests...)
+}
+
+func TestClientGet(t *testing.T) {
+	s := newAPIStandIn(t, map[string]string{
+		"GET /api/overview":          "overview.json",
+		"GET /api/nodes":             "nodes.json",
+		"GET /api/queues":            "queues.json",
+		"GET /api/queues/%2F":        "queues.json",
+		"GET /api/queues/%2F/orders": "queue.json",
+		"GET /api/definitions":       "definitions.json",
+	})
+	c := s.client(t)
+
+	tests := []struct {
+		name  string
+		get   func() (interface{}, error)
+		check func(t *testing.T, v interface{})
+	}{
+		{
+			name: "overview",
+			get:  func() (interface{}, error) { return c.Overview() },
+			check: func(t *testing.T, v interface{}) {
+				o := v.(Overview)
+				if o.RabbitMQVersion != "3.12.4" || o.ObjectTotals.Queues != 3 || o.QueueTotals.MessagesUnacknowledged != 50 ||
+					o.MessageStats.PublishDetails.Rate != 12.4 {
+					t.Errorf("Overview() = %+v", o)
+				}
+			},
+		},
+		{
+			name: "nodes",
+			get:  func() (interface{}, error) { return c.Nodes() },
+			check: func(t *testing.T, v interface{}) {
+				nodes := v.([]Node)
+				if len(nodes) != 2 || nodes[0].Name != "rabbit@rabbit-1" || nodes[0].MemUsed != 1900000000 || !nodes[1].Running {
+					t.Errorf("Nodes() = %+v", nodes)
+				}
+			},
+		},
+		{
+			name: "queues",
+			get:  func() (interface{}, error) { return c.Queues("") },
+			check: func(t *testing.T, v interface{}) {
+				queues := v.([]Queue)
+				if len(queues) != 2 || queues[0].Messages != 1250 || queues[1].Type != "quorum" {
+					t.Fatalf("Queues() = %+v", queues)
+				}
+				if queues[0].HeadMessageTimestamp == nil || *queues[0].HeadMessageTimestamp != 1697700000 || queues[1].HeadMessageTimestamp != nil {
+					t.Errorf("Queues() head message timestamps = %v, %v", queues[0].HeadMessageTimestamp, queues[1].HeadMessageTimestamp)
+				}
+			},
+		},
+		{
+			name: "queues of a vhost",
+			get:  func() (interface{}, error) { return c.Queues("/") },
+			check: func(t *testing.T, v interface{}) {
+				if queues := v.([]Queue); len(queues) != 2 {
+					t.Errorf("Queues(/) = %+v", queues)
+				}
+			},
+		},
+		{
+			name: "queue",
+			get:  func() (interface{}, error) { return c.Queue("/", "orders") },
+			check: func(t *testing.T, v interface{}) {
+				q := v.(Queue)
+				if q.Name != "orders" || q.Policy != "ha-all" || q.Arguments["x-dead-letter-exchange"] != "dlx" {
+					t.Errorf("Queue() = %+v", q)
+				}
+			},
+		},
+		{
+			name: "definitions",
+			get:  func() (interface{}, error) { return c.Definitions() },
+			check: func(t *testing.T, v interface{}) {
+				d := v.(Definitions)
+				if len(d.Users) != 2 || len(d.Queues) != 1 || len(d.Exchanges) != 1 || len(d.Bindings) != 1 || len(d.Policies) != 1 {
+					t.Fatalf("Definitions() = %+v", d)
+				}
+				// The tags are a list since RabbitMQ 3.9, a string before.
+				if want := (Tags{"administrator"}); !reflect.DeepEqual(d.Users[0].Tags, want) {
+					t.Errorf("Definitions() tags = %v, want %v", d.Users[0].Tags, want)
+				}
+				if want := (Tags{"monitoring", "management"}); !reflect.DeepEqual(d.Users[1].Tags, want) {
+					t.Errorf("Definitions() tags = %v, want %v", d.Users[1].Tags, want)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v, err := test.get()
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			test.check(t, v)
+		})
+	}
+}
+
+func TestGetMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    GetOptions
+		ackMode string
+	}{
+		{name: "remove", opts: GetOptions{Count: 1}, ackMode: "ack_requeue_false"},
+		{name: "requeue", opts: GetOptions{Count: 5, Requeue: true, Truncate: 1024}, ackMode: "ack_requeue_true"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newAPIStandIn(t, map[string]string{"POST /api/queues/%2F/orders.dlq/get": "messages.json"})
+			messages, err := s.client(t).GetMessages("/", "orders.dlq", test.opts)
+			if err != nil {
+				t.Fatalf("GetMessages() error = %v", err)
+			}
+			if len(messages) != 1 || messages[0].Payload != `{"order":42,"card":"4111"}` || !messages[0].Redelivered {
+				t.Errorf("GetMessages() = %+v", messages)
+			}
+
+			body := s.received()[0].Body
+			if body["ackmode"] != test.ackMode || body["count"] != float64(test.opts.Count) || body["encoding"] != "auto" {
+				t.Errorf("GetMessages() requested %v, want the ack mode %s", body, test.ackMode)
+			}
+			if truncate, ok := body["truncate"]; ok != (test.opts.Truncate > 0) || (ok && truncate != float64(test.opts.Truncate)) {
+				t.Errorf("GetMessages() requested the truncate %v, want %d", truncate, test.opts.Truncate)
+			}
+		})
+	}
+}
+
+func TestPublish(t *testing.T) {
+	s := newAPIStandIn(t, map[string]string{"POST /api/exchanges/%2F/amq.default/publish": "publish.json"})
+	routed, err := s.client(t).Publish("/", "amq.default", Publishing{RoutingKey: "orders", Payload: "{}"})
+	if err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if !routed {
+		t.Error("Publish() = not routed, want routed")
+	}
+	body := s.received()[0].Body
+	want := map[string]interface{}{
+		"routing_key":      "orders",
+		"properties":       map[string]interface{}{},
+		"payload":          "{}",
+		"payload_encoding": "string",
+	}
+	if !reflect.DeepEqual(body, want) {
+		t.Errorf("Publish() requested %v, want %v", body, want)
+	}
+}
+
+func TestClientWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		do     func(c *Client) error
+		method string
+		path   string
+		header map[string]string
+	}{
+		{
+			name:   "purge queue",
+			do:     func(c *Client) error { return c.PurgeQueue("/", "orders") },
+			method: http.MethodDelete,
+			path:   "/api/queues/%2F/orders/contents",
+		},
+		{
+			name:   "delete queue",
+			do:     func(c *Client) error { return c.DeleteQueue("prod", "orders") },
+			method: http.MethodDelete,
+			path:   "/api/queues/prod/orders",
+		},
+		{
+			name:   "close connection",
+			do:     func(c *Client) error { return c.CloseConnection("10.0.0.1:5672 -> 10.0.0.2:5672", "stuck") },
+			method: http.MethodDelete,
+			path:   "/api/connections/10.0.0.1:5672%20-%3E%2010.0.0.2:5672",
+			header: map[string]string{"X-Reason": "stuck"},
+		},
+		{
+			name: "bind",
+			do: func(c *Client) error {
+				return c.Bind(Binding{Source: "dlx", Vhost: "/", Destination: "orders.dlq", DestinationType: "queue"})
+			},
+			method: http.MethodPost,
+			path:   "/api/bindings/%2F/e/dlx/q/orders.dlq",
+			header: map[string]string{"Content-Type": "application/json"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newAPIStandIn(t, map[string]string{test.method + " " + test.path: ""})
+			if err := test.do(s.client(t)); err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			req := s.received()[0]
+			if req.Method != test.method || req.Path != test.path {
+				t.Errorf("requested %s %s, want %s %s", req.Method, req.Path, test.method, test.path)
+			}
+			for name, value := range test.header {
+				if got := req.Header.Get(name); got != value {
+					t.Errorf("requested with the header %s = %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	s := newAPIStandIn(t, nil)
+	c := s.client(t)
+
+	_, err := c.Queue("/", "deleted")
+	if !IsNotFound(err) {
+		t.Fatalf("Queue() error = %v, want not found", err)
+	}
+	if want := "GET /api/queues/%2F/deleted returned 404 Not Found: Not Found"; err.Error() != want {
+		t.Errorf("Queue() error = %q, want %q", err.Error(), want)
+	}
+	if !IsNotFound(errors.Wrap(err, "failed to get the queue")) {
+		t.Error("IsNotFound() = false for a wrapped 404")
+	}
+
+	c.server.Password = "wrong"
+	_, err = c.Overview()
+	statusErr, ok := err.(*StatusError)
+	if !ok || statusErr.Status != http.StatusUnauthorized || statusErr.Reason != "Login failed" {
+		t.Fatalf("Overview() error = %v, want a 401 status error", err)
+	}
+	if IsNotFound(err) {
+		t.Error("IsNotFound() = true for a 401")
+	}
+}
@@ -0,0 +1,292 @@
+package management
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Rate is the rate of change of a counter, per second.
+type Rate struct {
+	Rate float64 `json:"rate"`
+}
+
+// MessageStats are the message counters of an object, with their rates.
+type MessageStats struct {
+	Publish           int64 `json:"publish"`
+	PublishDetails    Rate  `json:"publish_details"`
+	Deliver           int64 `json:"deliver"`
+	DeliverDetails    Rate  `json:"deliver_details"`
+	DeliverGet        int64 `json:"deliver_get"`
+	DeliverGetDetails Rate  `json:"deliver_get_details"`
+	Ack               int64 `json:"ack"`
+	AckDetails        Rate  `json:"ack_details"`
+	Redeliver         int64 `json:"redeliver"`
+	RedeliverDetails  Rate  `json:"redeliver_details"`
+}
+
+// ObjectTotals counts the objects of a cluster.
+type ObjectTotals struct {
+	Connections int `json:"connections"`
+	Channels    int `json:"channels"`
+	Exchanges   int `json:"exchanges"`
+	Queues      int `json:"queues"`
+	Consumers   int `json:"consumers"`
+}
+
+// QueueTotals counts the messages of every queue of a cluster.
+type QueueTotals struct {
+	Messages               int64 `json:"messages"`
+	MessagesReady          int64 `json:"messages_ready"`
+	MessagesUnacknowledged int64 `json:"messages_unacknowledged"`
+}
+
+// Overview describes a cluster, as returned by `/api/overview`.
+type Overview struct {
+	ManagementVersion string       `json:"management_version"`
+	RabbitMQVersion   string       `json:"rabbitmq_version"`
+	ErlangVersion     string       `json:"erlang_version"`
+	ClusterName       string       `json:"cluster_name"`
+	Node              string       `json:"node"`
+	ObjectTotals      ObjectTotals `json:"object_totals"`
+	QueueTotals       QueueTotals  `json:"queue_totals"`
+	MessageStats      MessageStats `json:"message_stats"`
+}
+
+// Node is a node of a cluster, as returned by `/api/nodes`.
+type Node struct {
+	Name                     string   `json:"name"`
+	Type                     string   `json:"type"`
+	Running                  bool     `json:"running"`
+	Uptime                   int64    `json:"uptime"`
+	MemUsed                  int64    `json:"mem_used"`
+	MemLimit                 int64    `json:"mem_limit"`
+	MemAlarm                 bool     `json:"mem_alarm"`
+	DiskFree                 int64    `json:"disk_free"`
+	DiskFreeLimit            int64    `json:"disk_free_limit"`
+	DiskFreeAlarm            bool     `json:"disk_free_alarm"`
+	FDUsed                   int64    `json:"fd_used"`
+	FDTotal                  int64    `json:"fd_total"`
+	SocketsUsed              int64    `json:"sockets_used"`
+	SocketsTotal             int64    `json:"sockets_total"`
+	ProcUsed                 int64    `json:"proc_used"`
+	ProcTotal                int64    `json:"proc_total"`
+	Partitions               []string `json:"partitions"`
+	ConnectionCreated        int64    `json:"connection_created"`
+	ConnectionCreatedDetails Rate     `json:"connection_created_details"`
+	ConnectionClosed         int64    `json:"connection_closed"`
+	ConnectionClosedDetails  Rate     `json:"connection_closed_details"`
+}
+
+// Queue is a queue, as returned by `/api/queues`. HeadMessageTimestamp is
+// the timestamp, in seconds, of the oldest message of the queue, when the
+// messages are published with one and the queue reports it.
+type Queue struct {
+	Name                          string                 `json:"name"`
+	Vhost                         string                 `json:"vhost"`
+	Type                          string                 `json:"type"`
+	Durable                       bool                   `json:"durable"`
+	AutoDelete                    bool                   `json:"auto_delete"`
+	Exclusive                     bool                   `json:"exclusive"`
+	Arguments                     map[string]interface{} `json:"arguments"`
+	Node                          string                 `json:"node"`
+	State                         string                 `json:"state"`
+	Policy                        string                 `json:"policy"`
+	Consumers                     int                    `json:"consumers"`
+	Messages                      int64                  `json:"messages"`
+	MessagesDetails               Rate                   `json:"messages_details"`
+	MessagesReady                 int64                  `json:"messages_ready"`
+	MessagesReadyDetails          Rate                   `json:"messages_ready_details"`
+	MessagesUnacknowledged        int64                  `json:"messages_unacknowledged"`
+	MessagesUnacknowledgedDetails Rate                   `json:"messages_unacknowledged_details"`
+	HeadMessageTimestamp          *int64                 `json:"head_message_timestamp"`
+	IdleSince                     string                 `json:"idle_since"`
+	MessageStats                  MessageStats           `json:"message_stats"`
+}
+
+// Exchange is an exchange, as returned by `/api/exchanges`.
+type Exchange struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost"`
+	Type       string                 `json:"type"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Internal   bool                   `json:"internal"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+// Binding binds the Source exchange to the Destination queue or exchange,
+// DestinationType being either `queue` or `exchange`.
+type Binding struct {
+	Source          string                 `json:"source"`
+	Vhost           string                 `json:"vhost"`
+	Destination     string                 `json:"destination"`
+	DestinationType string                 `json:"destination_type"`
+	RoutingKey      string                 `json:"routing_key"`
+	Arguments       map[string]interface{} `json:"arguments"`
+	PropertiesKey   string                 `json:"properties_key,omitempty"`
+}
+
+// Connection is a client connection, as returned by `/api/connections`.
+type Connection struct {
+	Name             string                 `json:"name"`
+	Node             string                 `json:"node"`
+	User             string                 `json:"user"`
+	Vhost            string                 `json:"vhost"`
+	State            string                 `json:"state"`
+	PeerHost         string                 `json:"peer_host"`
+	Channels         int                    `json:"channels"`
+	ConnectedAt      int64                  `json:"connected_at"`
+	ClientProperties map[string]interface{} `json:"client_properties"`
+}
+
+// ChannelDetails identifies the channel of a consumer.
+type ChannelDetails struct {
+	Name           string `json:"name"`
+	Number         int    `json:"number"`
+	ConnectionName string `json:"connection_name"`
+	PeerHost       string `json:"peer_host"`
+	User           string `json:"user"`
+}
+
+// Channel is a channel of a connection, as returned by `/api/channels`.
+type Channel struct {
+	Name                   string         `json:"name"`
+	Node                   string         `json:"node"`
+	Number                 int            `json:"number"`
+	User                   string         `json:"user"`
+	Vhost                  string         `json:"vhost"`
+	State                  string         `json:"state"`
+	Consumers              int            `json:"consumer_count"`
+	MessagesUnacknowledged int64          `json:"messages_unacknowledged"`
+	PrefetchCount          int            `json:"prefetch_count"`
+	ConnectionDetails      ChannelDetails `json:"connection_details"`
+	MessageStats           MessageStats   `json:"message_stats"`
+}
+
+// QueueDetails identifies the queue of a consumer.
+type QueueDetails struct {
+	Name  string `json:"name"`
+	Vhost string `json:"vhost"`
+}
+
+// Consumer is a consumer of a queue, as returned by `/api/consumers`.
+type Consumer struct {
+	ConsumerTag    string         `json:"consumer_tag"`
+	Queue          QueueDetails   `json:"queue"`
+	ChannelDetails ChannelDetails `json:"channel_details"`
+	AckRequired    bool           `json:"ack_required"`
+	Exclusive      bool           `json:"exclusive"`
+	Active         bool           `json:"active"`
+	PrefetchCount  int            `json:"prefetch_count"`
+}
+
+// Policy is a policy, as returned by `/api/policies` and found in the
+// definitions.
+type Policy struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost"`
+	Pattern    string                 `json:"pattern"`
+	ApplyTo    string                 `json:"apply-to"`
+	Definition map[string]interface{} `json:"definition"`
+	Priority   int                    `json:"priority"`
+}
+
+// User is a user of the definitions.
+type User struct {
+	Name             string `json:"name"`
+	PasswordHash     string `json:"password_hash"`
+	HashingAlgorithm string `json:"hashing_algorithm"`
+	Tags             Tags   `json:"tags"`
+}
+
+// Tags are the tags of a user, which are a comma separated string before
+// RabbitMQ 3.9 and a list since.
+type Tags []string
+
+// UnmarshalJSON decodes both forms of the tags.
+func (t *Tags) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = nil
+		for _, tag := range strings.Split(s, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				*t = append(*t, tag)
+			}
+		}
+		return nil
+	}
+	var tags []string
+	if err := json.Unmarshal(b, &tags); err != nil {
+		return err
+	}
+	*t = tags
+	return nil
+}
+
+// Vhost is a virtual host of the definitions.
+type Vhost struct {
+	Name string `json:"name"`
+}
+
+// Permission grants a user access to a virtual host.
+type Permission struct {
+	User      string `json:"user"`
+	Vhost     string `json:"vhost"`
+	Configure string `json:"configure"`
+	Write     string `json:"write"`
+	Read      string `json:"read"`
+}
+
+// QueueDefinition is a queue of the definitions.
+type QueueDefinition struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+// ExchangeDefinition is an exchange of the definitions.
+type ExchangeDefinition struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost"`
+	Type       string                 `json:"type"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Internal   bool                   `json:"internal"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+// Definitions is the topology of a cluster, as exported by
+// `/api/definitions`.
+type Definitions struct {
+	RabbitVersion string               `json:"rabbit_version,omitempty"`
+	Users         []User               `json:"users,omitempty"`
+	Vhosts        []Vhost              `json:"vhosts,omitempty"`
+	Permissions   []Permission         `json:"permissions,omitempty"`
+	Policies      []Policy             `json:"policies,omitempty"`
+	Queues        []QueueDefinition    `json:"queues,omitempty"`
+	Exchanges     []ExchangeDefinition `json:"exchanges,omitempty"`
+	Bindings      []Binding            `json:"bindings,omitempty"`
+}
+
+// Message is a message fetched from a queue by `Client.GetMessages`.
+type Message struct {
+	Exchange        string                 `json:"exchange"`
+	RoutingKey      string                 `json:"routing_key"`
+	Redelivered     bool                   `json:"redelivered"`
+	MessageCount    int                    `json:"message_count"`
+	Properties      map[string]interface{} `json:"properties"`
+	Payload         string                 `json:"payload"`
+	PayloadBytes    int                    `json:"payload_bytes"`
+	PayloadEncoding string                 `json:"payload_encoding"`
+}
+
+// Publishing is a message published by `Client.Publish`. PayloadEncoding is
+// either `string` or `base64`.
+type Publishing struct {
+	RoutingKey      string                 `json:"routing_key"`
+	Properties      map[string]interface{} `json:"properties"`
+	Payload         string                 `json:"payload"`
+	PayloadEncoding string                 `json:"payload_encoding"`
+}